@@ -1,31 +1,35 @@
 package main
 
 import (
+    "context"
     "flag"
     "fmt"
     "github.com/gorilla/handlers"
     "github.com/gorilla/mux"
+    "io"
     "log"
     "net/http"
+    "os"
+    "osdata/osvtile/container/disk"
     "osdata/osvtile/container/lru"
-    "osdata/osvtile/mbtiles"
+    "osdata/osvtile/tile"
+    "osdata/osvtile/tileset"
     "osdata/osvtile/web"
-    "regexp"
-    "strconv"
-    "strings"
-)
-
-const (
-    kb int64 = 1024
-    mb       = kb * 1024
-    gb       = mb * 1024
+    "time"
 )
 
 func main() {
 
+    if len(os.Args) > 1 && os.Args[1] == "seed" {
+        seed(os.Args[2:])
+        return
+    }
+
     flag.Usage = func() {
         fmt.Println("Usage: osvtiled [OPTIONS]\n\nSimple server to deliver Ordnance Survey Zoom Stack MBtiles")
         fmt.Println()
+        fmt.Println("Run `osvtiled seed -h` for the options to seed the disk cache")
+        fmt.Println()
         flag.PrintDefaults()
         fmt.Println()
     }
@@ -33,43 +37,82 @@ func main() {
     port := flag.Int("port", 8080, "port on which to run server")
     cors := flag.Bool("cors", false, "enable cors handling")
     proxy := flag.Bool("proxy", false, "enable proxy header support (when behind nginx, apache etc)")
-    zoomstack := flag.String("zoomstack", ".", "location of the zoomstack package to serve up")
     static := flag.String("static", ".", "directory to the root static web content (index.html, style etc)")
-    cacheSize := flag.String("cache", "512m", "cache size: format <INTEGER><k|m|g>, e.g. 1g or 512mb")
-    hillshade := flag.String("hillshade", ".", "location of the hillshade package to serve up")
+    cacheSize := flag.String("cache", "512m", "cache size: format <INTEGER><k|m|g>, e.g. 1g or 512mb (includes any tileset budgets)")
+    cachePolicy := flag.String("cache-policy", "lru", "cache eviction policy: lru, lfu, arc or tinylfu")
+    sources := addTilesetFlags(flag.CommandLine)
+    negativeSize := flag.Int("negative-cache", 100000, "number of missing tiles to remember, 0 to disable")
+    negativeTTL := flag.Duration("negative-ttl", 10*time.Minute, "how long to remember a missing tile for")
+    adminToken := flag.String("admin-token", "", "bearer token for the /admin endpoints, the endpoints are disabled if not set")
+    seedMaxTiles := flag.Int64("seed-max-tiles", 1000000, "most tiles a seed job started through /admin/cache/seed may fetch, 0 for no limit")
+    diskCache := addDiskFlags(flag.CommandLine)
+    cacheSweep := flag.Duration("cache-sweep", time.Minute, "how often to remove expired tiles from the cache, 0 to only remove them when requested")
+    accessLog := flag.String("access-log", "", "file to write the access log to, rotated by size, the standard error if not set")
+    accessLogFormat := flag.String("access-log-format", web.AccessLogLegacy, "access log format: json, combined or legacy")
+    accessLogFields := flag.String("access-log-fields", "", "optional access log fields: requestId, traceId, tileset, tile, cache, bytes, fetchTime or all, comma separated")
+    accessLogSize := flag.String("access-log-size", "100m", "size at which the access log file is rotated: format <INTEGER><k|m|g>")
+    accessLogKeep := flag.Int("access-log-keep", 5, "number of rotated access log files to keep")
+    snapshot := flag.String("snapshot", "", "file to save the cache to on shutdown and load it from on startup, disabled if not set")
 
     flag.Parse()
 
     log.Println("server starting")
 
     // parse the cache size
-    re := regexp.MustCompile(`([1-9]\d*)([kmg])`)
-    matches := re.FindStringSubmatch(strings.TrimSpace(*cacheSize))
+    bytesize, err := lru.ParseSize(*cacheSize)
 
-    if matches == nil || len(matches) == 0 {
+    if err != nil {
         log.Fatalf("invalid cacheSize value: value = %s", *cacheSize)
     }
 
-    size, _ := strconv.Atoi(matches[1])
-    bytesize := int64(0)
+    policy, err := lru.ParsePolicy(*cachePolicy)
 
-    switch matches[2] {
-    case "g":
-        bytesize = int64(size) * gb
-    case "m":
-        bytesize = int64(size) * mb
-    default:
-        bytesize = int64(size) * kb
+    if err != nil {
+        log.Fatalf("invalid cache policy: error = %s", err)
     }
 
-    cache := lru.New(bytesize)
+    // tile datasources
+    tilesets := sources.load()
+
+    // cache usage is reported by tileset, with budgets reserved by the tileset config
+    budgets, budgetFunc := web.CacheBudgets(tilesets)
+    reserved := int64(0)
 
-    // vector datasource
-    zsds := loadMVT(*zoomstack)
+    for _, b := range budgets {
+        reserved += b.MaxSize
+    }
+
+    if reserved > bytesize {
+        log.Fatalf("tileset cache budgets exceed the cache size: reserved = %d, cache = %d", reserved, bytesize)
+    }
+
+    opts := []lru.Option{lru.WithPolicy(policy), lru.WithNamespaces(tile.Namespace), lru.WithBudgets(budgetFunc, budgets...)}
+
+    if *negativeSize > 0 {
+        opts = append(opts, lru.WithNegative(*negativeSize, *negativeTTL))
+    }
+
+    opts = append(opts, lru.WithTTL(web.CacheTTLs(tilesets)))
+
+    if *cacheSweep > 0 {
+        opts = append(opts, lru.WithSweeper(*cacheSweep))
+    }
+
+    cache := lru.New(bytesize, opts...)
+    defer cache.Close()
 
     metrics := web.NewMetrics()
+    store := diskCache.open(disk.WithSources(web.DiskSources(tilesets)), disk.WithTTL(disk.TTLFunc(web.CacheTTLs(tilesets))))
+    tiles := web.NewTileFetcher(cache, store, metrics)
+
+    if *snapshot != "" {
+        if _, err := tiles.LoadSnapshot(context.Background(), *snapshot, tilesets); err != nil {
+            log.Printf("failed to load cache snapshot, starting cold: path = %s, error = %s", *snapshot, err)
+        }
+    }
 
     r := mux.NewRouter()
+    r.Use(web.NewRouteHandler)
 
     // add in the wrappers
     var h http.Handler
@@ -94,6 +137,11 @@ func main() {
                 "Expires",
                 "Last-Modified",
                 "Content-Length",
+                "Authorization",
+                "If-None-Match",
+                "If-Modified-Since",
+                "X-Request-ID",
+                "traceparent",
             }),
             handlers.AllowedMethods([]string{
                 "GET", "HEAD", "POST", "DELETE", "PUT",
@@ -104,24 +152,79 @@ func main() {
                 "ETag",
                 "Expires",
                 "Last-Modified",
+                "X-Request-ID",
+                "traceparent",
             }),
         )(h)
     }
 
-    // default handlers will be the logger and clacks
-    h = web.NewRequestHandler(metrics, web.NewClacksHandler(h))
+    // access log goes to standard error unless a file is given
+    fields, err := web.ParseAccessFields(*accessLogFields)
+
+    if err != nil {
+        log.Fatalf("invalid access log fields: error = %s", err)
+    }
+
+    var out io.Writer = os.Stderr
+
+    if *accessLog != "" {
+        size, err := lru.ParseSize(*accessLogSize)
+
+        if err != nil {
+            log.Fatalf("invalid access log size value: value = %s", *accessLogSize)
+        }
+
+        file, err := web.OpenRotatingFile(*accessLog, size, *accessLogKeep)
+
+        if err != nil {
+            log.Fatalf("failed to open access log: path = %s, error = %s", *accessLog, err)
+        }
+
+        defer func() {
+            if err := file.Close(); err != nil {
+                log.Printf("error closing access log: error = %s", err)
+            }
+        }()
+
+        out = file
+    }
+
+    logger, err := web.NewAccessLogger(out, *accessLogFormat, fields)
+
+    if err != nil {
+        log.Fatalf("invalid access log format: error = %s", err)
+    }
+
+    // default handlers will be the request IDs, logger and clacks
+    h = web.NewTraceHandler(web.NewRequestHandler(metrics, logger, web.NewClacksHandler(h)))
 
     // routes
-    r.HandleFunc("/status", web.NewStatusHandler(metrics, cache))
-    r.HandleFunc("/{name:[A-Za-z0-9_]+}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}/tile.mvt", web.NewMVTRequestHandler(zsds, cache))
-    r.HandleFunc("/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}/tile.mvt", web.NewMVTRequestHandler(zsds, cache))
+    r.HandleFunc("/status", web.NewStatusHandler(metrics, tiles, tilesets))
+    r.HandleFunc("/metrics", web.NewPrometheusHandler(metrics, tiles))
+    r.HandleFunc("/{scheme:tms}/{name:[A-Za-z0-9_]+}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}/tile.mvt", web.NewMVTRequestHandler(tilesets, "zoomstack", tiles))
+    r.HandleFunc("/{scheme:tms}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}/tile.mvt", web.NewMVTRequestHandler(tilesets, "zoomstack", tiles))
+    r.HandleFunc("/{scheme:tms}/{name:[A-Za-z0-9_]+}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}/hs.png", web.NewRasterDEMRequestHandler(tilesets, "hillshade", tiles))
+    r.HandleFunc("/{scheme:tms}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}/hs.png", web.NewRasterDEMRequestHandler(tilesets, "hillshade", tiles))
+    r.HandleFunc("/{name:[A-Za-z0-9_]+}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}/tile.mvt", web.NewMVTRequestHandler(tilesets, "zoomstack", tiles))
+    r.HandleFunc("/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}/tile.mvt", web.NewMVTRequestHandler(tilesets, "zoomstack", tiles))
+    r.HandleFunc("/{name:[A-Za-z0-9_]+}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}/hs.png", web.NewRasterDEMRequestHandler(tilesets, "hillshade", tiles))
+    r.HandleFunc("/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}/hs.png", web.NewRasterDEMRequestHandler(tilesets, "hillshade", tiles))
+
+    for _, format := range []web.TileFormat{web.FormatJPG, web.FormatWebP} {
+        r.HandleFunc("/{scheme:tms}/{name:[A-Za-z0-9_]+}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}/"+format.File, web.NewTileRequestHandler(tilesets, "", tiles, format))
+        r.HandleFunc("/{name:[A-Za-z0-9_]+}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}/"+format.File, web.NewTileRequestHandler(tilesets, "", tiles, format))
+    }
+
+    r.HandleFunc("/tiles.json", web.NewTileJSONHandler(tilesets, "zoomstack"))
+    r.HandleFunc("/{name:[A-Za-z0-9_]+}.json", web.NewTileJSONHandler(tilesets, "")).MatcherFunc(web.TilesetMatcher(tilesets))
 
-    var hsds *mbtiles.MBTiles = nil
+    seeder := web.NewSeedHandler(tilesets, tiles, *seedMaxTiles)
 
-    if hillshade != nil {
-        hsds = loadMVT(*hillshade)
-        r.HandleFunc("/{name:[A-Za-z0-9_]+}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}/hs.png", web.NewRasterDEMRequestHandler(hsds, cache))
-        r.HandleFunc("/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}/hs.png", web.NewRasterDEMRequestHandler(hsds, cache))
+    if *adminToken != "" {
+        log.Printf("enabled admin endpoints")
+        admin := r.PathPrefix("/admin").Subrouter()
+        admin.Handle("/cache/purge", web.NewAdminHandler(*adminToken, web.NewPurgeHandler(tiles))).Methods("POST")
+        admin.Handle("/cache/seed", web.NewAdminHandler(*adminToken, seeder)).Methods("GET", "POST", "DELETE")
     }
 
     r.HandleFunc("/fonts/{stack}/{file}", web.NewFontHandler(fmt.Sprintf("%s/fonts", *static)))
@@ -134,20 +237,21 @@ func main() {
         *port,
     )
 
-    defer func() {
-
-        log.Println("closing zoomstack mbtile package")
-        if err := zsds.Close(); err != nil {
-            log.Printf("error closing zoomstack mbtile package: error = %s", err)
-        }
+    // any seed job is stopped before the cache is saved
+    s.OnShutdown(seeder.Cancel)
 
-        if hsds == nil {
-            return
-        }
+    if *snapshot != "" {
+        s.OnShutdown(func() {
+            if _, err := tiles.WriteSnapshot(context.Background(), *snapshot, tilesets); err != nil {
+                log.Printf("failed to write cache snapshot: path = %s, error = %s", *snapshot, err)
+            }
+        })
+    }
 
-        log.Println("closing hillshade mbtile package")
-        if err := hsds.Close(); err != nil {
-            log.Printf("error closing hillshade mbtile package: error = %s", err)
+    defer func() {
+        log.Println("closing tilesets")
+        if err := tilesets.Close(); err != nil {
+            log.Printf("error closing tilesets: error = %s", err)
         }
     }()
 
@@ -158,21 +262,128 @@ func main() {
     log.Println("server closed")
 }
 
-// util function to load an mbtiles package or fail and dump an error
-func loadMVT(path string) *mbtiles.MBTiles {
-    tiles, err := mbtiles.NewMVT(path)
+// tilesetFlags select the tilesets to load, shared by the server and the seed command
+type tilesetFlags struct {
+    zoomstack *string
+    hillshade *string
+    zsScheme  *string
+    hsScheme  *string
+    dir       *string
+    config    *string
+    maxAge    *string
+    cacheTTL  *string
+    timeout   *string
+    conns     *int
+    mmap      *string
+    pageCache *string
+    mutable   *bool
+    preload   *bool
+    limit     *string
+}
 
-    if err != nil {
-        log.Fatalf("failed to load MBTiles package: error = %s", err)
+func addTilesetFlags(fs *flag.FlagSet) *tilesetFlags {
+    return &tilesetFlags{
+        zoomstack: fs.String("zoomstack", "", "location of the zoomstack package to serve up"),
+        hillshade: fs.String("hillshade", "", "location of the hillshade package to serve up"),
+        zsScheme:  fs.String("zoomstack-scheme", "", "row scheme of the zoomstack package, xyz or tms, overriding the package metadata (tms if neither is set)"),
+        hsScheme:  fs.String("hillshade-scheme", "xyz", "row scheme of the hillshade package, xyz or tms, overriding the package metadata (xyz, as the bundled map expects, unless set)"),
+        dir:       fs.String("tilesets", "", "directory of MBTiles packages to serve up, each named after its file"),
+        config:    fs.String("config", "", "JSON config file listing the tilesets to serve up"),
+        maxAge:    fs.String("max-age", "", "default time clients may cache tiles for, e.g. 24h (overridden per tileset in the config)"),
+        cacheTTL:  fs.String("cache-ttl", "", "default time tiles stay in the cache for, e.g. 1h (overridden per tileset in the config)"),
+        timeout:   fs.String("fetch-timeout", "", "default deadline for fetching a tile from a package, e.g. 2s (overridden per tileset in the config)"),
+        conns:     fs.Int("read-conns", 0, "connections reading each package at once, 0 for GOMAXPROCS (overridden per tileset in the config)"),
+        mmap:      fs.String("mmap-size", "", "bytes of each package read through a memory map, e.g. 1g (overridden per tileset in the config)"),
+        pageCache: fs.String("page-cache", "", "SQLite page cache of each package connection, e.g. 16m (overridden per tileset in the config)"),
+        mutable:   fs.Bool("mutable", false, "open packages in normal read-only mode rather than immutable mode, if they may be modified while served"),
+        preload:   fs.Bool("preload", false, "read each package into memory on startup, rather than reading tiles from it as requested"),
+        limit:     fs.String("preload-limit", "1g", "most tile data a preloaded package may hold, identical tiles counted once, startup fails on a larger package: format <INTEGER><k|m|g>"),
+    }
+}
+
+// load creates the registry of tilesets selected by the flags, failing on any error
+func (f *tilesetFlags) load() *tileset.Registry {
+    tilesets := tileset.NewRegistry()
+    defaults := tileset.Config{
+        MaxAge:       *f.maxAge,
+        CacheTTL:     *f.cacheTTL,
+        FetchTimeout: *f.timeout,
+        ReadConns:    *f.conns,
+        MmapSize:     *f.mmap,
+        PageCache:    *f.pageCache,
+        Mutable:      *f.mutable,
+        Preload:      *f.preload,
+        PreloadLimit: *f.limit,
+    }
+
+    if *f.zoomstack != "" {
+        loadTileset(tilesets, tileset.Config{Name: "zoomstack", Path: *f.zoomstack, Scheme: *f.zsScheme}.WithDefaults(defaults))
+    }
+
+    if *f.hillshade != "" {
+        loadTileset(tilesets, tileset.Config{Name: "hillshade", Path: *f.hillshade, Scheme: *f.hsScheme}.WithDefaults(defaults))
+    }
+
+    if *f.dir != "" {
+        if _, err := tilesets.LoadDir(*f.dir, defaults); err != nil {
+            log.Fatalf("failed to load tilesets: dir = %s, error = %s", *f.dir, err)
+        }
+    }
+
+    if *f.config != "" {
+        configs, err := tileset.ReadConfig(*f.config)
+
+        if err != nil {
+            log.Fatalf("failed to read config: error = %s", err)
+        }
+
+        for _, c := range configs {
+            loadTileset(tilesets, c.WithDefaults(defaults))
+        }
+    }
+
+    log.Printf("serving tilesets: names = %v", tilesets.Names())
+
+    return tilesets
+}
+
+// util function to load a tileset into the registry or fail and dump an error
+func loadTileset(tilesets *tileset.Registry, c tileset.Config) {
+    if _, err := tilesets.Load(c); err != nil {
+        log.Fatalf("failed to load tileset: name = %s, error = %s", c.Name, err)
+    }
+}
+
+// diskFlags configure the disk cache tier, shared by the server and the seed command
+type diskFlags struct {
+    dir  *string
+    size *string
+}
+
+func addDiskFlags(fs *flag.FlagSet) *diskFlags {
+    return &diskFlags{
+        dir:  fs.String("disk-cache", "", "directory for the on-disk tile cache below the memory cache, disabled if not set"),
+        size: fs.String("disk-cache-size", "10g", "disk cache size: format <INTEGER><k|m|g>, e.g. 10g"),
+    }
+}
+
+// open the disk cache with the options, nil if not enabled, failing on any error
+func (f *diskFlags) open(opts ...disk.Option) *disk.Store {
+    if *f.dir == "" {
+        return nil
     }
 
-    v, err := tiles.Version()
+    size, err := lru.ParseSize(*f.size)
 
     if err != nil {
-        log.Fatalf("failed to load MBTiles version: error = %s", err)
+        log.Fatalf("invalid disk cache size value: value = %s", *f.size)
     }
 
-    log.Printf("loaded MBtiles package: path = %s, version = %v", path, v)
+    store, err := disk.Open(*f.dir, size, opts...)
+
+    if err != nil {
+        log.Fatalf("failed to open disk cache: error = %s", err)
+    }
 
-    return tiles
+    return store
 }
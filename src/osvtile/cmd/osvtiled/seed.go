@@ -0,0 +1,129 @@
+package main
+
+import (
+    "context"
+    "flag"
+    "fmt"
+    "log"
+    "os"
+    "osdata/osvtile/container/disk"
+    "osdata/osvtile/container/lru"
+    "osdata/osvtile/mbtiles"
+    "osdata/osvtile/tile"
+    "osdata/osvtile/web"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// seed runs the `seed` command, loading the tiles of a bbox and zoom range into the disk cache so they survive until
+// the server next starts
+func seed(args []string) {
+    fs := flag.NewFlagSet("seed", flag.ExitOnError)
+
+    fs.Usage = func() {
+        fmt.Println("Usage: osvtiled seed [OPTIONS]\n\nLoad the tiles of a bbox and zoom range into the disk cache")
+        fmt.Println()
+        fs.PrintDefaults()
+        fmt.Println()
+    }
+
+    sources := addTilesetFlags(fs)
+    diskCache := addDiskFlags(fs)
+    name := fs.String("tileset", "zoomstack", "name of the tileset to seed")
+    bbox := fs.String("bbox", "", "area to seed: <left>,<bottom>,<right>,<top> in the coordinates of -crs")
+    crs := fs.String("crs", web.CRSWGS84, "coordinates of the bbox: wgs84 (lon/lat) or bng (British National Grid eastings/northings)")
+    minzoom := fs.Int("minzoom", 0, "lowest zoom to seed")
+    maxzoom := fs.Int("maxzoom", 14, "highest zoom to seed")
+    concurrency := fs.Int("concurrency", 4, "number of tiles to fetch at once")
+    interval := fs.Duration("progress", 5*time.Second, "how often to report progress")
+
+    _ = fs.Parse(args)
+
+    if *diskCache.dir == "" {
+        log.Fatalf("the disk cache directory must be set to seed: flag = -disk-cache")
+    }
+
+    b, err := parseBBox(*bbox)
+
+    if err != nil {
+        log.Fatalf("invalid bbox value: value = %s, error = %s", *bbox, err)
+    }
+
+    tilesets := sources.load()
+
+    // tiles only go to disk, the memory cache is only needed for the cache keys
+    store := diskCache.open(disk.WithSources(web.DiskSources(tilesets)), disk.WithTTL(disk.TTLFunc(web.CacheTTLs(tilesets))))
+    tiles := web.NewTileFetcher(lru.New(0, lru.WithNamespaces(tile.Namespace)), store, nil)
+
+    job, err := web.NewSeedJob(tilesets, tiles, web.SeedRequest{
+        Tileset:     *name,
+        BBox:        b,
+        CRS:         *crs,
+        Minzoom:     *minzoom,
+        Maxzoom:     *maxzoom,
+        Concurrency: *concurrency,
+    })
+
+    if err != nil {
+        log.Fatalf("failed to plan seed: error = %s", err)
+    }
+
+    if job.Progress().Total == 0 {
+        log.Printf("nothing to seed: tileset = %s, bbox = %s, zooms = %d-%d", *name, *bbox, *minzoom, *maxzoom)
+        _ = tilesets.Close()
+        return
+    }
+
+    done := make(chan struct{})
+
+    go func() {
+        ticker := time.NewTicker(*interval)
+        defer ticker.Stop()
+
+        for {
+            select {
+            case <-done:
+                return
+            case <-ticker.C:
+                p := job.Progress()
+                log.Printf("seed progress: done = %d/%d (%.1f%%), loaded = %d, missing = %d, failed = %d, elapsed = %s",
+                    p.Done, p.Total, 100*float64(p.Done)/float64(p.Total), p.Loaded, p.Missing, p.Failed, p.Elapsed)
+            }
+        }
+    }()
+
+    job.Run(context.Background())
+    close(done)
+
+    if err := tilesets.Close(); err != nil {
+        log.Printf("error closing tilesets: error = %s", err)
+    }
+
+    if p := job.Progress(); p.Failed > 0 {
+        log.Printf("seed finished with failures: failed = %d", p.Failed)
+        os.Exit(1)
+    }
+}
+
+// parseBBox parses a comma separated bounding box, the range of the values is checked by the seed job
+func parseBBox(value string) (mbtiles.BBox, error) {
+    b := mbtiles.BBox{}
+    parts := strings.Split(value, ",")
+
+    if len(parts) != 4 {
+        return b, fmt.Errorf("expected 4 comma separated values")
+    }
+
+    for i, p := range parts {
+        v, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+
+        if err != nil {
+            return b, err
+        }
+
+        b[i] = v
+    }
+
+    return b, nil
+}
@@ -0,0 +1,550 @@
+package disk
+
+import (
+    "bytes"
+    "container/list"
+    "crypto/md5"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "os"
+    "path/filepath"
+    "regexp"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+const (
+    // suffix of the entry files within the store directory
+    suffix = ".tile"
+    // magic and version at the start of every entry file
+    magic   = "OSVT"
+    version = 1
+)
+
+// ErrCorrupt is returned when an entry fails its integrity check
+var ErrCorrupt = errors.New("corrupt disk cache entry")
+
+// errVersion is returned when an entry was written in another version of the file layout
+var errVersion = errors.New("unknown disk cache entry version")
+
+// valid key segments, keys are used as relative paths so must not be able to escape the store directory
+var validSegment = regexp.MustCompile(`^[A-Za-z0-9_\-]+$`)
+
+// Status reports the current state of the store
+type Status struct {
+    Elements  int    `json:"elements"`
+    Size      int64  `json:"size"`
+    MaxSize   int64  `json:"maxSize"`
+    Hits      int64  `json:"hits"`
+    Misses    int64  `json:"misses"`
+    Evictions int64  `json:"evictions"`
+    Corrupt   int64  `json:"corrupt"`
+    Stale     int64  `json:"stale"`
+    Expired   int64  `json:"expired"`
+    Path      string `json:"path"`
+}
+
+// Entry is a value read from the store along with its ETag and expiry
+type Entry struct {
+    Value []byte
+    ETag  string
+    // Expires is when the entry expires, zero if it never does
+    Expires time.Time
+}
+
+// record is the decoded content of an entry file
+type record struct {
+    Entry
+    source string
+}
+
+// TTLFunc maps a key to how long its entry lives for, zero for entries which never expire
+type TTLFunc func(key string) time.Duration
+
+// SourceFunc maps a key to a stamp of the source data its value is made from, such as the modified time and size of
+// an MBTiles package
+type SourceFunc func(key string) string
+
+// Option configures the optional features of a store
+type Option func(s *Store)
+
+// WithSources records the source stamp of each entry when it is written, using the func to look up the stamp of each
+// key. An entry read back under a different stamp, as after its package has been replaced, is stale and removed.
+func WithSources(fn SourceFunc) Option {
+    return func(s *Store) {
+        s.source = fn
+    }
+}
+
+// WithTTL sets how long entries live for, using the func to look up the TTL of each key (e.g. by tileset). The expiry
+// is written with the entry, and an entry read back after it has expired is removed and reported as missing.
+func WithTTL(fn TTLFunc) Option {
+    return func(s *Store) {
+        s.ttl = fn
+    }
+}
+
+// entry is the index record of a file in the store
+type entry struct {
+    key  string
+    size int64
+}
+
+// Store is a least recently used cache of values held as files under a root directory, with the key giving the
+// relative path of the file. Each file holds the value's ETag, source stamp and checksum, which are checked on every
+// read. The index is rebuilt from the directory when the store is opened, so entries survive restarts.
+type Store struct {
+    mu        *sync.Mutex
+    root      string
+    source    SourceFunc
+    ttl       TTLFunc
+    now       func() time.Time
+    dict      map[string]*list.Element
+    list      *list.List
+    size      int64
+    maxsize   int64
+    hits      int64
+    misses    int64
+    evictions int64
+    corrupt   int64
+    stale     int64
+    expired   int64
+}
+
+// Get will read the value and ETag for the key, a nil value is returned if there is no such entry. Stale and expired
+// entries are removed and reported as missing, entries which fail the integrity check are removed and reported as
+// ErrCorrupt.
+func (s *Store) Get(key string) ([]byte, string, error) {
+    e, err := s.GetEntry(key)
+
+    if e == nil {
+        return nil, "", err
+    }
+
+    return e.Value, e.ETag, nil
+}
+
+// GetEntry is `Get`, returning the entry along with its expiry. A nil entry is returned if there is no such entry.
+func (s *Store) GetEntry(key string) (*Entry, error) {
+    path, err := s.path(key)
+
+    if err != nil {
+        return nil, err
+    }
+
+    s.mu.Lock()
+    elm, ok := s.dict[key]
+
+    if !ok {
+        s.misses++
+        s.mu.Unlock()
+        return nil, nil
+    }
+
+    s.list.MoveToFront(elm)
+    s.mu.Unlock()
+
+    data, err := ioutil.ReadFile(path)
+
+    if os.IsNotExist(err) {
+        // removed since the index was checked
+        s.forget(key)
+        return nil, nil
+    }
+
+    if err != nil {
+        return nil, err
+    }
+
+    r, err := decode(data)
+    now := s.now()
+
+    switch {
+    case err == errVersion || (err == nil && r.source != s.sourceOf(key)):
+        s.drop(key, &s.stale)
+        return nil, nil
+    case err == nil && !r.Expires.IsZero() && !now.Before(r.Expires):
+        s.drop(key, &s.expired)
+        return nil, nil
+    case err != nil:
+        log.Printf("removing corrupt disk cache entry: key = %s, error = %s", key, err)
+        s.mu.Lock()
+        s.corrupt++
+        s.mu.Unlock()
+        s.Delete(key)
+        return nil, ErrCorrupt
+    }
+
+    // the modified time records the access order for when the index is rebuilt
+    _ = os.Chtimes(path, now, now)
+
+    s.mu.Lock()
+    s.hits++
+    s.mu.Unlock()
+
+    return &r.Entry, nil
+}
+
+// drop removes an entry that can no longer be served, counting it as a miss and in the given statistic
+func (s *Store) drop(key string, stat *int64) {
+    s.mu.Lock()
+    *stat++
+    s.misses++
+    s.mu.Unlock()
+    s.Delete(key)
+}
+
+// Set will write the value and its ETag for the key, evicting the least recently used entries to stay within the
+// maximum size. Values larger than the store are not written. The entry expires after the TTL given by the store's
+// TTL func, if it has one. The entry is only renamed into place under the lock, so
+// a purge or delete running at the same time never leaves it behind.
+func (s *Store) Set(key string, value []byte, etag string) error {
+    path, err := s.path(key)
+
+    if err != nil {
+        return err
+    }
+
+    r := &record{Entry: Entry{Value: value, ETag: etag}, source: s.sourceOf(key)}
+
+    if s.ttl != nil {
+        if ttl := s.ttl(key); ttl > 0 {
+            r.Expires = s.now().Add(ttl)
+        }
+    }
+
+    data := encode(r)
+    size := int64(len(data))
+
+    if size > s.maxsize {
+        return nil
+    }
+
+    if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+        return err
+    }
+
+    // write to a temporary file and rename, so a partial write is never seen as an entry
+    tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+
+    if err != nil {
+        return err
+    }
+
+    if _, err := tmp.Write(data); err != nil {
+        _ = tmp.Close()
+        _ = os.Remove(tmp.Name())
+        return err
+    }
+
+    if err := tmp.Close(); err != nil {
+        _ = os.Remove(tmp.Name())
+        return err
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if err := os.Rename(tmp.Name(), path); err != nil {
+        _ = os.Remove(tmp.Name())
+        return err
+    }
+
+    if elm, ok := s.dict[key]; ok {
+        e := elm.Value.(*entry)
+        s.size += size - e.size
+        e.size = size
+        s.list.MoveToFront(elm)
+    } else {
+        s.dict[key] = s.list.PushFront(&entry{key: key, size: size})
+        s.size += size
+    }
+
+    for s.size > s.maxsize {
+        elm := s.list.Back()
+        s.remove(elm)
+        s.evictions++
+    }
+
+    return nil
+}
+
+// Delete will remove the entry for the key if it exists
+func (s *Store) Delete(key string) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if elm, ok := s.dict[key]; ok {
+        s.remove(elm)
+    }
+}
+
+// Purge will remove every entry with a key selected by the match func, returning the entries and bytes freed
+func (s *Store) Purge(match func(key string) bool) (int, int64) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    entries, bytes := 0, int64(0)
+
+    for key, elm := range s.dict {
+        if !match(key) {
+            continue
+        }
+
+        entries++
+        bytes += elm.Value.(*entry).size
+        s.remove(elm)
+    }
+
+    return entries, bytes
+}
+
+// Status reports the current state of the store
+func (s *Store) Status() *Status {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    return &Status{
+        Elements:  len(s.dict),
+        Size:      s.size,
+        MaxSize:   s.maxsize,
+        Hits:      s.hits,
+        Misses:    s.misses,
+        Evictions: s.evictions,
+        Corrupt:   s.corrupt,
+        Stale:     s.stale,
+        Expired:   s.expired,
+        Path:      s.root,
+    }
+}
+
+// sourceOf looks up the source stamp of the key, empty if the store does not record sources
+func (s *Store) sourceOf(key string) string {
+    if s.source == nil {
+        return ""
+    }
+
+    return s.source(key)
+}
+
+// forget drops the key from the index without touching the file
+func (s *Store) forget(key string) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if elm, ok := s.dict[key]; ok {
+        s.size -= elm.Value.(*entry).size
+        delete(s.dict, key)
+        s.list.Remove(elm)
+    }
+}
+
+// remove drops the entry from the index and deletes its file, the caller must hold the lock
+func (s *Store) remove(elm *list.Element) {
+    e := elm.Value.(*entry)
+    delete(s.dict, e.key)
+    s.list.Remove(elm)
+    s.size -= e.size
+
+    path, _ := s.path(e.key)
+
+    if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+        log.Printf("failed to remove disk cache entry: key = %s, error = %s", e.key, err)
+    }
+}
+
+// path maps the key to its file, rejecting keys which are not a simple relative path
+func (s *Store) path(key string) (string, error) {
+    parts := strings.Split(key, "/")
+
+    for _, part := range parts {
+        if !validSegment.MatchString(part) {
+            return "", fmt.Errorf("invalid disk cache key: key = %s", key)
+        }
+    }
+
+    return filepath.Join(s.root, filepath.Join(parts...)+suffix), nil
+}
+
+// load rebuilds the index from the files under the root, oldest first so the most recently used end up at the front
+func (s *Store) load() error {
+    type found struct {
+        key     string
+        size    int64
+        modtime time.Time
+    }
+
+    var files []found
+
+    err := filepath.Walk(s.root, func(path string, info os.FileInfo, err error) error {
+        if err != nil {
+            return err
+        }
+
+        if info.IsDir() {
+            return nil
+        }
+
+        // clean up temporary files left behind by a crash
+        if strings.HasPrefix(info.Name(), ".tmp-") {
+            _ = os.Remove(path)
+            return nil
+        }
+
+        if !strings.HasSuffix(path, suffix) {
+            return nil
+        }
+
+        rel, err := filepath.Rel(s.root, strings.TrimSuffix(path, suffix))
+
+        if err != nil {
+            return err
+        }
+
+        files = append(files, found{key: filepath.ToSlash(rel), size: info.Size(), modtime: info.ModTime()})
+
+        return nil
+    })
+
+    if err != nil {
+        return err
+    }
+
+    sort.Slice(files, func(i, j int) bool {
+        return files[i].modtime.Before(files[j].modtime)
+    })
+
+    for _, f := range files {
+        s.dict[f.key] = s.list.PushFront(&entry{key: f.key, size: f.size})
+        s.size += f.size
+    }
+
+    for s.size > s.maxsize {
+        s.remove(s.list.Back())
+    }
+
+    return nil
+}
+
+// encode lays out an entry file as: magic, version, expiry (unix nanoseconds, zero for never), source length
+// (uint16), source, etag length (uint16), etag, md5 of the value, value
+func encode(r *record) []byte {
+    var expires int64
+
+    if !r.Expires.IsZero() {
+        expires = r.Expires.UnixNano()
+    }
+
+    buf := &bytes.Buffer{}
+    buf.WriteString(magic)
+    buf.WriteByte(version)
+    _ = binary.Write(buf, binary.BigEndian, expires)
+    _ = binary.Write(buf, binary.BigEndian, uint16(len(r.source)))
+    buf.WriteString(r.source)
+    _ = binary.Write(buf, binary.BigEndian, uint16(len(r.ETag)))
+    buf.WriteString(r.ETag)
+    sum := md5.Sum(r.Value)
+    buf.Write(sum[:])
+    buf.Write(r.Value)
+
+    return buf.Bytes()
+}
+
+// decode checks and unpacks an entry file
+func decode(data []byte) (*record, error) {
+    if len(data) < len(magic)+1 || string(data[:len(magic)]) != magic {
+        return nil, fmt.Errorf("bad header")
+    }
+
+    if data[len(magic)] != version {
+        return nil, errVersion
+    }
+
+    rest := data[len(magic)+1:]
+    r := &record{}
+
+    if len(rest) < 8 {
+        return nil, fmt.Errorf("truncated entry")
+    }
+
+    if expires := int64(binary.BigEndian.Uint64(rest)); expires != 0 {
+        r.Expires = time.Unix(0, expires)
+    }
+
+    rest = rest[8:]
+
+    // the length prefixed strings
+    field := func() (string, error) {
+        if len(rest) < 2 {
+            return "", fmt.Errorf("truncated entry")
+        }
+
+        n := int(binary.BigEndian.Uint16(rest))
+
+        if len(rest) < 2+n {
+            return "", fmt.Errorf("truncated entry")
+        }
+
+        value := string(rest[2 : 2+n])
+        rest = rest[2+n:]
+
+        return value, nil
+    }
+
+    var err error
+
+    if r.source, err = field(); err != nil {
+        return nil, err
+    }
+
+    if r.ETag, err = field(); err != nil {
+        return nil, err
+    }
+
+    if len(rest) < md5.Size {
+        return nil, fmt.Errorf("truncated entry")
+    }
+
+    r.Value = rest[md5.Size:]
+
+    if sum := md5.Sum(r.Value); !bytes.Equal(sum[:], rest[:md5.Size]) {
+        return nil, fmt.Errorf("checksum mismatch")
+    }
+
+    return r, nil
+}
+
+// Open will create (if needed) the root directory and index any existing entries. Existing entries beyond the
+// maximum size are evicted.
+func Open(root string, maxsize int64, opts ...Option) (*Store, error) {
+    if err := os.MkdirAll(root, 0755); err != nil {
+        return nil, err
+    }
+
+    s := &Store{
+        mu:      &sync.Mutex{},
+        root:    root,
+        dict:    map[string]*list.Element{},
+        list:    list.New(),
+        maxsize: maxsize,
+        now:     time.Now,
+    }
+
+    for _, opt := range opts {
+        opt(s)
+    }
+
+    if err := s.load(); err != nil {
+        return nil, fmt.Errorf("failed to index disk cache: path = %s, error = %s", root, err)
+    }
+
+    log.Printf("opened disk cache: path = %s, elements = %d, size = %d bytes, max size = %d bytes",
+        root, len(s.dict), s.size, maxsize)
+
+    return s, nil
+}
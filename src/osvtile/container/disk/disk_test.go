@@ -0,0 +1,213 @@
+package disk
+
+import (
+    "github.com/stretchr/testify/require"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+func tempStore(t *testing.T, maxsize int64) (*Store, string) {
+    dir, err := ioutil.TempDir("", "disk-test")
+    require.NoError(t, err)
+
+    s, err := Open(dir, maxsize)
+    require.NoError(t, err)
+
+    return s, dir
+}
+
+func TestStore_GetSet(t *testing.T) {
+    s, dir := tempStore(t, 4096)
+    defer os.RemoveAll(dir)
+
+    require.NoError(t, s.Set("zoomstack/mvt/1/2/3", []byte("aaaaaaaa"), "etag-a"))
+
+    v, etag, err := s.Get("zoomstack/mvt/1/2/3")
+    require.NoError(t, err)
+    require.Equal(t, []byte("aaaaaaaa"), v)
+    require.Equal(t, "etag-a", etag)
+
+    v, _, err = s.Get("zoomstack/mvt/1/2/4")
+    require.NoError(t, err)
+    require.Nil(t, v)
+
+    require.Error(t, s.Set("../escape", []byte("x"), ""))
+    require.Error(t, s.Set("a//b", []byte("x"), ""))
+
+    status := s.Status()
+    require.Equal(t, 1, status.Elements)
+    require.Equal(t, int64(1), status.Hits)
+    require.Equal(t, int64(1), status.Misses)
+}
+
+func TestStore_Corrupt(t *testing.T) {
+    s, dir := tempStore(t, 4096)
+    defer os.RemoveAll(dir)
+
+    require.NoError(t, s.Set("a/b", []byte("aaaaaaaa"), "etag-a"))
+
+    path := filepath.Join(dir, "a", "b"+suffix)
+    data, err := ioutil.ReadFile(path)
+    require.NoError(t, err)
+    data[len(data)-1] = 'x'
+    require.NoError(t, ioutil.WriteFile(path, data, 0644))
+
+    v, _, err := s.Get("a/b")
+    require.Equal(t, ErrCorrupt, err)
+    require.Nil(t, v)
+
+    _, err = os.Stat(path)
+    require.True(t, os.IsNotExist(err))
+    require.Equal(t, 0, s.Status().Elements)
+    require.Equal(t, int64(1), s.Status().Corrupt)
+}
+
+func TestStore_EvictionAndReopen(t *testing.T) {
+    entry := int64(len(encode(&record{Entry: Entry{Value: make([]byte, 100), ETag: "etag"}})))
+    s, dir := tempStore(t, 3*entry)
+    defer os.RemoveAll(dir)
+
+    for _, key := range []string{"a", "b", "c"} {
+        require.NoError(t, s.Set("t/"+key, make([]byte, 100), "etag"))
+        time.Sleep(10 * time.Millisecond)
+    }
+
+    // touch a so b is the least recently used
+    _, _, err := s.Get("t/a")
+    require.NoError(t, err)
+
+    require.NoError(t, s.Set("t/d", make([]byte, 100), "etag"))
+    require.Equal(t, 3, s.Status().Elements)
+    require.Equal(t, int64(1), s.Status().Evictions)
+
+    _, err = os.Stat(filepath.Join(dir, "t", "b"+suffix))
+    require.True(t, os.IsNotExist(err))
+
+    // the index is rebuilt from the files, with a smaller limit dropping the oldest
+    reopened, err := Open(dir, 2*entry)
+    require.NoError(t, err)
+    require.Equal(t, 2, reopened.Status().Elements)
+    require.Equal(t, 2*entry, reopened.Status().Size)
+
+    v, _, err := reopened.Get("t/c")
+    require.NoError(t, err)
+    require.Nil(t, v)
+
+    v, _, err = reopened.Get("t/d")
+    require.NoError(t, err)
+    require.Len(t, v, 100)
+}
+
+func TestStore_Purge(t *testing.T) {
+    s, dir := tempStore(t, 4096)
+    defer os.RemoveAll(dir)
+
+    require.NoError(t, s.Set("a/1", []byte("1"), ""))
+    require.NoError(t, s.Set("a/2", []byte("2"), ""))
+    require.NoError(t, s.Set("b/1", []byte("3"), ""))
+
+    entries, _ := s.Purge(func(key string) bool {
+        return key[0] == 'a'
+    })
+
+    require.Equal(t, 2, entries)
+    require.Equal(t, 1, s.Status().Elements)
+
+    _, err := os.Stat(filepath.Join(dir, "a", "1"+suffix))
+    require.True(t, os.IsNotExist(err))
+}
+
+func TestStore_Sources(t *testing.T) {
+    dir, err := ioutil.TempDir("", "disk-test")
+    require.NoError(t, err)
+    defer os.RemoveAll(dir)
+
+    stamp := "v1"
+    s, err := Open(dir, 4096, WithSources(func(key string) string { return stamp }))
+    require.NoError(t, err)
+
+    require.NoError(t, s.Set("t/a", []byte("aaaa"), "etag"))
+
+    v, _, err := s.Get("t/a")
+    require.NoError(t, err)
+    require.Equal(t, []byte("aaaa"), v)
+
+    // once the source has changed the entry is stale, and removed rather than served
+    stamp = "v2"
+    v, _, err = s.Get("t/a")
+    require.NoError(t, err)
+    require.Nil(t, v)
+    require.Equal(t, int64(1), s.Status().Stale)
+    require.Equal(t, 0, s.Status().Elements)
+
+    _, err = os.Stat(filepath.Join(dir, "t", "a"+suffix))
+    require.True(t, os.IsNotExist(err))
+
+    // entries written in another layout are stale too
+    require.NoError(t, s.Set("t/b", []byte("bbbb"), "etag"))
+    path := filepath.Join(dir, "t", "b"+suffix)
+    data, err := ioutil.ReadFile(path)
+    require.NoError(t, err)
+    data[len(magic)] = version + 1
+    require.NoError(t, ioutil.WriteFile(path, data, 0644))
+
+    v, _, err = s.Get("t/b")
+    require.NoError(t, err)
+    require.Nil(t, v)
+    require.Equal(t, int64(2), s.Status().Stale)
+    require.Equal(t, int64(0), s.Status().Corrupt)
+}
+
+func TestStore_TTL(t *testing.T) {
+    dir, err := ioutil.TempDir("", "disk-test")
+    require.NoError(t, err)
+    defer os.RemoveAll(dir)
+
+    ttls := func(key string) time.Duration {
+        if filepath.Dir(key) == "short" {
+            return time.Minute
+        }
+
+        return 0
+    }
+
+    s, err := Open(dir, 4096, WithTTL(ttls))
+    require.NoError(t, err)
+
+    now := time.Unix(1000, 0)
+    s.now = func() time.Time { return now }
+
+    require.NoError(t, s.Set("short/a", []byte("aaaa"), "etag-a"))
+    require.NoError(t, s.Set("long/a", []byte("bbbb"), "etag-b"))
+
+    e, err := s.GetEntry("short/a")
+    require.NoError(t, err)
+    require.Equal(t, []byte("aaaa"), e.Value)
+    require.Equal(t, now.Add(time.Minute), e.Expires)
+
+    e, err = s.GetEntry("long/a")
+    require.NoError(t, err)
+    require.True(t, e.Expires.IsZero())
+
+    // expired entries are removed, the expiry survives reopening the store
+    now = now.Add(time.Minute)
+    s, err = Open(dir, 4096, WithTTL(ttls))
+    require.NoError(t, err)
+    s.now = func() time.Time { return now }
+
+    v, _, err := s.Get("short/a")
+    require.NoError(t, err)
+    require.Nil(t, v)
+    require.Equal(t, int64(1), s.Status().Expired)
+    require.Equal(t, 1, s.Status().Elements)
+
+    _, err = os.Stat(filepath.Join(dir, "short", "a"+suffix))
+    require.True(t, os.IsNotExist(err))
+
+    v, _, err = s.Get("long/a")
+    require.NoError(t, err)
+    require.Equal(t, []byte("bbbb"), v)
+}
@@ -0,0 +1,2 @@
+// Package disk holds a size limited, least recently used byte cache stored on disk
+package disk
@@ -0,0 +1,169 @@
+package lru
+
+import "container/list"
+
+// ARC segments
+const (
+    arcT1 uint8 = iota
+    arcT2
+)
+
+// arc is the adaptive replacement cache of Megiddo and Modha. Entries seen once live in t1, entries seen again move
+// to t2. The keys of entries evicted from each are remembered in the ghost lists b1 and b2, and a later miss on a
+// ghost shifts the target size of t1 (p) towards the list which would have kept it. The target is counted in
+// entries rather than bytes, which is close enough for tiles of similar sizes.
+type arc struct {
+    t1, t2 *list.List
+    b1, b2 *ghosts
+    p      int
+    c      int
+    // set when the last entry added was a ghost in b2, which favours evicting from t1
+    fromB2 bool
+}
+
+func (a *arc) add(n *node) {
+    a.fromB2 = false
+
+    switch {
+    case a.b1.remove(n.key):
+        a.p = minInt(a.p+maxInt(1, a.b2.len()/maxInt(1, a.b1.len())), a.c)
+        n.seg, n.elem = arcT2, a.t2.PushFront(n)
+    case a.b2.remove(n.key):
+        a.p = maxInt(a.p-maxInt(1, a.b1.len()/maxInt(1, a.b2.len())), 0)
+        a.fromB2 = true
+        n.seg, n.elem = arcT2, a.t2.PushFront(n)
+    default:
+        n.seg, n.elem = arcT1, a.t1.PushFront(n)
+    }
+
+    a.c = maxInt(a.c, a.len())
+
+    // bound the history to the resident entries: t1 + b1 <= c and everything <= 2c
+    for a.b1.len() > 0 && a.t1.Len()+a.b1.len() > a.c {
+        a.b1.evict()
+    }
+
+    for a.b2.len() > 0 && a.len()+a.b1.len()+a.b2.len() > 2*a.c {
+        a.b2.evict()
+    }
+}
+
+func (a *arc) hit(n *node) {
+    if n.seg == arcT2 {
+        a.t2.MoveToFront(n.elem)
+        return
+    }
+
+    a.t1.Remove(n.elem)
+    n.seg, n.elem = arcT2, a.t2.PushFront(n)
+}
+
+func (a *arc) remove(n *node) {
+    a.list(n.seg).Remove(n.elem)
+}
+
+func (a *arc) evict() *node {
+    t1 := a.t1.Len()
+
+    if t1 > 0 && (t1 > a.p || (a.fromB2 && t1 == a.p) || a.t2.Len() == 0) {
+        n := a.t1.Remove(a.t1.Back()).(*node)
+        a.b1.add(n.key)
+        return n
+    }
+
+    if a.t2.Len() > 0 {
+        n := a.t2.Remove(a.t2.Back()).(*node)
+        a.b2.add(n.key)
+        return n
+    }
+
+    return nil
+}
+
+func (a *arc) walk(fn func(n *node)) {
+    for _, l := range []*list.List{a.t1, a.t2} {
+        for elm := l.Back(); elm != nil; elm = elm.Prev() {
+            fn(elm.Value.(*node))
+        }
+    }
+}
+
+func (a *arc) len() int {
+    return a.t1.Len() + a.t2.Len()
+}
+
+func (a *arc) clear() {
+    a.t1.Init()
+    a.t2.Init()
+    a.b1 = newGhosts()
+    a.b2 = newGhosts()
+    a.p, a.c = 0, 0
+}
+
+func (a *arc) list(seg uint8) *list.List {
+    if seg == arcT2 {
+        return a.t2
+    }
+
+    return a.t1
+}
+
+func newARC() *arc {
+    return &arc{
+        t1: list.New(),
+        t2: list.New(),
+        b1: newGhosts(),
+        b2: newGhosts(),
+    }
+}
+
+// ghosts is an LRU list of the keys of evicted entries
+type ghosts struct {
+    keys map[string]*list.Element
+    list *list.List
+}
+
+func (g *ghosts) add(key string) {
+    g.keys[key] = g.list.PushFront(key)
+}
+
+func (g *ghosts) remove(key string) bool {
+    elm, ok := g.keys[key]
+
+    if ok {
+        g.list.Remove(elm)
+        delete(g.keys, key)
+    }
+
+    return ok
+}
+
+func (g *ghosts) evict() {
+    if elm := g.list.Back(); elm != nil {
+        delete(g.keys, g.list.Remove(elm).(string))
+    }
+}
+
+func (g *ghosts) len() int {
+    return g.list.Len()
+}
+
+func newGhosts() *ghosts {
+    return &ghosts{keys: map[string]*list.Element{}, list: list.New()}
+}
+
+func minInt(a, b int) int {
+    if a < b {
+        return a
+    }
+
+    return b
+}
+
+func maxInt(a, b int) int {
+    if a > b {
+        return a
+    }
+
+    return b
+}
@@ -0,0 +1,145 @@
+package lru
+
+import (
+    "bytes"
+    "sync"
+    "sync/atomic"
+)
+
+// payload is a value buffer shared by every entry of the cache holding the same bytes. Large parts of a tileset are
+// byte-identical tiles (empty sea, uniform woodland), so sharing the buffer holds them in memory once. The buffer is
+// charged to a single node, the holder. Once the holder is gone a shard still referencing the buffer, the owner,
+// retains the charge until another node claims it, or the last reference is dropped. The charge moves on whenever
+// the owner loses its last reference, so a shard can always free what it retains by evicting its own entries.
+type payload struct {
+    value []byte
+    // references by shard, and in total
+    refs   map[*shard]int
+    total  int
+    holder *node
+    owner  *shard
+}
+
+// retainer picks the shard to retain the charge of the buffer, preferring the given shard if it still references it
+func (e *payload) retainer(s *shard) *shard {
+    if e.refs[s] > 0 {
+        return s
+    }
+
+    for r := range e.refs {
+        return r
+    }
+
+    return nil
+}
+
+// payloads is the content addressed store of the buffers shared by the shards of a cache. It has its own lock, taken
+// with a shard lock held, and only touches the retained bytes of other shards atomically - so no shard waits on
+// another.
+type payloads struct {
+    mu      *sync.Mutex
+    entries map[string]*payload
+}
+
+// cost is the number of bytes the node would add to the shard, nothing if its value is already charged to a node or
+// retained by the shard
+func (p *payloads) cost(s *shard, n *node) int64 {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    if e, ok := p.entries[n.md5]; ok && bytes.Equal(e.value, n.value) && (e.holder != nil || e.owner == s) {
+        return 0
+    }
+
+    return n.size()
+}
+
+// acquire points the node added to the shard at the shared buffer for its value, creating it if this is the first
+// node holding the value. The node's cost is set to the bytes charged to it, which is its size if it holds the charge
+// of the buffer and otherwise nothing.
+func (p *payloads) acquire(s *shard, n *node) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    e, ok := p.entries[n.md5]
+
+    if !ok {
+        e = &payload{value: n.value, refs: map[*shard]int{}}
+        p.entries[n.md5] = e
+    } else if !bytes.Equal(e.value, n.value) {
+        // an md5 collision, the node keeps a buffer of its own
+        n.cost = n.size()
+        return
+    }
+
+    n.payload = e
+    n.value = e.value
+    e.refs[s]++
+    e.total++
+
+    if e.holder != nil {
+        n.cost = 0
+        return
+    }
+
+    // a new buffer, or one retained by a shard, is charged to the node
+    if e.owner != nil {
+        atomic.AddInt64(&e.owner.retained, -n.size())
+        e.owner = nil
+    }
+
+    e.holder = n
+    n.cost = n.size()
+}
+
+// release drops the reference to its buffer of the node leaving the shard, removing the buffer with its last
+// reference. The charge of a buffer still in use elsewhere is retained by a shard which still references it, either
+// when the node held the charge or when the shard retaining it has no references left.
+func (p *payloads) release(s *shard, n *node) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    e := n.payload
+
+    if e == nil {
+        return
+    }
+
+    n.payload = nil
+    e.total--
+
+    if e.refs[s]--; e.refs[s] == 0 {
+        delete(e.refs, s)
+    }
+
+    if e.total == 0 {
+        if e.owner != nil {
+            atomic.AddInt64(&e.owner.retained, -n.size())
+        }
+
+        delete(p.entries, n.md5)
+        return
+    }
+
+    switch {
+    case e.holder == n:
+        e.holder, e.owner = nil, e.retainer(s)
+        atomic.AddInt64(&e.owner.retained, n.cost)
+    case e.owner == s && e.refs[s] == 0:
+        e.owner = e.retainer(s)
+        atomic.AddInt64(&s.retained, -n.size())
+        atomic.AddInt64(&e.owner.retained, n.size())
+    }
+}
+
+// len is the number of buffers held
+func (p *payloads) len() int {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    return len(p.entries)
+}
+
+func newPayloads() *payloads {
+    return &payloads{mu: &sync.Mutex{}, entries: map[string]*payload{}}
+}
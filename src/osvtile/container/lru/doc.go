@@ -1,2 +1,2 @@
-// package LRU holds a least recently used byte cache
-package lru
\ No newline at end of file
+// package LRU holds a sharded byte cache, evicting the least recently used entries or by another eviction policy
+package lru
@@ -0,0 +1,99 @@
+package lru
+
+import (
+    "container/heap"
+    "sort"
+)
+
+// lfu keeps the entries in a min heap ordered by access count, then by last access. Counts are never aged, so LFU
+// suits workloads with a stable hot set.
+type lfu struct {
+    nodes lfuHeap
+    tick  uint64
+}
+
+func (l *lfu) add(n *node) {
+    l.tick++
+    n.freq = 1
+    n.tick = l.tick
+    heap.Push(&l.nodes, n)
+}
+
+func (l *lfu) hit(n *node) {
+    l.tick++
+    n.freq++
+    n.tick = l.tick
+    heap.Fix(&l.nodes, n.index)
+}
+
+func (l *lfu) remove(n *node) {
+    heap.Remove(&l.nodes, n.index)
+}
+
+func (l *lfu) evict() *node {
+    if len(l.nodes) == 0 {
+        return nil
+    }
+
+    return heap.Pop(&l.nodes).(*node)
+}
+
+func (l *lfu) walk(fn func(n *node)) {
+    nodes := append(lfuHeap(nil), l.nodes...)
+    sort.Slice(nodes, func(i, j int) bool {
+        return nodes.Less(i, j)
+    })
+
+    for _, n := range nodes {
+        fn(n)
+    }
+}
+
+func (l *lfu) len() int {
+    return len(l.nodes)
+}
+
+func (l *lfu) clear() {
+    l.nodes = nil
+}
+
+func newLFU() *lfu {
+    return &lfu{}
+}
+
+// lfuHeap implements heap.Interface, keeping the index of each node up to date so it can be fixed in place
+type lfuHeap []*node
+
+func (h lfuHeap) Len() int {
+    return len(h)
+}
+
+func (h lfuHeap) Less(i, j int) bool {
+    if h[i].freq != h[j].freq {
+        return h[i].freq < h[j].freq
+    }
+
+    return h[i].tick < h[j].tick
+}
+
+func (h lfuHeap) Swap(i, j int) {
+    h[i], h[j] = h[j], h[i]
+    h[i].index = i
+    h[j].index = j
+}
+
+func (h *lfuHeap) Push(x interface{}) {
+    n := x.(*node)
+    n.index = len(*h)
+    *h = append(*h, n)
+}
+
+func (h *lfuHeap) Pop() interface{} {
+    old := *h
+    n := old[len(old)-1]
+    old[len(old)-1] = nil
+    *h = old[:len(old)-1]
+    n.index = -1
+
+    return n
+}
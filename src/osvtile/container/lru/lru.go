@@ -5,36 +5,254 @@ import (
     "crypto/md5"
     "fmt"
     "log"
-    "sync"
+    "time"
 )
 
-// node type holds the actual value and it's key - this allows removal of the LRU element
-// from the linked list and then to delete it from the map with the key.
+const (
+    // defaultShards is the number of shards used by caches large enough to hold `minShardSize` in each shard
+    defaultShards = 16
+    // minShardSize stops small caches being split into shards too small to hold a typical tile
+    minShardSize int64 = 1024 * 1024
+)
+
+// node type holds the actual value and it's key, along with the position of the node in the structures of the
+// shard's eviction policy
 type node struct {
     key   string
+    ns    string
     value []byte
     md5   string
+    // expiry time in unix nanoseconds, zero if the node never expires
+    expires int64
+    // buffer shared with the other nodes of the cache holding the same value, and the bytes charged for the node
+    payload *payload
+    cost    int64
+    // list element (lru, arc, tinylfu) and segment (arc, tinylfu)
+    elem *list.Element
+    seg  uint8
+    // heap index, access count and last access (lfu)
+    index int
+    freq  int
+    tick  uint64
 }
 
-type Status struct {
+// size is the number of bytes of the node's value, before deduplication
+func (n *node) size() int64 {
+    return int64(len(n.value))
+}
+
+// expired checks if the node has expired by the given time (unix nanoseconds)
+func (n *node) expired(now int64) bool {
+    return n.expires != 0 && now >= n.expires
+}
+
+// Stats counts the cache activity since it was created:
+// + hits and misses of `Get`
+// + entries (and their bytes) evicted to make space for new entries
+// + entries rejected for being larger than a shard, or for not fitting in a full pinned budget
+// + entries removed once past their TTL, on access or by the sweeper
+type Stats struct {
+    Hits         int64 `json:"hits"`
+    Misses       int64 `json:"misses"`
+    Evictions    int64 `json:"evictions"`
+    EvictedBytes int64 `json:"evictedBytes"`
+    Rejections   int64 `json:"rejections"`
+    Expired      int64 `json:"expired"`
+}
+
+func (s *Stats) add(o Stats) {
+    s.Hits += o.Hits
+    s.Misses += o.Misses
+    s.Evictions += o.Evictions
+    s.EvictedBytes += o.EvictedBytes
+    s.Rejections += o.Rejections
+    s.Expired += o.Expired
+}
+
+// Usage reports the number of elements and byte size held by a namespace
+type Usage struct {
     Elements int   `json:"elements"`
     Size     int64 `json:"size"`
-    MaxSize  int64 `json:"maxSize"`
 }
 
-// LRU is the basic implementation of an LRU cache
+type Status struct {
+    Elements    int                      `json:"elements"`
+    Size        int64                    `json:"size"`
+    LogicalSize int64                    `json:"logicalSize"`
+    Payloads    int                      `json:"payloads"`
+    MaxSize     int64                    `json:"maxSize"`
+    Shards      int                      `json:"shards"`
+    Policy      Policy                   `json:"policy"`
+    Stats       Stats                    `json:"stats"`
+    Namespaces  map[string]*Usage        `json:"namespaces,omitempty"`
+    Budgets     map[string]*BudgetStatus `json:"budgets,omitempty"`
+    Negative    *NegativeStatus          `json:"negative,omitempty"`
+}
+
+// Cache is the interface of the tile cache, implemented by LRU with any of the eviction policies
+type Cache interface {
+    Set(key string, value []byte) string
+    SetWithTTL(key string, value []byte, ttl time.Duration) string
+    Get(key string) ([]byte, string)
+    SetMissing(key string)
+    Missing(key string) bool
+    Exists(key string) bool
+    Delete(key string)
+    Purge(match func(key string) bool) (int, int64)
+    Walk(fn func(key string, value []byte, md5 string) error) error
+    Status() *Status
+    Clear()
+    Close()
+}
+
+var _ Cache = &LRU{}
+
+// NamespaceFunc maps a key to the namespace it belongs to
+type NamespaceFunc func(key string) string
+
+// TTLFunc maps a key to how long its entry lives for, zero for entries which never expire
+type TTLFunc func(key string) time.Duration
+
+// RemovalReason reports why an entry left the cache
+type RemovalReason string
+
+const (
+    // RemovedEvicted entries were evicted by the policy to make space for new entries
+    RemovedEvicted RemovalReason = "evicted"
+    // RemovedExpired entries were past their TTL, when accessed or swept
+    RemovedExpired RemovalReason = "expired"
+    // RemovedReplaced entries were replaced by a new value for the same key
+    RemovedReplaced RemovalReason = "replaced"
+    // RemovedDeleted entries were deleted, purged or cleared from the cache
+    RemovedDeleted RemovalReason = "deleted"
+)
+
+// EvictionFunc is called with the key and value of each entry removed from the cache, and why it was removed
+type EvictionFunc func(key string, value []byte, reason RemovalReason)
+
+// Option configures the optional features of a cache
+type Option func(l *LRU)
+
+// WithNegative enables the negative cache, recording up to `maxElements` keys known to have no value. Each key is
+// held for at most the ttl.
+func WithNegative(maxElements int, ttl time.Duration) Option {
+    return func(l *LRU) {
+        l.negative = newNegative(maxElements, ttl)
+    }
+}
+
+// WithShards sets the number of shards each budget is split into. By default 16 shards are used, or fewer for
+// budgets under 16MB so that each shard holds at least 1MB.
+func WithShards(shards int) Option {
+    return func(l *LRU) {
+        if shards > 0 {
+            l.nshards = shards
+        }
+    }
+}
+
+// WithPolicy sets the eviction policy of every shard, by default the least recently used entry is evicted
+func WithPolicy(p Policy) Option {
+    return func(l *LRU) {
+        l.policy = p
+    }
+}
+
+// WithTTL sets how long the entries set without an explicit TTL live for, using the func to look up the TTL of each
+// key (e.g. by namespace). Expired entries are treated as missing and removed when accessed, or by the sweeper.
+func WithTTL(fn TTLFunc) Option {
+    return func(l *LRU) {
+        l.ttl = fn
+    }
+}
+
+// WithSweeper starts a background sweep for expired entries every interval, stopped by `LRU.Close`. Without a sweeper
+// expired entries are only removed when accessed, or evicted as normal.
+func WithSweeper(interval time.Duration) Option {
+    return func(l *LRU) {
+        l.sweep = interval
+    }
+}
+
+// WithEvictionCallback registers a func to be called for every entry removed from the cache: evicted, expired,
+// replaced, deleted, purged or cleared. Entries rejected by `Set` were never held, so are not reported. The callback is
+// made outside of the cache locks, so it is safe for it to use the cache.
+func WithEvictionCallback(fn EvictionFunc) Option {
+    return func(l *LRU) {
+        l.onEvict = fn
+    }
+}
+
+// WithNamespaces groups the keys into namespaces using the given func, the usage of each namespace is then reported
+// in the cache status
+func WithNamespaces(fn NamespaceFunc) Option {
+    return func(l *LRU) {
+        l.namespace = fn
+    }
+}
+
+// WithBudgets reserves parts of the cache for the keys mapped to each budget by the func. The budgets are carved out
+// of the maximum size of the cache, with the default budget taking whatever remains.
+func WithBudgets(fn BudgetFunc, budgets ...Budget) Option {
+    return func(l *LRU) {
+        l.budget = fn
+        l.budgets = budgets
+    }
+}
+
+// LRU is a sharded cache, evicting the least recently used entries unless another policy is chosen. Each key is
+// owned by a single shard, which evicts its own entries when over its share of the maximum size - so eviction order
+// is only strictly by the policy within a shard. The cache can be divided into budgets, each with their own shards,
+// so one set of keys cannot evict another.
 type LRU struct {
-    rw      *sync.RWMutex
-    dict    map[string]*list.Element
-    list    *list.List
-    size    int64
-    maxsize int64
+    parts      []*partition
+    partitions map[string]*partition
+    payloads   *payloads
+    nshards    int
+    maxsize    int64
+    policy     Policy
+    negative   *negative
+    onEvict    EvictionFunc
+    namespace  NamespaceFunc
+    budget     BudgetFunc
+    budgets    []Budget
+    ttl        TTLFunc
+    sweep      time.Duration
+    stop       chan struct{}
+    now        func() time.Time
 }
 
-// Set will add/replace the given key with the specified value and return the calculated md5 hash
+// shard finds the shard which owns the given key
+func (l *LRU) shard(key string) *shard {
+    p := l.parts[0]
+
+    if l.budget != nil {
+        if bp, ok := l.partitions[l.budget(key)]; ok {
+            p = bp
+        }
+    }
+
+    return p.shard(key)
+}
+
+// Set will add/replace the given key with the specified value and return the calculated md5 hash. Values larger than
+// a shard are not stored, but the hash is still returned. Identical values share a buffer, so values must not be
+// modified once set. The entry lives for the TTL given by the cache's TTL func, if it has one.
 func (l *LRU) Set(key string, value []byte) string {
-    l.rw.Lock()
-    defer l.rw.Unlock()
+    var ttl time.Duration
+
+    if l.ttl != nil {
+        ttl = l.ttl(key)
+    }
+
+    return l.SetWithTTL(key, value, ttl)
+}
+
+// SetWithTTL will add/replace the given key as `Set`, with the entry expiring after the ttl. A zero ttl never expires.
+func (l *LRU) SetWithTTL(key string, value []byte, ttl time.Duration) string {
+    if l.negative != nil {
+        l.negative.delete(key)
+    }
 
     n := &node{
         key:   key,
@@ -42,92 +260,249 @@ func (l *LRU) Set(key string, value []byte) string {
         md5:   fmt.Sprintf("%x", md5.Sum(value)),
     }
 
-    elm := l.list.PushFront(n)
-    l.dict[key] = elm
-    l.size += int64(len(value))
+    if ttl > 0 {
+        n.expires = l.now().Add(ttl).UnixNano()
+    }
 
-    if l.size > l.maxsize {
-        for l.size > l.maxsize {
-            elm := l.list.Back()
-            n := elm.Value.(*node)
-            delete(l.dict, n.key)
+    if l.namespace != nil {
+        n.ns = l.namespace(key)
+    }
 
-            l.size -= int64(len(n.value))
-            l.list.Remove(elm)
+    if removed := l.shard(key).set(n); l.onEvict != nil {
+        for _, r := range removed {
+            l.onEvict(r.node.key, r.node.value, r.reason)
         }
     }
 
     return n.md5
 }
 
-// Get will fetch the value for the given key or return nil if it does not exist
+// removed reports the nodes removed for the reason to the eviction callback, if there is one
+func (l *LRU) removed(nodes []*node, reason RemovalReason) {
+    if l.onEvict == nil {
+        return
+    }
+
+    for _, n := range nodes {
+        l.onEvict(n.key, n.value, reason)
+    }
+}
+
+// Get will fetch the value for the given key or return nil if it does not exist or has expired
 func (l *LRU) Get(key string) ([]byte, string) {
-    l.rw.RLock()
-    defer l.rw.RUnlock()
+    n, expired := l.shard(key).get(key, l.now().UnixNano())
+
+    if expired != nil {
+        l.removed([]*node{expired}, RemovedExpired)
+    }
 
-    if e, ok := l.dict[key]; ok {
-        n := e.Value.(*node)
-        l.list.MoveToFront(e)
+    if n != nil {
         return n.value, n.md5
     }
 
     return nil, ""
 }
 
-// Exists will determine if there is an entry for the given key
-func (l *LRU) Exists(key string) bool {
-    l.rw.RLock()
-    defer l.rw.RUnlock()
+// SetMissing records that the given key has no value, this is a no-op if the negative cache is not enabled
+func (l *LRU) SetMissing(key string) {
+    if l.negative == nil {
+        return
+    }
 
-    _, ok := l.dict[key]
+    l.negative.set(key)
+}
 
-    return ok
+// Missing will determine if the given key is known to have no value
+func (l *LRU) Missing(key string) bool {
+    if l.negative == nil {
+        return false
+    }
+
+    return l.negative.get(key)
+}
+
+// Exists will determine if there is an unexpired entry for the given key
+func (l *LRU) Exists(key string) bool {
+    return l.shard(key).exists(key, l.now().UnixNano())
 }
 
 // Delete will remove an entry for the given key if it exists
 func (l *LRU) Delete(key string) {
-    l.rw.Lock()
-    defer l.rw.Unlock()
+    if l.negative != nil {
+        l.negative.delete(key)
+    }
 
-    elm, ok := l.dict[key]
+    if n := l.shard(key).delete(key); n != nil {
+        l.removed([]*node{n}, RemovedDeleted)
+    }
+}
 
-    if !ok {
-        return
+// Purge will remove every entry (including negative entries) with a key selected by the match func. The number of
+// entries and bytes freed are returned.
+func (l *LRU) Purge(match func(key string) bool) (int, int64) {
+    if l.negative != nil {
+        l.negative.purge(match)
+    }
+
+    entries, bytes := 0, int64(0)
+
+    for _, p := range l.parts {
+        for _, s := range p.shards {
+            purged, b := s.purge(match)
+            entries += len(purged)
+            bytes += b
+            l.removed(purged, RemovedDeleted)
+        }
+    }
+
+    return entries, bytes
+}
+
+// Walk calls the func for every unexpired entry, shard by shard, in the order the entries would be evicted - so the
+// most valuable entries of each shard come last. The func is called outside of the shard locks, with values that must
+// not be modified. Walking stops at the first error, which is returned.
+func (l *LRU) Walk(fn func(key string, value []byte, md5 string) error) error {
+    for _, p := range l.parts {
+        for _, s := range p.shards {
+            for _, n := range s.nodes(l.now().UnixNano()) {
+                if err := fn(n.key, n.value, n.md5); err != nil {
+                    return err
+                }
+            }
+        }
     }
 
-    delete(l.dict, key)
-    l.list.Remove(elm)
+    return nil
 }
 
 // Status reports the current state of the cache returning:
 // + number of elements
-// + current byte size
+// + current byte size (counting shared values once), the size before deduplication and the number of unique values
 // + maximum byte size
+// + number of shards
+// + eviction policy
+// + hit, miss and eviction statistics
+// + usage by namespace (if enabled)
+// + usage by budget (if enabled)
+// + the negative cache status (if enabled)
 func (l *LRU) Status() *Status {
-    l.rw.RLock()
-    defer l.rw.RUnlock()
-    return &Status{len(l.dict), l.size, l.maxsize}
+    status := &Status{MaxSize: l.maxsize, Policy: l.policy, Payloads: l.payloads.len()}
+
+    for _, p := range l.parts {
+        bs := p.status(status)
+
+        if l.budget != nil {
+            if status.Budgets == nil {
+                status.Budgets = map[string]*BudgetStatus{}
+            }
+
+            status.Budgets[p.budget.Name] = bs
+        }
+    }
+
+    if l.negative != nil {
+        status.Negative = l.negative.status()
+    }
+
+    return status
+}
+
+// Sweep removes every expired entry, returning the number removed
+func (l *LRU) Sweep() int {
+    now := l.now().UnixNano()
+    expired := 0
+
+    for _, p := range l.parts {
+        for _, s := range p.shards {
+            nodes := s.sweep(now)
+            expired += len(nodes)
+            l.removed(nodes, RemovedExpired)
+        }
+    }
+
+    return expired
+}
+
+// Close stops the background sweeper, if running
+func (l *LRU) Close() {
+    if l.stop != nil {
+        close(l.stop)
+        l.stop = nil
+    }
+}
+
+// sweeper removes the expired entries every interval until the cache is closed
+func (l *LRU) sweeper(interval time.Duration, stop chan struct{}) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-stop:
+            return
+        case <-ticker.C:
+            if expired := l.Sweep(); expired > 0 {
+                log.Printf("swept expired cache entries: entries = %d", expired)
+            }
+        }
+    }
 }
 
 // Clear will empty the cache completely
 func (l *LRU) Clear() {
-    l.rw.Lock()
-    defer l.rw.Unlock()
+    if l.negative != nil {
+        l.negative.clear()
+    }
 
-    l.dict = map[string]*list.Element{}
-    l.list = list.New()
-    l.size = 0
+    for _, p := range l.parts {
+        for _, s := range p.shards {
+            l.removed(s.clear(), RemovedDeleted)
+        }
+    }
 }
 
-// New will create a LRU instance with the given size of elements
-func New(maxsize int64) *LRU {
-    log.Printf("created a new cache: max maxsize = %d bytes", maxsize)
+// New will create a LRU instance with the given maximum byte size, split evenly across the shards
+func New(maxsize int64, opts ...Option) *LRU {
     lru := &LRU{
-        rw:      &sync.RWMutex{},
-        dict:    map[string]*list.Element{},
-        list:    list.New(),
-        size:    0,
-        maxsize: maxsize,
+        maxsize:    maxsize,
+        partitions: map[string]*partition{},
+        payloads:   newPayloads(),
+        policy:     PolicyLRU,
+        now:        time.Now,
+    }
+
+    for _, opt := range opts {
+        opt(lru)
+    }
+
+    remaining := maxsize
+
+    for _, b := range lru.budgets {
+        remaining -= b.MaxSize
+    }
+
+    if remaining < 0 {
+        log.Printf("cache budgets exceed the cache size, the default budget will be empty: max size = %d", maxsize)
+        remaining = 0
+    }
+
+    lru.parts = []*partition{
+        newPartition(Budget{Name: DefaultBudget, MaxSize: remaining}, lru.nshards, lru.policy, lru.payloads),
+    }
+
+    for _, b := range lru.budgets {
+        p := newPartition(b, lru.nshards, lru.policy, lru.payloads)
+        lru.parts = append(lru.parts, p)
+        lru.partitions[b.Name] = p
+        log.Printf("reserved cache budget: name = %s, max size = %d bytes, pinned = %t", b.Name, b.MaxSize, b.Pinned)
+    }
+
+    log.Printf("created a new cache: max maxsize = %d bytes, shards = %d, policy = %s",
+        maxsize, len(lru.parts[0].shards), lru.policy)
+
+    if lru.sweep > 0 {
+        lru.stop = make(chan struct{})
+        go lru.sweeper(lru.sweep, lru.stop)
     }
 
     return lru
@@ -4,9 +4,24 @@ import (
     "crypto/md5"
     "fmt"
     "github.com/stretchr/testify/require"
+    "strconv"
+    "strings"
+    "sync"
     "testing"
+    "time"
 )
 
+// filled creates a value of the given size repeating the key, so values are not shared between keys
+func filled(key string, size int) []byte {
+    value := make([]byte, size)
+
+    for i := range value {
+        value[i] = key[i%len(key)]
+    }
+
+    return value
+}
+
 func TestLRU_GetSet(t *testing.T) {
     cache := New(1024)
 
@@ -40,6 +55,205 @@ func TestLRU_Replace(t *testing.T) {
     require.Equal(t, []byte("bbbbbbbb"), v)
 }
 
+func TestLRU_ReplaceSize(t *testing.T) {
+    cache := New(1024)
+
+    cache.Set("a", make([]byte, 256))
+    cache.Set("a", make([]byte, 128))
+    cache.Set("a", make([]byte, 512))
+
+    status := cache.Status()
+    require.Equal(t, 1, status.Elements)
+    require.Equal(t, int64(512), status.Size)
+    require.Equal(t, 1, cache.parts[0].shards[0].policy.len())
+}
+
+func TestLRU_Delete(t *testing.T) {
+    cache := New(1024)
+
+    cache.Set("a", make([]byte, 256))
+    cache.Set("b", make([]byte, 256))
+
+    cache.Delete("a")
+    cache.Delete("c")
+    require.False(t, cache.Exists("a"))
+    require.True(t, cache.Exists("b"))
+
+    status := cache.Status()
+    require.Equal(t, 1, status.Elements)
+    require.Equal(t, int64(256), status.Size)
+}
+
+func TestLRU_Oversize(t *testing.T) {
+    cache := New(1024)
+
+    cache.Set("a", make([]byte, 256))
+    m := cache.Set("b", make([]byte, 2048))
+    require.Equal(t, fmt.Sprintf("%x", md5.Sum(make([]byte, 2048))), m)
+    require.False(t, cache.Exists("b"))
+    require.True(t, cache.Exists("a"))
+
+    // an oversize replacement drops the old value
+    cache.Set("a", make([]byte, 2048))
+    require.False(t, cache.Exists("a"))
+    require.Equal(t, int64(0), cache.Status().Size)
+}
+
+func TestLRU_Shards(t *testing.T) {
+    require.Equal(t, 1, New(1024).Status().Shards)
+    require.Equal(t, 4, New(4*minShardSize).Status().Shards)
+    require.Equal(t, defaultShards, New(1024*minShardSize).Status().Shards)
+
+    cache := New(1000, WithShards(3))
+    require.Equal(t, 3, len(cache.parts[0].shards))
+    require.Equal(t, int64(334), cache.parts[0].shards[0].maxsize)
+    require.Equal(t, int64(333), cache.parts[0].shards[1].maxsize)
+    require.Equal(t, int64(333), cache.parts[0].shards[2].maxsize)
+
+    for i := 0; i < 100; i++ {
+        cache.Set(strconv.Itoa(i), []byte(fmt.Sprintf("%04d", i)))
+    }
+
+    // keys are spread across all the shards and the sizes add up
+    var size int64
+    for _, s := range cache.parts[0].shards {
+        require.NotZero(t, s.policy.len())
+        size += s.size
+    }
+
+    require.Equal(t, int64(400), size)
+    require.Equal(t, int64(400), cache.Status().Size)
+}
+
+func TestLRU_Stats(t *testing.T) {
+    var evicted []string
+    var cache *LRU
+
+    cache = New(1024, WithEvictionCallback(func(key string, value []byte, reason RemovalReason) {
+        if reason != RemovedEvicted {
+            return
+        }
+
+        evicted = append(evicted, key)
+
+        // the callback is made outside of the lock
+        require.False(t, cache.Exists(key))
+    }))
+
+    cache.Set("a", filled("a", 256))
+    cache.Set("b", filled("b", 256))
+    cache.Set("c", filled("c", 256))
+    cache.Set("d", filled("d", 256))
+    cache.Set("e", filled("e", 256))
+    cache.Set("f", filled("f", 256))
+    cache.Set("g", make([]byte, 2048))
+
+    cache.Get("a")
+    cache.Get("c")
+    cache.Get("d")
+    cache.Get("e")
+
+    stats := cache.Status().Stats
+    require.Equal(t, int64(3), stats.Hits)
+    require.Equal(t, int64(1), stats.Misses)
+    require.Equal(t, int64(2), stats.Evictions)
+    require.Equal(t, int64(512), stats.EvictedBytes)
+    require.Equal(t, int64(1), stats.Rejections)
+    require.Equal(t, []string{"a", "b"}, evicted)
+
+    // clearing the cache keeps the statistics
+    cache.Clear()
+    require.Equal(t, stats, cache.Status().Stats)
+}
+
+func TestLRU_EvictionCallback(t *testing.T) {
+    removed := map[string]RemovalReason{}
+
+    cache := New(1024, WithShards(1), WithEvictionCallback(func(key string, value []byte, reason RemovalReason) {
+        removed[key] = reason
+    }))
+
+    now := time.Now()
+    cache.now = func() time.Time { return now }
+
+    cache.Set("replaced", filled("replaced", 64))
+    cache.Set("replaced", filled("replaced", 32))
+    cache.SetWithTTL("accessed", filled("accessed", 64), time.Minute)
+    cache.SetWithTTL("swept", filled("swept", 64), time.Minute)
+    cache.Set("deleted", filled("deleted", 64))
+    cache.Set("purged", filled("purged", 64))
+    cache.Set("evicted", filled("evicted", 64))
+    cache.Set("big", make([]byte, 2048))
+
+    require.Equal(t, map[string]RemovalReason{"replaced": RemovedReplaced}, removed)
+
+    now = now.Add(2 * time.Minute)
+    cache.Get("accessed")
+    cache.Sweep()
+    cache.Delete("deleted")
+    cache.Purge(func(key string) bool { return key == "purged" })
+    cache.Set("filler", filled("filler", 1000))
+
+    // every removal is reported, but not the rejected entry that was never held
+    require.Equal(t, map[string]RemovalReason{
+        "replaced": RemovedEvicted,
+        "accessed": RemovedExpired,
+        "swept":    RemovedExpired,
+        "deleted":  RemovedDeleted,
+        "purged":   RemovedDeleted,
+        "evicted":  RemovedEvicted,
+    }, removed)
+
+    cache.Clear()
+    require.Equal(t, RemovedDeleted, removed["filler"])
+}
+
+func TestLRU_Concurrent(t *testing.T) {
+    cache := New(64*1024, WithShards(8), WithNegative(100, time.Minute))
+
+    wg := &sync.WaitGroup{}
+
+    for g := 0; g < 16; g++ {
+        wg.Add(1)
+        go func(g int) {
+            defer wg.Done()
+
+            for i := 0; i < 2000; i++ {
+                key := strconv.Itoa((g * i) % 500)
+
+                switch i % 5 {
+                case 0:
+                    cache.Set(key, make([]byte, 64+i%256))
+                case 1:
+                    cache.Delete(key)
+                case 2:
+                    cache.SetMissing(key)
+                    cache.Missing(key)
+                default:
+                    cache.Get(key)
+                }
+            }
+        }(g)
+    }
+
+    wg.Wait()
+
+    // the tracked size must match the values held
+    var size int64
+    for _, s := range cache.parts[0].shards {
+        require.Equal(t, len(s.dict), s.policy.len())
+
+        for _, n := range s.dict {
+            size += int64(len(n.value))
+        }
+    }
+
+    status := cache.Status()
+    require.Equal(t, size, status.LogicalSize)
+    require.True(t, status.Size <= status.LogicalSize)
+    require.True(t, status.Size <= status.MaxSize)
+}
+
 func TestLRU_GetNNonExistent(t *testing.T) {
     cache := New(1024)
 
@@ -56,66 +270,167 @@ func TestLRU_GetNNonExistent(t *testing.T) {
 func TestLRU_Eviction(t *testing.T) {
     cache := New(1024)
 
-    data0 := make([]byte, 256, 256)
-
-    cache.Set("a", data0)
-    cache.Set("b", data0)
-    cache.Set("c", data0)
-    cache.Set("d", data0)
+    cache.Set("a", filled("a", 256))
+    cache.Set("b", filled("b", 256))
+    cache.Set("c", filled("c", 256))
+    cache.Set("d", filled("d", 256))
 
     _, _ = cache.Get("d")
     _, _ = cache.Get("c")
     _, _ = cache.Get("b")
     _, _ = cache.Get("a")
 
-    require.Equal(t, "a", cache.list.Front().Value.(*node).key)
-    require.Equal(t, "d", cache.list.Back().Value.(*node).key)
-    require.Equal(t, int64(1024), cache.size)
+    require.Equal(t, "a", cache.parts[0].shards[0].policy.(*lruEvictor).list.Front().Value.(*node).key)
+    require.Equal(t, "d", cache.parts[0].shards[0].policy.(*lruEvictor).list.Back().Value.(*node).key)
+    require.Equal(t, int64(1024), cache.parts[0].shards[0].size)
 
-    cache.Set("e", data0)
+    cache.Set("e", filled("e", 256))
     require.False(t, cache.Exists("d"))
     require.True(t, cache.Exists("e"))
 
-    require.Equal(t, "e", cache.list.Front().Value.(*node).key)
-    require.Equal(t, "c", cache.list.Back().Value.(*node).key)
+    require.Equal(t, "e", cache.parts[0].shards[0].policy.(*lruEvictor).list.Front().Value.(*node).key)
+    require.Equal(t, "c", cache.parts[0].shards[0].policy.(*lruEvictor).list.Back().Value.(*node).key)
 }
 
 func TestLRU_Clear(t *testing.T) {
     cache := New(1024)
 
-    data0 := make([]byte, 256, 256)
+    cache.Set("a", filled("a", 256))
+    cache.Set("b", filled("b", 256))
+    cache.Set("c", filled("c", 256))
+    cache.Set("d", filled("d", 256))
 
-    cache.Set("a", data0)
-    cache.Set("b", data0)
-    cache.Set("c", data0)
-    cache.Set("d", data0)
-
-    require.Equal(t, 4, cache.list.Len())
-    require.Equal(t, 4, len(cache.dict))
-    require.Equal(t, int64(1024), cache.size)
+    require.Equal(t, 4, cache.parts[0].shards[0].policy.len())
+    require.Equal(t, 4, len(cache.parts[0].shards[0].dict))
+    require.Equal(t, int64(1024), cache.parts[0].shards[0].size)
     require.True(t, cache.Exists("a"))
     require.True(t, cache.Exists("b"))
     require.True(t, cache.Exists("c"))
     require.True(t, cache.Exists("d"))
 
     cache.Clear()
-    require.Equal(t, 0, cache.list.Len())
-    require.Equal(t, 0, len(cache.dict))
-    require.Equal(t, int64(0), cache.size)
+    require.Equal(t, 0, cache.parts[0].shards[0].policy.len())
+    require.Equal(t, 0, len(cache.parts[0].shards[0].dict))
+    require.Equal(t, int64(0), cache.parts[0].shards[0].size)
     require.False(t, cache.Exists("a"))
     require.False(t, cache.Exists("b"))
     require.False(t, cache.Exists("c"))
     require.False(t, cache.Exists("d"))
 }
 
+func TestLRU_Purge(t *testing.T) {
+    cache := New(4096, WithShards(4), WithNegative(10, time.Minute))
+
+    cache.Set("a/1", make([]byte, 100))
+    cache.Set("a/2", make([]byte, 200))
+    cache.Set("b/1", make([]byte, 300))
+    cache.SetMissing("a/3")
+    cache.SetMissing("b/3")
+
+    entries, bytes := cache.Purge(func(key string) bool {
+        return strings.HasPrefix(key, "a/")
+    })
+
+    require.Equal(t, 2, entries)
+    require.Equal(t, int64(300), bytes)
+    require.False(t, cache.Exists("a/1"))
+    require.False(t, cache.Exists("a/2"))
+    require.True(t, cache.Exists("b/1"))
+    require.False(t, cache.Missing("a/3"))
+    require.True(t, cache.Missing("b/3"))
+    require.Equal(t, int64(300), cache.Status().Size)
+}
+
+func TestLRU_Namespaces(t *testing.T) {
+    cache := New(1024, WithShards(2), WithNamespaces(func(key string) string {
+        return strings.Split(key, "/")[0]
+    }))
+
+    cache.Set("a/1", make([]byte, 100))
+    cache.Set("a/2", make([]byte, 200))
+    cache.Set("b/1", make([]byte, 300))
+    cache.Set("a/2", make([]byte, 50))
+
+    status := cache.Status()
+    require.Equal(t, &Usage{Elements: 2, Size: 150}, status.Namespaces["a"])
+    require.Equal(t, &Usage{Elements: 1, Size: 300}, status.Namespaces["b"])
+
+    cache.Delete("b/1")
+    status = cache.Status()
+    require.Len(t, status.Namespaces, 1)
+
+    cache.Clear()
+    require.Nil(t, cache.Status().Namespaces)
+}
+
+func TestLRU_Budgets(t *testing.T) {
+    cache := New(2048, WithBudgets(
+        func(key string) string {
+            return strings.Split(key, "/")[0]
+        },
+        Budget{Name: "low", MaxSize: 512, Pinned: true},
+        Budget{Name: "hs", MaxSize: 512},
+    ))
+
+    cache.Set("low/1", filled("low/1", 256))
+    cache.Set("low/2", filled("low/2", 256))
+
+    // the high zoom keys fill their own budget and evict from it, not the others
+    for i := 0; i < 10; i++ {
+        cache.Set("hs/"+strconv.Itoa(i), filled("hs/"+strconv.Itoa(i), 256))
+    }
+
+    // default keys only have the remainder
+    for i := 0; i < 10; i++ {
+        cache.Set("other/"+strconv.Itoa(i), filled("other/"+strconv.Itoa(i), 256))
+    }
+
+    require.True(t, cache.Exists("low/1"))
+    require.True(t, cache.Exists("low/2"))
+    require.True(t, cache.Exists("hs/9"))
+    require.False(t, cache.Exists("hs/7"))
+    require.True(t, cache.Exists("other/9"))
+    require.False(t, cache.Exists("other/5"))
+
+    // pinned budgets reject rather than evict
+    cache.Set("low/3", filled("low/3", 256))
+    require.False(t, cache.Exists("low/3"))
+    require.True(t, cache.Exists("low/1"))
+
+    // replacing a pinned entry with one that fits is fine
+    cache.Set("low/1", make([]byte, 128))
+    v, _ := cache.Get("low/1")
+    require.Len(t, v, 128)
+
+    status := cache.Status()
+    require.Equal(t, &BudgetStatus{Elements: 2, Size: 384, MaxSize: 512, Pinned: true}, status.Budgets["low"])
+    require.Equal(t, &BudgetStatus{Elements: 2, Size: 512, MaxSize: 512}, status.Budgets["hs"])
+    require.Equal(t, &BudgetStatus{Elements: 4, Size: 1024, MaxSize: 1024}, status.Budgets[DefaultBudget])
+    require.Equal(t, 8, status.Elements)
+    require.Equal(t, int64(1920), status.Size)
+    require.Equal(t, int64(2048), status.MaxSize)
+    require.Equal(t, int64(1), status.Stats.Rejections)
+}
+
+func TestParseSize(t *testing.T) {
+    for value, expected := range map[string]int64{"1k": 1024, "512m": 512 * 1024 * 1024, "512mb": 512 * 1024 * 1024, "2G": 2 * 1024 * 1024 * 1024} {
+        size, err := ParseSize(value)
+        require.NoError(t, err)
+        require.Equal(t, expected, size)
+    }
+
+    for _, value := range []string{"", "0m", "12", "12t", "m12", "x12m"} {
+        _, err := ParseSize(value)
+        require.Error(t, err, value)
+    }
+}
+
 func TestLRU_Status(t *testing.T) {
     cache := New(1024)
 
-    data0 := make([]byte, 256, 256)
-
-    cache.Set("a", data0)
-    cache.Set("b", data0)
-    cache.Set("c", data0)
+    cache.Set("a", filled("a", 256))
+    cache.Set("b", filled("b", 256))
+    cache.Set("c", filled("c", 256))
 
     status := cache.Status()
     require.Equal(t, 3, status.Elements)
@@ -130,3 +445,286 @@ func TestLRU_Status(t *testing.T) {
     require.Equal(t, int64(1024), status.MaxSize)
 
 }
+
+func TestLRU_Negative(t *testing.T) {
+    cache := New(1024, WithNegative(2, time.Minute))
+
+    now := time.Now()
+    cache.negative.now = func() time.Time { return now }
+
+    require.False(t, cache.Missing("a"))
+
+    cache.SetMissing("a")
+    cache.SetMissing("b")
+    require.True(t, cache.Missing("a"))
+    require.True(t, cache.Missing("b"))
+
+    // over the element limit, the least recently used key goes
+    cache.SetMissing("c")
+    require.False(t, cache.Missing("a"))
+    require.True(t, cache.Missing("c"))
+
+    // setting a value clears the negative entry
+    cache.Set("c", []byte("cccccccc"))
+    require.False(t, cache.Missing("c"))
+
+    // entries expire after the ttl
+    now = now.Add(2 * time.Minute)
+    require.False(t, cache.Missing("b"))
+
+    status := cache.Status()
+    require.Equal(t, 0, status.Negative.Elements)
+    require.Equal(t, 2, status.Negative.MaxElements)
+    require.Equal(t, int64(3), status.Negative.Hits)
+    require.Equal(t, 1, status.Elements)
+}
+
+func TestLRU_NegativeDisabled(t *testing.T) {
+    cache := New(1024)
+
+    cache.SetMissing("a")
+    require.False(t, cache.Missing("a"))
+    require.Nil(t, cache.Status().Negative)
+}
+
+func benchmarkParallelGet(b *testing.B, shards int) {
+    cache := New(64*minShardSize, WithShards(shards))
+
+    for i := 0; i < 10000; i++ {
+        cache.Set(strconv.Itoa(i), make([]byte, 1024))
+    }
+
+    b.ResetTimer()
+    b.RunParallel(func(pb *testing.PB) {
+        i := 0
+        for pb.Next() {
+            cache.Get(strconv.Itoa(i % 10000))
+            i++
+        }
+    })
+}
+
+func benchmarkParallelMixed(b *testing.B, shards int) {
+    cache := New(4*minShardSize, WithShards(shards))
+    value := make([]byte, 1024)
+
+    b.ResetTimer()
+    b.RunParallel(func(pb *testing.PB) {
+        i := 0
+        for pb.Next() {
+            key := strconv.Itoa(i % 20000)
+
+            if _, m := cache.Get(key); m == "" {
+                cache.Set(key, value)
+            }
+            i++
+        }
+    })
+}
+
+func BenchmarkLRU_ParallelGet1(b *testing.B)    { benchmarkParallelGet(b, 1) }
+func BenchmarkLRU_ParallelGet16(b *testing.B)   { benchmarkParallelGet(b, 16) }
+func BenchmarkLRU_ParallelMixed1(b *testing.B)  { benchmarkParallelMixed(b, 1) }
+func BenchmarkLRU_ParallelMixed16(b *testing.B) { benchmarkParallelMixed(b, 16) }
+
+func TestLRU_Dedup(t *testing.T) {
+    cache := New(1024, WithShards(1))
+
+    sea := filled("sea", 256)
+
+    // identical values share a buffer and are only counted once
+    for i := 0; i < 10; i++ {
+        cache.Set(strconv.Itoa(i), append([]byte(nil), sea...))
+    }
+
+    cache.Set("land", filled("land", 256))
+
+    status := cache.Status()
+    require.Equal(t, 11, status.Elements)
+    require.Equal(t, 2, status.Payloads)
+    require.Equal(t, int64(512), status.Size)
+    require.Equal(t, int64(11*256), status.LogicalSize)
+
+    a, _ := cache.Get("0")
+    b, _ := cache.Get("9")
+    require.Equal(t, sea, a)
+    require.True(t, &a[0] == &b[0])
+
+    // the buffer is freed with its last reference
+    for i := 0; i < 9; i++ {
+        cache.Delete(strconv.Itoa(i))
+    }
+
+    require.Equal(t, int64(512), cache.Status().Size)
+
+    cache.Delete("9")
+    require.Equal(t, int64(256), cache.Status().Size)
+    require.Equal(t, 1, cache.Status().Payloads)
+
+    // replacing a value with a shared one frees the old buffer
+    cache.Set("land", append([]byte(nil), sea...))
+    cache.Set("sea", append([]byte(nil), sea...))
+    require.Equal(t, int64(256), cache.Status().Size)
+    entries, bytes := cache.Purge(func(key string) bool { return key == "land" })
+    require.Equal(t, 1, entries)
+    require.Equal(t, int64(0), bytes)
+}
+
+func TestLRU_DedupPinned(t *testing.T) {
+    cache := New(512, WithShards(1), WithBudgets(
+        func(key string) string { return "pinned" },
+        Budget{Name: "pinned", MaxSize: 512, Pinned: true},
+    ))
+
+    cache.Set("a", filled("a", 256))
+    cache.Set("b", filled("b", 256))
+
+    // a full pinned budget still takes values it already holds
+    cache.Set("c", filled("a", 256))
+    require.True(t, cache.Exists("c"))
+
+    cache.Set("d", filled("d", 256))
+    require.False(t, cache.Exists("d"))
+}
+
+func TestLRU_DedupShards(t *testing.T) {
+    cache := New(32*1024*1024, WithShards(16), WithBudgets(
+        func(key string) string { return strings.SplitN(key, "/", 2)[0] },
+        Budget{Name: "z14", MaxSize: 16 * 1024 * 1024},
+    ))
+
+    sea := filled("sea", 256)
+
+    // the charged bytes of every shard, checking that the buffer is charged to exactly one shard
+    used := func() int64 {
+        var total int64
+
+        for _, p := range cache.parts {
+            for _, s := range p.shards {
+                total += s.used()
+            }
+        }
+
+        return total
+    }
+
+    // identical values spread across the shards of both budgets cost a single payload
+    for i := 0; i < 100; i++ {
+        cache.Set(fmt.Sprintf("z0/%d", i), append([]byte(nil), sea...))
+        cache.Set(fmt.Sprintf("z14/%d", i), append([]byte(nil), sea...))
+    }
+
+    status := cache.Status()
+    require.Equal(t, 200, status.Elements)
+    require.Equal(t, 1, status.Payloads)
+    require.Equal(t, int64(256), status.Size)
+    require.Equal(t, int64(200*256), status.LogicalSize)
+    require.Equal(t, int64(256), status.Budgets[DefaultBudget].Size+status.Budgets["z14"].Size)
+    require.Equal(t, int64(256), used())
+
+    // the first entry held the charge, which a shard still referencing the buffer retains while it is in use
+    cache.Delete("z0/0")
+    require.Equal(t, int64(256), cache.Status().Size)
+    require.Equal(t, int64(256), used())
+
+    cache.Set("z14/new", append([]byte(nil), sea...))
+    require.Equal(t, int64(256), used())
+
+    for i := 1; i < 100; i++ {
+        cache.Delete(fmt.Sprintf("z0/%d", i))
+        cache.Delete(fmt.Sprintf("z14/%d", i))
+    }
+
+    require.Equal(t, int64(256), used())
+
+    cache.Delete("z14/0")
+    cache.Delete("z14/new")
+    require.Equal(t, int64(0), used())
+    require.Equal(t, 0, cache.Status().Payloads)
+}
+
+func TestLRU_DedupBudgetEviction(t *testing.T) {
+    cache := New(4096, WithShards(1), WithBudgets(
+        func(key string) string { return strings.SplitN(key, "/", 2)[0] },
+        Budget{Name: "small", MaxSize: 1024},
+    ))
+
+    sea := filled("sea", 800)
+
+    // the small budget holds the charge of a buffer the default budget also references
+    cache.Set("small/sea", append([]byte(nil), sea...))
+    cache.Set("large/sea", append([]byte(nil), sea...))
+    require.Equal(t, int64(800), cache.Status().Budgets["small"].Size)
+
+    // once evicted from the small budget, the charge moves to the budget still referencing the buffer, so the small
+    // budget keeps room for its own entries
+    for i := 0; i < 3; i++ {
+        cache.Set(fmt.Sprintf("small/%d", i), filled(strconv.Itoa(i), 300))
+    }
+
+    status := cache.Status()
+    require.False(t, cache.Exists("small/sea"))
+    require.True(t, cache.Exists("small/2"))
+    require.Equal(t, &BudgetStatus{Elements: 3, Size: 900, MaxSize: 1024}, status.Budgets["small"])
+    require.Equal(t, int64(800), status.Budgets[DefaultBudget].Size)
+
+    // and the buffer is freed with its last reference
+    cache.Delete("large/sea")
+    require.Equal(t, int64(0), cache.Status().Budgets[DefaultBudget].Size)
+    require.Equal(t, 3, cache.Status().Payloads)
+}
+
+func TestLRU_TTL(t *testing.T) {
+    cache := New(1024, WithShards(1), WithTTL(func(key string) time.Duration {
+        if key == "short" {
+            return time.Minute
+        }
+        return 0
+    }))
+
+    now := time.Now()
+    cache.now = func() time.Time { return now }
+
+    cache.Set("short", filled("short", 64))
+    cache.Set("forever", filled("forever", 64))
+    cache.SetWithTTL("explicit", filled("explicit", 64), time.Hour)
+
+    now = now.Add(2 * time.Minute)
+
+    // expired entries are missing, and removed on access
+    require.False(t, cache.Exists("short"))
+    value, _ := cache.Get("short")
+    require.Nil(t, value)
+    require.True(t, cache.Exists("forever"))
+    require.True(t, cache.Exists("explicit"))
+
+    status := cache.Status()
+    require.Equal(t, 2, status.Elements)
+    require.Equal(t, int64(1), status.Stats.Expired)
+    require.Equal(t, int64(1), status.Stats.Misses)
+
+    // a refreshed entry gets a new expiry
+    cache.Set("short", filled("short", 64))
+    now = now.Add(30 * time.Second)
+    value, _ = cache.Get("short")
+    require.NotNil(t, value)
+
+    // the sweep removes whatever has expired without it being accessed
+    now = now.Add(2 * time.Hour)
+    require.Equal(t, 2, cache.Sweep())
+    require.Equal(t, 1, cache.Status().Elements)
+    require.Equal(t, int64(64), cache.Status().Size)
+    require.Equal(t, int64(3), cache.Status().Stats.Expired)
+}
+
+func TestLRU_Sweeper(t *testing.T) {
+    cache := New(1024, WithSweeper(time.Millisecond))
+    defer cache.Close()
+
+    cache.SetWithTTL("a", filled("a", 64), time.Nanosecond)
+
+    require.Eventually(t, func() bool {
+        return cache.Status().Elements == 0
+    }, time.Second, time.Millisecond)
+    require.Equal(t, int64(1), cache.Status().Stats.Expired)
+}
@@ -0,0 +1,132 @@
+package lru
+
+import (
+    "container/list"
+    "sync"
+    "time"
+)
+
+// NegativeStatus reports the state of the negative cache
+type NegativeStatus struct {
+    Elements    int   `json:"elements"`
+    MaxElements int   `json:"maxElements"`
+    TTL         int64 `json:"ttl"`
+    Hits        int64 `json:"hits"`
+}
+
+// missing is a negative cache entry, recording when the key was found to be missing
+type missing struct {
+    key     string
+    expires time.Time
+}
+
+// negative is a size and time limited LRU of keys which are known to have no value
+type negative struct {
+    mu          *sync.Mutex
+    dict        map[string]*list.Element
+    list        *list.List
+    maxElements int
+    ttl         time.Duration
+    hits        int64
+    now         func() time.Time
+}
+
+// set records the key as missing, evicting the oldest keys if over the element limit
+func (n *negative) set(key string) {
+    n.mu.Lock()
+    defer n.mu.Unlock()
+
+    expires := n.now().Add(n.ttl)
+
+    if elm, ok := n.dict[key]; ok {
+        elm.Value.(*missing).expires = expires
+        n.list.MoveToFront(elm)
+        return
+    }
+
+    n.dict[key] = n.list.PushFront(&missing{key: key, expires: expires})
+
+    for n.list.Len() > n.maxElements {
+        n.remove(n.list.Back())
+    }
+}
+
+// get determines if the key is known to be missing, expired entries are dropped
+func (n *negative) get(key string) bool {
+    n.mu.Lock()
+    defer n.mu.Unlock()
+
+    elm, ok := n.dict[key]
+
+    if !ok {
+        return false
+    }
+
+    if n.now().After(elm.Value.(*missing).expires) {
+        n.remove(elm)
+        return false
+    }
+
+    n.list.MoveToFront(elm)
+    n.hits++
+
+    return true
+}
+
+// delete will drop the key if present
+func (n *negative) delete(key string) {
+    n.mu.Lock()
+    defer n.mu.Unlock()
+
+    if elm, ok := n.dict[key]; ok {
+        n.remove(elm)
+    }
+}
+
+func (n *negative) remove(elm *list.Element) {
+    delete(n.dict, elm.Value.(*missing).key)
+    n.list.Remove(elm)
+}
+
+// purge drops every key selected by the match func
+func (n *negative) purge(match func(key string) bool) {
+    n.mu.Lock()
+    defer n.mu.Unlock()
+
+    for key, elm := range n.dict {
+        if match(key) {
+            n.remove(elm)
+        }
+    }
+}
+
+func (n *negative) clear() {
+    n.mu.Lock()
+    defer n.mu.Unlock()
+
+    n.dict = map[string]*list.Element{}
+    n.list = list.New()
+}
+
+func (n *negative) status() *NegativeStatus {
+    n.mu.Lock()
+    defer n.mu.Unlock()
+
+    return &NegativeStatus{
+        Elements:    len(n.dict),
+        MaxElements: n.maxElements,
+        TTL:         int64(n.ttl / time.Second),
+        Hits:        n.hits,
+    }
+}
+
+func newNegative(maxElements int, ttl time.Duration) *negative {
+    return &negative{
+        mu:          &sync.Mutex{},
+        dict:        map[string]*list.Element{},
+        list:        list.New(),
+        maxElements: maxElements,
+        ttl:         ttl,
+        now:         time.Now,
+    }
+}
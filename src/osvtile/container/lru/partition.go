@@ -0,0 +1,140 @@
+package lru
+
+import (
+    "fmt"
+    "hash/fnv"
+    "regexp"
+    "strconv"
+    "strings"
+)
+
+// Budget reserves part of the cache for the keys mapped to it by the cache's budget func. Entries in a pinned budget
+// are never evicted, new entries are rejected instead once the budget is full.
+type Budget struct {
+    Name    string
+    MaxSize int64
+    Pinned  bool
+}
+
+// BudgetStatus reports the usage of a budget
+type BudgetStatus struct {
+    Elements int   `json:"elements"`
+    Size     int64 `json:"size"`
+    MaxSize  int64 `json:"maxSize"`
+    Pinned   bool  `json:"pinned,omitempty"`
+}
+
+// BudgetFunc maps a key to the name of its budget, keys mapped to an empty or unknown name use the default budget
+type BudgetFunc func(key string) string
+
+// DefaultBudget is the name of the budget holding all keys not mapped to another budget
+const DefaultBudget = "default"
+
+// partition is the set of shards holding the entries of a single budget
+type partition struct {
+    budget Budget
+    shards []*shard
+}
+
+// shard finds the shard which owns the given key
+func (p *partition) shard(key string) *shard {
+    if len(p.shards) == 1 {
+        return p.shards[0]
+    }
+
+    h := fnv.New32a()
+    _, _ = h.Write([]byte(key))
+
+    return p.shards[h.Sum32()%uint32(len(p.shards))]
+}
+
+// status adds the shards to the cache status, returning the usage of the partition itself
+func (p *partition) status(status *Status) *BudgetStatus {
+    ps := &Status{}
+
+    for _, s := range p.shards {
+        s.status(ps)
+    }
+
+    status.Elements += ps.Elements
+    status.Size += ps.Size
+    status.LogicalSize += ps.LogicalSize
+    status.Shards += len(p.shards)
+    status.Stats.add(ps.Stats)
+
+    for ns, u := range ps.Namespaces {
+        if status.Namespaces == nil {
+            status.Namespaces = map[string]*Usage{}
+        }
+
+        if total, ok := status.Namespaces[ns]; ok {
+            total.Elements += u.Elements
+            total.Size += u.Size
+        } else {
+            status.Namespaces[ns] = u
+        }
+    }
+
+    return &BudgetStatus{
+        Elements: ps.Elements,
+        Size:     ps.Size,
+        MaxSize:  p.budget.MaxSize,
+        Pinned:   p.budget.Pinned,
+    }
+}
+
+// newPartition splits the budget across the given number of shards, or if zero, as many shards as the budget can
+// hold (up to the default), each evicting by the policy and sharing the payload store of the cache
+func newPartition(budget Budget, nshards int, policy Policy, payloads *payloads) *partition {
+    if nshards <= 0 {
+        nshards = defaultShards
+
+        for budget.MaxSize/int64(nshards) < minShardSize && nshards > 1 {
+            nshards /= 2
+        }
+    }
+
+    p := &partition{
+        budget: budget,
+        shards: make([]*shard, nshards),
+    }
+
+    for i := range p.shards {
+        size := budget.MaxSize / int64(nshards)
+
+        // the first shard picks up any remainder so the shards add up to the maximum size
+        if i == 0 {
+            size += budget.MaxSize % int64(nshards)
+        }
+
+        p.shards[i] = newShard(size, budget.Pinned, policy, payloads)
+    }
+
+    return p
+}
+
+var sizeRegex = regexp.MustCompile(`^([1-9]\d*)([kmg])b?$`)
+
+// ParseSize converts a size of the form <INTEGER><k|m|g>, e.g. `1g` or `512mb`, to bytes
+func ParseSize(value string) (int64, error) {
+    matches := sizeRegex.FindStringSubmatch(strings.ToLower(strings.TrimSpace(value)))
+
+    if matches == nil {
+        return 0, fmt.Errorf("invalid size, expected <INTEGER><k|m|g>: value = %s", value)
+    }
+
+    size, err := strconv.ParseInt(matches[1], 10, 64)
+
+    if err != nil {
+        return 0, fmt.Errorf("invalid size: value = %s, error = %s", value, err)
+    }
+
+    switch matches[2] {
+    case "g":
+        return size * 1024 * 1024 * 1024, nil
+    case "m":
+        return size * 1024 * 1024, nil
+    default:
+        return size * 1024, nil
+    }
+}
@@ -0,0 +1,115 @@
+package lru
+
+import (
+    "container/list"
+    "fmt"
+    "strings"
+)
+
+// Policy names the eviction policy used by each shard of the cache
+type Policy string
+
+const (
+    // PolicyLRU evicts the least recently used entry
+    PolicyLRU Policy = "lru"
+    // PolicyLFU evicts the least frequently used entry, ties going to the least recently used
+    PolicyLFU Policy = "lfu"
+    // PolicyARC is the adaptive replacement cache, balancing recency and frequency by learning from recent evictions
+    PolicyARC Policy = "arc"
+    // PolicyTinyLFU is W-TinyLFU: new entries go to a small LRU window, and only enter the main cache if they are
+    // used more often than the entry they would evict
+    PolicyTinyLFU Policy = "tinylfu"
+)
+
+// Policies lists the supported eviction policies
+var Policies = []Policy{PolicyLRU, PolicyLFU, PolicyARC, PolicyTinyLFU}
+
+// ParsePolicy converts a policy name (case insensitive) to a Policy
+func ParsePolicy(value string) (Policy, error) {
+    p := Policy(strings.ToLower(strings.TrimSpace(value)))
+
+    for _, known := range Policies {
+        if p == known {
+            return p, nil
+        }
+    }
+
+    return "", fmt.Errorf("unknown cache policy, must be one of %v: value = %s", Policies, value)
+}
+
+// evictor tracks the entries of a shard and decides which to evict. It is only called with the shard lock held.
+type evictor interface {
+    // add records a new entry
+    add(n *node)
+    // hit records an access to an entry
+    hit(n *node)
+    // remove forgets an entry deleted from the shard
+    remove(n *node)
+    // evict picks the next entry to evict and forgets it, nil if there are no entries
+    evict() *node
+    // len reports the number of entries tracked
+    len() int
+    // walk calls the func for each entry, in the order they would be evicted
+    walk(fn func(n *node))
+    // clear forgets every entry
+    clear()
+}
+
+// newEvictor creates the evictor for the policy, for a shard of the given byte size
+func newEvictor(p Policy, maxsize int64) evictor {
+    switch p {
+    case PolicyLFU:
+        return newLFU()
+    case PolicyARC:
+        return newARC()
+    case PolicyTinyLFU:
+        return newTinyLFU(maxsize)
+    default:
+        return newLRUEvictor()
+    }
+}
+
+// lruEvictor keeps the entries in a list from most to least recently used
+type lruEvictor struct {
+    list *list.List
+}
+
+func (l *lruEvictor) add(n *node) {
+    n.elem = l.list.PushFront(n)
+}
+
+func (l *lruEvictor) hit(n *node) {
+    l.list.MoveToFront(n.elem)
+}
+
+func (l *lruEvictor) remove(n *node) {
+    l.list.Remove(n.elem)
+}
+
+func (l *lruEvictor) evict() *node {
+    elm := l.list.Back()
+
+    if elm == nil {
+        return nil
+    }
+
+    return l.list.Remove(elm).(*node)
+}
+
+func (l *lruEvictor) walk(fn func(n *node)) {
+    for elm := l.list.Back(); elm != nil; elm = elm.Prev() {
+        fn(elm.Value.(*node))
+    }
+}
+
+func (l *lruEvictor) len() int {
+    return l.list.Len()
+}
+
+func (l *lruEvictor) clear() {
+    l.list.Init()
+}
+
+func newLRUEvictor() *lruEvictor {
+    return &lruEvictor{list: list.New()}
+}
@@ -0,0 +1,221 @@
+package lru
+
+import (
+    "bufio"
+    "compress/gzip"
+    "fmt"
+    "github.com/stretchr/testify/require"
+    "math/rand"
+    "os"
+    "strconv"
+    "strings"
+    "testing"
+)
+
+func TestParsePolicy(t *testing.T) {
+    p, err := ParsePolicy(" TinyLFU ")
+    require.NoError(t, err)
+    require.Equal(t, PolicyTinyLFU, p)
+
+    _, err = ParsePolicy("mru")
+    require.Error(t, err)
+}
+
+// every policy must keep its own tracking in step with the shard through a random mix of operations
+func TestPolicies_Consistency(t *testing.T) {
+    for _, p := range Policies {
+        t.Run(string(p), func(t *testing.T) {
+            cache := New(64*1024, WithShards(1), WithPolicy(p))
+            r := rand.New(rand.NewSource(1))
+
+            for i := 0; i < 20000; i++ {
+                key := strconv.Itoa(r.Intn(200))
+
+                switch r.Intn(10) {
+                case 0:
+                    cache.Delete(key)
+                case 1, 2, 3:
+                    cache.Set(key, make([]byte, 256+r.Intn(2048)))
+                default:
+                    _, _ = cache.Get(key)
+                }
+            }
+
+            s := cache.parts[0].shards[0]
+            require.Equal(t, len(s.dict), s.policy.len())
+
+            var size, logical, charged int64
+            unique := map[string]bool{}
+
+            for _, n := range s.dict {
+                logical += n.size()
+                charged += n.cost
+
+                if !unique[n.md5] {
+                    unique[n.md5] = true
+                    size += n.size()
+                }
+            }
+
+            require.Equal(t, logical, s.logical)
+            require.Equal(t, size, s.used())
+            require.Equal(t, len(unique), s.payloads.len())
+            require.Equal(t, charged, s.size)
+
+            // the segments of tinylfu count the same bytes as the shard
+            if tl, ok := s.policy.(*tinyLFU); ok {
+                require.Equal(t, charged, tl.size())
+            }
+            require.True(t, s.used() <= s.maxsize)
+            require.Equal(t, p, cache.Status().Policy)
+
+            cache.Clear()
+            require.Equal(t, 0, s.policy.len())
+            require.Equal(t, int64(0), s.used())
+            require.Equal(t, 0, s.payloads.len())
+        })
+    }
+}
+
+func TestLFU_KeepsFrequent(t *testing.T) {
+    cache := New(1024, WithShards(1), WithPolicy(PolicyLFU))
+    data := make([]byte, 256)
+
+    cache.Set("hot", data)
+
+    for i := 0; i < 5; i++ {
+        _, _ = cache.Get("hot")
+    }
+
+    for i := 0; i < 10; i++ {
+        cache.Set(strconv.Itoa(i), data)
+    }
+
+    require.True(t, cache.Exists("hot"))
+    require.True(t, cache.Exists("9"))
+}
+
+// a scan of one-off keys flushes the hot set from an LRU, but not from the frequency aware policies
+func TestPolicies_ScanResistance(t *testing.T) {
+    data := make([]byte, 1024)
+
+    for _, p := range []Policy{PolicyLFU, PolicyARC, PolicyTinyLFU} {
+        t.Run(string(p), func(t *testing.T) {
+            cache := New(128*1024, WithShards(1), WithPolicy(p))
+
+            for round := 0; round < 10; round++ {
+                for i := 0; i < 50; i++ {
+                    key := fmt.Sprintf("hot-%d", i)
+
+                    if v, _ := cache.Get(key); v == nil {
+                        cache.Set(key, data)
+                    }
+                }
+            }
+
+            for i := 0; i < 1000; i++ {
+                cache.Set(fmt.Sprintf("scan-%d", i), data)
+            }
+
+            hot := 0
+
+            for i := 0; i < 50; i++ {
+                if cache.Exists(fmt.Sprintf("hot-%d", i)) {
+                    hot++
+                }
+            }
+
+            require.True(t, hot >= 40, "hot entries kept = %d", hot)
+        })
+    }
+}
+
+// request is a single tile request of a trace
+type request struct {
+    key  string
+    size int
+}
+
+// readTrace loads a trace of tile requests, one `z/x/y size` per line. testdata/trace.txt.gz is synthetic: users
+// browsing around a handful of towns in the south of England, interleaved with the odd user sweeping across the
+// country at high zoom. Set OSVTILE_TRACE to replay a trace recorded from a real server instead.
+func readTrace(b *testing.B) []request {
+    path := os.Getenv("OSVTILE_TRACE")
+
+    if path == "" {
+        path = "testdata/trace.txt.gz"
+    }
+
+    f, err := os.Open(path)
+    require.NoError(b, err)
+    defer f.Close()
+
+    reader := bufio.NewReader(f)
+    var scanner *bufio.Scanner
+
+    if strings.HasSuffix(path, ".gz") {
+        gz, err := gzip.NewReader(reader)
+        require.NoError(b, err)
+        scanner = bufio.NewScanner(gz)
+    } else {
+        scanner = bufio.NewScanner(reader)
+    }
+
+    var trace []request
+
+    for scanner.Scan() {
+        line := strings.TrimSpace(scanner.Text())
+
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+
+        fields := strings.Fields(line)
+        require.Len(b, fields, 2, line)
+        size, err := strconv.Atoi(fields[1])
+        require.NoError(b, err, line)
+
+        trace = append(trace, request{key: fields[0], size: size})
+    }
+
+    require.NoError(b, scanner.Err())
+
+    return trace
+}
+
+// benchmarkTrace replays the trace through a cache of the given size, reporting the hit ratio
+func benchmarkTrace(b *testing.B, p Policy, maxsize int64) {
+    trace := readTrace(b)
+    b.ResetTimer()
+
+    var hits, requests int64
+
+    for i := 0; i < b.N; i++ {
+        cache := New(maxsize, WithPolicy(p))
+
+        for _, r := range trace {
+            requests++
+
+            if v, _ := cache.Get(r.key); v != nil {
+                hits++
+                continue
+            }
+
+            // the key is written into the value so tiles are not deduplicated
+            value := make([]byte, r.size)
+            copy(value, r.key)
+            cache.Set(r.key, value)
+        }
+    }
+
+    b.ReportMetric(100*float64(hits)/float64(requests), "hit%")
+}
+
+func BenchmarkTrace_LRU32m(b *testing.B)     { benchmarkTrace(b, PolicyLRU, 32<<20) }
+func BenchmarkTrace_LFU32m(b *testing.B)     { benchmarkTrace(b, PolicyLFU, 32<<20) }
+func BenchmarkTrace_ARC32m(b *testing.B)     { benchmarkTrace(b, PolicyARC, 32<<20) }
+func BenchmarkTrace_TinyLFU32m(b *testing.B) { benchmarkTrace(b, PolicyTinyLFU, 32<<20) }
+func BenchmarkTrace_LRU64m(b *testing.B)     { benchmarkTrace(b, PolicyLRU, 64<<20) }
+func BenchmarkTrace_LFU64m(b *testing.B)     { benchmarkTrace(b, PolicyLFU, 64<<20) }
+func BenchmarkTrace_ARC64m(b *testing.B)     { benchmarkTrace(b, PolicyARC, 64<<20) }
+func BenchmarkTrace_TinyLFU64m(b *testing.B) { benchmarkTrace(b, PolicyTinyLFU, 64<<20) }
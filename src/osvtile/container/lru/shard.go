@@ -0,0 +1,292 @@
+package lru
+
+import (
+    "sync"
+    "sync/atomic"
+)
+
+// shard is a set of entries with its own lock, byte limit and eviction policy. Keys are spread across the shards of
+// the cache so concurrent requests for different keys rarely contend on the same lock. A pinned shard never evicts, it
+// rejects new entries once full. Entries with identical values share a single buffer across the cache, and each
+// buffer is counted once in the size of one shard.
+type shard struct {
+    // bytes of buffers still in use whose holder has left the shard, updated atomically by the payload store. This is
+    // first so it is 64-bit aligned for the atomic operations.
+    retained int64
+    mu       *sync.Mutex
+    dict     map[string]*node
+    policy   evictor
+    payloads *payloads
+    // bytes charged to the nodes of the shard
+    size int64
+    // size of the values before deduplication
+    logical int64
+    maxsize int64
+    pinned  bool
+    stats   Stats
+    // usage by namespace, only tracked when the cache has a namespace func
+    usage map[string]*Usage
+}
+
+// account adds (or with a negative sign removes) the node from the shard size and namespace usage. Namespace usage
+// counts the size of the values before deduplication.
+func (s *shard) account(n *node, sign int) {
+    if sign > 0 {
+        s.payloads.acquire(s, n)
+    } else {
+        s.payloads.release(s, n)
+    }
+
+    s.size += int64(sign) * n.cost
+
+    s.logical += int64(sign) * n.size()
+
+    if n.ns == "" {
+        return
+    }
+
+    u, ok := s.usage[n.ns]
+
+    if !ok {
+        u = &Usage{}
+        s.usage[n.ns] = u
+    }
+
+    u.Elements += sign
+    u.Size += int64(sign) * n.size()
+
+    if u.Elements == 0 {
+        delete(s.usage, n.ns)
+    }
+}
+
+// removal is a node removed from a shard, reported to the eviction callback once the shard lock is released
+type removal struct {
+    node   *node
+    reason RemovalReason
+}
+
+// set adds or replaces the node, evicting the nodes chosen by the policy to bring the shard back under its limit. The
+// replaced and evicted nodes are returned so the caller can report them once the lock is released. Nodes larger than
+// the whole shard, or which do not fit in a pinned shard, are rejected and not stored.
+func (s *shard) set(n *node) []removal {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    var removed []removal
+
+    // drop any previous value, a replaced value is treated as a new entry by the policy
+    if old, ok := s.dict[n.key]; ok {
+        s.remove(old)
+        removed = append(removed, removal{old, RemovedReplaced})
+    }
+
+    fits := n.size() <= s.maxsize
+
+    if fits && s.pinned {
+        fits = s.used()+s.payloads.cost(s, n) <= s.maxsize
+    }
+
+    if !fits {
+        s.stats.Rejections++
+        return removed
+    }
+
+    // the node is charged before the policy sees it, so both count the same bytes
+    s.dict[n.key] = n
+    s.account(n, 1)
+    s.policy.add(n)
+
+    for s.used() > s.maxsize {
+        old := s.policy.evict()
+
+        if old == nil {
+            break
+        }
+
+        delete(s.dict, old.key)
+        s.account(old, -1)
+
+        s.stats.Evictions++
+        s.stats.EvictedBytes += old.size()
+        removed = append(removed, removal{old, RemovedEvicted})
+    }
+
+    return removed
+}
+
+// get returns the node for the key, recording the access with the policy. An expired node is removed, and returned
+// as the second value, and reported as a miss.
+func (s *shard) get(key string, now int64) (*node, *node) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    n, ok := s.dict[key]
+
+    if ok && n.expired(now) {
+        s.remove(n)
+        s.stats.Expired++
+        s.stats.Misses++
+        return nil, n
+    }
+
+    if !ok {
+        s.stats.Misses++
+        return nil, nil
+    }
+
+    s.policy.hit(n)
+    s.stats.Hits++
+
+    return n, nil
+}
+
+func (s *shard) exists(key string, now int64) bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    n, ok := s.dict[key]
+
+    return ok && !n.expired(now)
+}
+
+// delete removes the node for the key, returning the node removed (if any)
+func (s *shard) delete(key string) *node {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    n, ok := s.dict[key]
+
+    if ok {
+        s.remove(n)
+    }
+
+    return n
+}
+
+// remove drops the node from the shard, the caller must hold the lock
+func (s *shard) remove(n *node) {
+    delete(s.dict, n.key)
+    s.policy.remove(n)
+    s.account(n, -1)
+}
+
+// nodes lists the unexpired nodes of the shard in the order they would be evicted
+func (s *shard) nodes(now int64) []*node {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    nodes := make([]*node, 0, len(s.dict))
+    s.policy.walk(func(n *node) {
+        if !n.expired(now) {
+            nodes = append(nodes, n)
+        }
+    })
+
+    return nodes
+}
+
+// sweep removes the expired nodes, returning the nodes removed
+func (s *shard) sweep(now int64) []*node {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    var expired []*node
+
+    for _, n := range s.dict {
+        if n.expired(now) {
+            s.remove(n)
+            expired = append(expired, n)
+        }
+    }
+
+    s.stats.Expired += int64(len(expired))
+
+    return expired
+}
+
+// purge removes every entry with a key selected by the match func, returning the nodes removed and the bytes freed
+func (s *shard) purge(match func(key string) bool) ([]*node, int64) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    var purged []*node
+    before := s.used()
+
+    for key, n := range s.dict {
+        if !match(key) {
+            continue
+        }
+
+        purged = append(purged, n)
+        s.remove(n)
+    }
+
+    return purged, before - s.used()
+}
+
+// clear removes every entry, returning the nodes removed
+func (s *shard) clear() []*node {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    cleared := make([]*node, 0, len(s.dict))
+
+    // the shared buffers are released one by one, as other shards may still use them
+    for _, n := range s.dict {
+        s.payloads.release(s, n)
+        cleared = append(cleared, n)
+    }
+
+    s.dict = map[string]*node{}
+    s.policy.clear()
+    s.size = 0
+    s.logical = 0
+    s.usage = map[string]*Usage{}
+
+    return cleared
+}
+
+// status adds the elements, byte size, statistics and namespace usage of the shard to the cache status
+func (s *shard) status(status *Status) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    status.Elements += len(s.dict)
+    status.Size += s.used()
+    status.LogicalSize += s.logical
+    status.Stats.add(s.stats)
+
+    for ns, u := range s.usage {
+        if status.Namespaces == nil {
+            status.Namespaces = map[string]*Usage{}
+        }
+
+        total, ok := status.Namespaces[ns]
+
+        if !ok {
+            total = &Usage{}
+            status.Namespaces[ns] = total
+        }
+
+        total.Elements += u.Elements
+        total.Size += u.Size
+    }
+}
+
+// used is the bytes counted against the limit of the shard, those charged to its nodes and those it retains
+func (s *shard) used() int64 {
+    return s.size + atomic.LoadInt64(&s.retained)
+}
+
+func newShard(maxsize int64, pinned bool, policy Policy, payloads *payloads) *shard {
+    return &shard{
+        mu:       &sync.Mutex{},
+        dict:     map[string]*node{},
+        policy:   newEvictor(policy, maxsize),
+        payloads: payloads,
+        maxsize:  maxsize,
+        pinned:   pinned,
+        usage:    map[string]*Usage{},
+    }
+}
@@ -0,0 +1,280 @@
+package lru
+
+import (
+    "container/list"
+    "hash/fnv"
+)
+
+// W-TinyLFU segments
+const (
+    tinyWindow uint8 = iota
+    tinyProbation
+    tinyProtected
+)
+
+const (
+    // windowPercent of the shard is given to the LRU window that new entries enter through
+    windowPercent = 1
+    // protectedPercent of the main cache holds the entries hit since they entered it
+    protectedPercent = 80
+    // averageEntrySize is used to size the frequency sketch from the byte size of the shard
+    averageEntrySize = 4096
+)
+
+// tinyLFU is W-TinyLFU (Einziger, Friedman and Manes). New entries enter a small LRU window. Once the window is full
+// its least recently used entry competes with the least recently used entry of the main cache, and whichever has been
+// requested less often (by a compact frequency sketch) is evicted. The main cache is a segmented LRU: probation for
+// entries not hit since they arrived, protected for the rest. A burst of one-off requests, such as a single user
+// zooming out across the country, only churns the window rather than flushing the hot set.
+type tinyLFU struct {
+    window    *list.List
+    probation *list.List
+    protected *list.List
+    // bytes charged for the entries of each segment, as counted by the shard
+    windowSize    int64
+    probationSize int64
+    protectedSize int64
+    windowMax     int64
+    protectedMax  int64
+    maxsize       int64
+    sketch        *sketch
+}
+
+func (t *tinyLFU) add(n *node) {
+    t.sketch.increment(n.key)
+    t.push(n, tinyWindow)
+
+    // until the cache is full, overflow from the window goes straight into the main cache
+    for t.windowSize > t.windowMax && t.window.Len() > 1 && t.size() <= t.maxsize {
+        t.move(t.window.Back().Value.(*node), tinyProbation)
+    }
+}
+
+func (t *tinyLFU) hit(n *node) {
+    t.sketch.increment(n.key)
+
+    switch n.seg {
+    case tinyWindow:
+        t.window.MoveToFront(n.elem)
+    case tinyProbation:
+        t.move(n, tinyProtected)
+
+        for t.protectedSize > t.protectedMax && t.protected.Len() > 1 {
+            t.move(t.protected.Back().Value.(*node), tinyProbation)
+        }
+    case tinyProtected:
+        t.protected.MoveToFront(n.elem)
+    }
+}
+
+func (t *tinyLFU) remove(n *node) {
+    t.pull(n)
+}
+
+func (t *tinyLFU) evict() *node {
+    victim := t.mainVictim()
+
+    if t.windowSize > t.windowMax && t.window.Len() > 0 {
+        candidate := t.window.Back().Value.(*node)
+
+        if victim == nil || t.sketch.estimate(candidate.key) <= t.sketch.estimate(victim.key) {
+            t.pull(candidate)
+            return candidate
+        }
+
+        // the candidate is admitted to the main cache in place of the victim
+        t.move(candidate, tinyProbation)
+    }
+
+    if victim == nil {
+        if elm := t.window.Back(); elm != nil {
+            victim = elm.Value.(*node)
+        } else {
+            return nil
+        }
+    }
+
+    t.pull(victim)
+
+    return victim
+}
+
+func (t *tinyLFU) walk(fn func(n *node)) {
+    for _, l := range []*list.List{t.window, t.probation, t.protected} {
+        for elm := l.Back(); elm != nil; elm = elm.Prev() {
+            fn(elm.Value.(*node))
+        }
+    }
+}
+
+func (t *tinyLFU) len() int {
+    return t.window.Len() + t.probation.Len() + t.protected.Len()
+}
+
+func (t *tinyLFU) clear() {
+    t.window.Init()
+    t.probation.Init()
+    t.protected.Init()
+    t.windowSize, t.probationSize, t.protectedSize = 0, 0, 0
+    t.sketch.clear()
+}
+
+// mainVictim is the least recently used entry of the main cache, from probation if it has any
+func (t *tinyLFU) mainVictim() *node {
+    if elm := t.probation.Back(); elm != nil {
+        return elm.Value.(*node)
+    }
+
+    if elm := t.protected.Back(); elm != nil {
+        return elm.Value.(*node)
+    }
+
+    return nil
+}
+
+func (t *tinyLFU) size() int64 {
+    return t.windowSize + t.probationSize + t.protectedSize
+}
+
+// push adds the node to the front of the segment
+func (t *tinyLFU) push(n *node, seg uint8) {
+    n.seg = seg
+    size := n.cost
+
+    switch seg {
+    case tinyWindow:
+        n.elem = t.window.PushFront(n)
+        t.windowSize += size
+    case tinyProbation:
+        n.elem = t.probation.PushFront(n)
+        t.probationSize += size
+    case tinyProtected:
+        n.elem = t.protected.PushFront(n)
+        t.protectedSize += size
+    }
+}
+
+// pull removes the node from its segment
+func (t *tinyLFU) pull(n *node) {
+    size := n.cost
+
+    switch n.seg {
+    case tinyWindow:
+        t.window.Remove(n.elem)
+        t.windowSize -= size
+    case tinyProbation:
+        t.probation.Remove(n.elem)
+        t.probationSize -= size
+    case tinyProtected:
+        t.protected.Remove(n.elem)
+        t.protectedSize -= size
+    }
+}
+
+func (t *tinyLFU) move(n *node, seg uint8) {
+    t.pull(n)
+    t.push(n, seg)
+}
+
+func newTinyLFU(maxsize int64) *tinyLFU {
+    windowMax := maxsize * windowPercent / 100
+
+    return &tinyLFU{
+        window:       list.New(),
+        probation:    list.New(),
+        protected:    list.New(),
+        windowMax:    windowMax,
+        protectedMax: (maxsize - windowMax) * protectedPercent / 100,
+        maxsize:      maxsize,
+        sketch:       newSketch(int(maxsize / averageEntrySize)),
+    }
+}
+
+// sketch is a count-min sketch of 4 rows of saturating 4 bit counters (held in bytes for simplicity). All counters are
+// halved once the number of increments reaches 10 times the width, so old popularity fades.
+type sketch struct {
+    rows      [4][]uint8
+    mask      uint64
+    additions int
+    resetAt   int
+}
+
+func (s *sketch) increment(key string) {
+    h := hash(key)
+
+    for i := range s.rows {
+        idx := s.index(h, i)
+
+        if s.rows[i][idx] < 15 {
+            s.rows[i][idx]++
+        }
+    }
+
+    s.additions++
+
+    if s.additions >= s.resetAt {
+        s.reset()
+    }
+}
+
+func (s *sketch) estimate(key string) uint8 {
+    h := hash(key)
+    est := uint8(15)
+
+    for i := range s.rows {
+        if v := s.rows[i][s.index(h, i)]; v < est {
+            est = v
+        }
+    }
+
+    return est
+}
+
+// index derives the counter of each row from the two halves of the hash
+func (s *sketch) index(h uint64, row int) uint64 {
+    return (h + uint64(row)*(h>>32|1)) & s.mask
+}
+
+func (s *sketch) reset() {
+    for i := range s.rows {
+        for j := range s.rows[i] {
+            s.rows[i][j] /= 2
+        }
+    }
+
+    s.additions /= 2
+}
+
+func (s *sketch) clear() {
+    for i := range s.rows {
+        for j := range s.rows[i] {
+            s.rows[i][j] = 0
+        }
+    }
+
+    s.additions = 0
+}
+
+// newSketch creates a sketch wide enough for the expected number of entries, as a power of 2 between 2^8 and 2^20
+func newSketch(entries int) *sketch {
+    width := 256
+
+    for width < entries && width < 1<<20 {
+        width *= 2
+    }
+
+    s := &sketch{mask: uint64(width - 1), resetAt: 10 * width}
+
+    for i := range s.rows {
+        s.rows[i] = make([]uint8, width)
+    }
+
+    return s
+}
+
+func hash(key string) uint64 {
+    h := fnv.New64a()
+    _, _ = h.Write([]byte(key))
+
+    return h.Sum64()
+}
@@ -1,12 +1,12 @@
 package mbtiles
 
 import (
+    "context"
     "database/sql"
     "fmt"
-    _ "github.com/mattn/go-sqlite3"
-    "log"
+    "github.com/mattn/go-sqlite3"
+    "osdata/osvtile/trace"
     "strconv"
-    "strings"
 )
 
 // Position represents a lon/lat/zoom
@@ -43,16 +43,26 @@ func (b BBox) Top() float64 {
     return b[3]
 }
 
-// Version specifies the MBTiles information (as specified in the spec)
+// Version specifies the MBTiles information (as specified in the spec). Any metadata keys not covered by the spec
+// are held in `Meta`.
 type Version struct {
-    Name    string
-    Format  string
-    Bounds  BBox
-    Center  Position
-    Maxzoom int
-    Minzoom int
-    JSON    string
-    Meta    map[string]string
+    Name         string
+    Format       string
+    Bounds       BBox
+    Center       Position
+    Maxzoom      int
+    Minzoom      int
+    Attribution  string
+    Description  string
+    Type         string
+    Scheme       Scheme
+    VectorLayers []VectorLayer
+    Tilestats    *Tilestats
+    Meta         map[string]string
+    // JSON is the raw `json` metadata value.
+    //
+    // Deprecated: use the parsed VectorLayers and Tilestats.
+    JSON string
 }
 
 func (v *Version) String() string {
@@ -62,24 +72,35 @@ func (v *Version) String() string {
 // MBTiles holds the datasource for tile information
 type MBTiles struct {
     // the underlying mbtiles package
-    db sql.DB
+    db *sql.DB
+    // the tile query, prepared once on each connection of the pool
+    tile *sql.Stmt
+    // the context the source was opened with, only used to tag its logs with the caller's trace
+    ctx context.Context
 }
 
-// FetchTile will query the package to return a given tile at the specified location and zoom. If no tile is found
-// this func will return a `nil,nil`
+// FetchTile will query the package to return a given tile at the specified location and zoom. The row `y` is in the
+// scheme of the package (TMS unless the metadata says otherwise). If no tile is found this func will return a `nil,nil`
 func (m *MBTiles) FetchTile(x, y, z int) ([]byte, error) {
+    return m.FetchTileContext(context.Background(), x, y, z)
+}
+
+// FetchTileContext is `FetchTile`, interrupting the query once the context is done and returning the context error
+func (m *MBTiles) FetchTileContext(ctx context.Context, x, y, z int) ([]byte, error) {
     var tile []byte
 
-    err := m.db.QueryRow(
-        "select tile_data from tiles where zoom_level = ? and tile_column = ? and tile_row = ?",
-        z, x, y,
-    ).Scan(&tile)
+    err := m.tile.QueryRowContext(ctx, z, x, y).Scan(&tile)
 
     if err != nil {
         if err == sql.ErrNoRows {
             return nil, nil
         }
 
+        // the driver reports an interrupted query in its own terms
+        if ctx.Err() != nil {
+            return nil, ctx.Err()
+        }
+
         return nil, err
     }
 
@@ -88,8 +109,18 @@ func (m *MBTiles) FetchTile(x, y, z int) ([]byte, error) {
 
 // Version will report the underlying MBTiles version information
 func (m *MBTiles) Version() (*Version, error) {
-    rows, err := m.db.Query("select * from metadata")
+    return m.VersionContext(context.Background())
+}
+
+// VersionContext is `Version`, interrupting the query once the context is done and returning the context error. Any
+// malformed value, such as a center or bounds that is not a valid WGS84 position or box, is an error.
+func (m *MBTiles) VersionContext(ctx context.Context) (*Version, error) {
+    rows, err := m.db.QueryContext(ctx, "select * from metadata")
     if err != nil {
+        if ctx.Err() != nil {
+            return nil, ctx.Err()
+        }
+
         return nil, err
     }
 
@@ -97,7 +128,7 @@ func (m *MBTiles) Version() (*Version, error) {
         err := rows.Close()
 
         if err != nil {
-            log.Printf("error closing db rows: error = %s", err)
+            trace.Printf(ctx, "error closing db rows: error = %s", err)
         }
     }()
 
@@ -105,6 +136,8 @@ func (m *MBTiles) Version() (*Version, error) {
         Meta: map[string]string{},
     }
 
+    var hasMinzoom, hasMaxzoom bool
+
     for rows.Next() {
         var key string
         var value string
@@ -122,12 +155,20 @@ func (m *MBTiles) Version() (*Version, error) {
             if v.Maxzoom, err = strconv.Atoi(value); err != nil {
                 return nil, fmt.Errorf("failed to parse maxzoom: error = %s", err)
             }
+
+            hasMaxzoom = true
         case "minzoom":
             if v.Minzoom, err = strconv.Atoi(value); err != nil {
                 return nil, fmt.Errorf("failed to parse minzoom: error = %s", err)
             }
+
+            hasMinzoom = true
         case "json":
             v.JSON = value
+
+            if err := parseJSON(value, v); err != nil {
+                return nil, err
+            }
         case "center":
             p, err := parsePosition(value)
 
@@ -136,6 +177,24 @@ func (m *MBTiles) Version() (*Version, error) {
             }
 
             v.Center = *p
+        case "bounds":
+            b, err := parseBBox(value)
+
+            if err != nil {
+                return nil, err
+            }
+
+            v.Bounds = *b
+        case "attribution":
+            v.Attribution = value
+        case "description":
+            v.Description = value
+        case "type":
+            v.Type = value
+        case "scheme":
+            if v.Scheme, err = ParseScheme(value); err != nil {
+                return nil, err
+            }
         default:
             v.Meta[key] = value
         }
@@ -143,6 +202,14 @@ func (m *MBTiles) Version() (*Version, error) {
 
     err = rows.Err()
     if err != nil {
+        if ctx.Err() != nil {
+            return nil, ctx.Err()
+        }
+
+        return nil, err
+    }
+
+    if err = v.validate(hasMinzoom, hasMaxzoom); err != nil {
         return nil, err
     }
 
@@ -151,41 +218,44 @@ func (m *MBTiles) Version() (*Version, error) {
 
 // Close will shutdown the MBTiles tile source
 func (m *MBTiles) Close() error {
-    return m.db.Close()
-}
-
-// NewMVT will construct a new tile source dataset
-func NewMVT(path string) (*MBTiles, error) {
-    db, err := sql.Open("sqlite3", fmt.Sprintf("%s?mode=ro&_query_only=true&_mutex=no", path))
-    if err != nil {
-        return nil, err
+    if err := m.tile.Close(); err != nil {
+        trace.Printf(m.ctx, "error closing tile statement: error = %s", err)
     }
 
-    if err = db.Ping(); err != nil {
-        return nil, err
-    }
+    return m.db.Close()
+}
 
-    log.Printf("created new MBTiles tile source: path = %s", path)
-    return &MBTiles{
-        db: *db,
-    }, nil
+// NewMVT will construct a new tile source dataset, reading the package through a pool of read-only connections
+func NewMVT(path string, opts ...Option) (*MBTiles, error) {
+    return NewMVTContext(context.Background(), path, opts...)
 }
 
-// parses a value such as `-0.173,51.3859,10` to a position type
-func parsePosition(value string) (*Position, error) {
-    parts := strings.Split(value, ",")
+// NewMVTContext is `NewMVT`, opening the package under the given context. Its trace tags the logs of the source.
+func NewMVTContext(ctx context.Context, path string, opts ...Option) (*MBTiles, error) {
+    o := newOptions(opts)
 
-    p := Position{}
+    // all connections are kept open, so the statements are only prepared once per connection
+    db := sql.OpenDB(&connector{dsn: o.dsn(path), pragmas: o.pragmas(), driver: &sqlite3.SQLiteDriver{}})
+    db.SetMaxOpenConns(o.conns)
+    db.SetMaxIdleConns(o.conns)
 
-    for i, part := range parts {
-        f, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+    if err := db.PingContext(ctx); err != nil {
+        _ = db.Close()
+        return nil, err
+    }
 
-        if err != nil {
-            return nil, err
-        }
+    tile, err := db.PrepareContext(ctx, "select tile_data from tiles where zoom_level = ? and tile_column = ? and tile_row = ?")
 
-        p[i] = f
+    if err != nil {
+        _ = db.Close()
+        return nil, err
     }
 
-    return &p, nil
+    trace.Printf(ctx, "created new MBTiles tile source: path = %s, conns = %d, immutable = %t, mmap = %d, page cache = %d",
+        path, o.conns, !o.mutable, o.mmapSize, o.pageCache)
+    return &MBTiles{
+        db:   db,
+        tile: tile,
+        ctx:  ctx,
+    }, nil
 }
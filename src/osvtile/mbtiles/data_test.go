@@ -0,0 +1,299 @@
+package mbtiles
+
+import (
+    "context"
+    "database/sql"
+    "fmt"
+    "github.com/stretchr/testify/require"
+    "io/ioutil"
+    "log"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+// createPackage writes an MBTiles package with a tile (holding its own location) for every x == y up to the
+// maxzoom, returning its path
+func createPackage(t testing.TB, dir string, maxzoom int) string {
+    path := filepath.Join(dir, "test.mbtiles")
+    db, err := sql.Open("sqlite3", path)
+    require.NoError(t, err)
+    defer db.Close()
+
+    _, err = db.Exec(`
+        create table metadata (name text, value text);
+        create table tiles (zoom_level integer, tile_column integer, tile_row integer, tile_data blob);
+        create unique index tile_index on tiles (zoom_level, tile_column, tile_row);
+    `)
+    require.NoError(t, err)
+
+    for k, v := range map[string]string{"name": "test", "format": "pbf", "minzoom": "0", "maxzoom": fmt.Sprint(maxzoom)} {
+        _, err = db.Exec("insert into metadata (name, value) values (?, ?)", k, v)
+        require.NoError(t, err)
+    }
+
+    tx, err := db.Begin()
+    require.NoError(t, err)
+
+    for z := 0; z <= maxzoom; z++ {
+        for i := 0; i < 1<<uint(z); i++ {
+            _, err = tx.Exec(
+                "insert into tiles (zoom_level, tile_column, tile_row, tile_data) values (?, ?, ?, ?)",
+                z, i, i, []byte(fmt.Sprintf("%d/%d/%d", z, i, i)),
+            )
+            require.NoError(t, err)
+        }
+    }
+
+    require.NoError(t, tx.Commit())
+
+    return path
+}
+
+func TestMBTiles_FetchTileContext(t *testing.T) {
+    dir, err := ioutil.TempDir("", "mbtiles-test")
+    require.NoError(t, err)
+    defer os.RemoveAll(dir)
+
+    m, err := NewMVT(createPackage(t, dir, 3))
+    require.NoError(t, err)
+    defer m.Close()
+
+    v, err := m.VersionContext(context.Background())
+    require.NoError(t, err)
+    require.Equal(t, "test", v.Name)
+    require.Equal(t, 3, v.Maxzoom)
+
+    tile, err := m.FetchTileContext(context.Background(), 5, 5, 3)
+    require.NoError(t, err)
+    require.Equal(t, []byte("3/5/5"), tile)
+
+    tile, err = m.FetchTileContext(context.Background(), 5, 4, 3)
+    require.NoError(t, err)
+    require.Nil(t, tile)
+
+    // a done context stops the query, reporting the context error
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+
+    _, err = m.FetchTileContext(ctx, 5, 5, 3)
+    require.Equal(t, context.Canceled, err)
+
+    _, err = m.VersionContext(ctx)
+    require.Equal(t, context.Canceled, err)
+}
+
+func TestMBTiles_Version(t *testing.T) {
+    dir, err := ioutil.TempDir("", "mbtiles-test")
+    require.NoError(t, err)
+    defer os.RemoveAll(dir)
+
+    path := createPackage(t, dir, 1)
+
+    db, err := sql.Open("sqlite3", path)
+    require.NoError(t, err)
+    defer db.Close()
+
+    _, err = db.Exec(`insert into metadata (name, value) values
+        ('center', '-1.4,50.9,7'), ('bounds', '-9,49.8,2,61'), ('json', '{"vector_layers": [{"id": "roads"}]}')`)
+    require.NoError(t, err)
+
+    m, err := NewMVT(path, WithMutable(true))
+    require.NoError(t, err)
+    defer m.Close()
+
+    v, err := m.Version()
+    require.NoError(t, err)
+    require.Equal(t, Position{-1.4, 50.9, 7}, v.Center)
+    require.Equal(t, BBox{-9, 49.8, 2, 61}, v.Bounds)
+    require.Equal(t, "roads", v.VectorLayers[0].ID)
+    require.Equal(t, `{"vector_layers": [{"id": "roads"}]}`, v.JSON)
+
+    // a minzoom without a maxzoom still loads
+    _, err = db.Exec(`delete from metadata where name = 'maxzoom'; update metadata set value = '3' where name = 'minzoom'`)
+    require.NoError(t, err)
+
+    v, err = m.Version()
+    require.NoError(t, err)
+    require.Equal(t, 3, v.Minzoom)
+
+    // malformed values are errors
+    _, err = db.Exec(`update metadata set value = '-1.4,50.9' where name = 'center'`)
+    require.NoError(t, err)
+
+    _, err = m.Version()
+    require.Error(t, err)
+
+    _, err = db.Exec(`update metadata set value = '-1.4,50.9,7' where name = 'center'; update metadata set value = '2,61,-9,49.8' where name = 'bounds'`)
+    require.NoError(t, err)
+
+    _, err = m.Version()
+    require.Error(t, err)
+}
+
+func TestNewMVT_Options(t *testing.T) {
+    dir, err := ioutil.TempDir("", "mbtiles-test")
+    require.NoError(t, err)
+    defer os.RemoveAll(dir)
+
+    path := createPackage(t, dir, 2)
+
+    m, err := NewMVT(path, WithConns(2), WithMmapSize(1<<20), WithPageCache(4<<20))
+    require.NoError(t, err)
+    defer m.Close()
+
+    require.Equal(t, 2, m.db.Stats().MaxOpenConnections)
+
+    var mmap, cache int64
+    require.NoError(t, m.db.QueryRow("pragma mmap_size").Scan(&mmap))
+    require.NoError(t, m.db.QueryRow("pragma cache_size").Scan(&cache))
+    require.Equal(t, int64(1<<20), mmap)
+    require.Equal(t, int64(-4096), cache)
+
+    // the package is opened read-only
+    _, err = m.db.Exec("delete from tiles")
+    require.Error(t, err)
+
+    // a missing package is an error, rather than an empty database being created
+    _, err = NewMVT(filepath.Join(dir, "missing.mbtiles"))
+    require.Error(t, err)
+
+    _, err = os.Stat(filepath.Join(dir, "missing.mbtiles"))
+    require.True(t, os.IsNotExist(err))
+}
+
+// benchPackage returns the package to benchmark against: the file named by `OSVTILE_MBTILES` (e.g. a Zoomstack
+// download) if set, otherwise a generated package. Results from the generated package only compare the read modes,
+// they say little about the throughput of a real package.
+func benchPackage(b *testing.B) (string, func()) {
+    if path := os.Getenv("OSVTILE_MBTILES"); path != "" {
+        return path, func() {}
+    }
+
+    log.Printf("OSVTILE_MBTILES is not set, benchmarking a generated package rather than a real one")
+
+    dir, err := ioutil.TempDir("", "mbtiles-bench")
+    require.NoError(b, err)
+
+    return createPackage(b, dir, 14), func() { _ = os.RemoveAll(dir) }
+}
+
+// benchTiles samples the locations of tiles in the package, so every fetch finds a tile
+func benchTiles(b *testing.B, path string) [][3]int {
+    db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+    require.NoError(b, err)
+    defer db.Close()
+
+    rows, err := db.Query("select zoom_level, tile_column, tile_row from tiles order by random() limit 10000")
+    require.NoError(b, err)
+    defer rows.Close()
+
+    var tiles [][3]int
+
+    for rows.Next() {
+        var t [3]int
+        require.NoError(b, rows.Scan(&t[0], &t[1], &t[2]))
+        tiles = append(tiles, t)
+    }
+
+    require.NoError(b, rows.Err())
+    require.NotEmpty(b, tiles)
+
+    return tiles
+}
+
+// legacy reads tiles as `NewMVT` used to: a single unsized pool, re-parsing the query on each fetch
+type legacy struct {
+    db *sql.DB
+}
+
+func (l *legacy) FetchTileContext(ctx context.Context, x, y, z int) ([]byte, error) {
+    var tile []byte
+
+    err := l.db.QueryRowContext(
+        ctx, "select tile_data from tiles where zoom_level = ? and tile_column = ? and tile_row = ?", z, x, y,
+    ).Scan(&tile)
+
+    if err == sql.ErrNoRows {
+        return nil, nil
+    }
+
+    return tile, err
+}
+
+// BenchmarkMBTiles_FetchTile reports the tiles per second read from the package by parallel clients. Throughput
+// figures should come from a real package, run with e.g.
+//
+//    OSVTILE_MBTILES=/data/OS_Open_Zoomstack.mbtiles go test -run x -bench FetchTile -cpu 1,4,8 ./osvtile/mbtiles
+func BenchmarkMBTiles_FetchTile(b *testing.B) {
+    path, cleanup := benchPackage(b)
+    defer cleanup()
+
+    tiles := benchTiles(b, path)
+
+    // keep the results readable, each source logs as it is opened
+    log.SetOutput(ioutil.Discard)
+    defer log.SetOutput(os.Stderr)
+
+    type fetcher interface {
+        FetchTileContext(ctx context.Context, x, y, z int) ([]byte, error)
+    }
+
+    run := func(b *testing.B, f fetcher) {
+        ctx := context.Background()
+        start := time.Now()
+
+        b.ResetTimer()
+        b.RunParallel(func(pb *testing.PB) {
+            i := 0
+
+            for pb.Next() {
+                t := tiles[i%len(tiles)]
+                i++
+
+                if tile, err := f.FetchTileContext(ctx, t[1], t[2], t[0]); err != nil || tile == nil {
+                    b.Errorf("failed to fetch tile: tile = %v, error = %v", t, err)
+                    return
+                }
+            }
+        })
+        b.StopTimer()
+
+        b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "tiles/s")
+    }
+
+    b.Run("legacy", func(b *testing.B) {
+        db, err := sql.Open("sqlite3", path+"?mode=ro&_query_only=true&_mutex=no")
+        require.NoError(b, err)
+        defer db.Close()
+
+        run(b, &legacy{db: db})
+    })
+
+    for _, c := range []struct {
+        name string
+        opts []Option
+    }{
+        {"prepared", nil},
+        {"prepared-mmap", []Option{WithMmapSize(1 << 30)}},
+        {"prepared-pagecache", []Option{WithPageCache(64 << 20)}},
+        {"prepared-mutable", []Option{WithMutable(true)}},
+    } {
+        b.Run(c.name, func(b *testing.B) {
+            m, err := NewMVT(path, c.opts...)
+            require.NoError(b, err)
+            defer m.Close()
+
+            run(b, m)
+        })
+    }
+
+    b.Run("preload", func(b *testing.B) {
+        m, err := Preload(path, 0)
+        require.NoError(b, err)
+        defer m.Close()
+
+        run(b, m)
+    })
+}
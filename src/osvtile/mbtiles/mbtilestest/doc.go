@@ -0,0 +1,2 @@
+// Package mbtilestest provides a fake tile source for the tests of packages serving tiles
+package mbtilestest
@@ -0,0 +1,99 @@
+package mbtilestest
+
+import (
+    "context"
+    "osdata/osvtile/mbtiles"
+    "sync"
+)
+
+// TileFunc produces the tile at the location, or `nil,nil` if there is no such tile
+type TileFunc func(ctx context.Context, x, y, z int) ([]byte, error)
+
+// Source is a fake tile source reporting the given metadata, with each tile produced by the tile func. A source
+// without a tile func holds no tiles. The fetches and closing of the source are recorded for the tests to check.
+type Source struct {
+    Meta *mbtiles.Version
+    Tile TileFunc
+
+    mu      sync.Mutex
+    fetches int
+    closed  bool
+}
+
+// NewSource creates a source of the given format, holding a tile for every x == y with all other tiles missing
+func NewSource(format string) *Source {
+    return &Source{
+        Meta: &mbtiles.Version{Name: "fake", Format: format, Minzoom: 0, Maxzoom: 2},
+        Tile: Diagonal,
+    }
+}
+
+// Diagonal holds the tile `tile` for every x == y, all other tiles are missing
+func Diagonal(ctx context.Context, x, y, z int) ([]byte, error) {
+    if x != y {
+        return nil, nil
+    }
+
+    return []byte("tile"), nil
+}
+
+// Blocking holds every tile, but each fetch blocks until its context is done
+func Blocking(ctx context.Context, x, y, z int) ([]byte, error) {
+    <-ctx.Done()
+    return nil, ctx.Err()
+}
+
+func (s *Source) FetchTile(x, y, z int) ([]byte, error) {
+    return s.FetchTileContext(context.Background(), x, y, z)
+}
+
+func (s *Source) FetchTileContext(ctx context.Context, x, y, z int) ([]byte, error) {
+    s.mu.Lock()
+    s.fetches++
+    s.mu.Unlock()
+
+    if s.Tile == nil {
+        return nil, nil
+    }
+
+    return s.Tile(ctx, x, y, z)
+}
+
+func (s *Source) Version() (*mbtiles.Version, error) {
+    return s.VersionContext(context.Background())
+}
+
+func (s *Source) VersionContext(ctx context.Context) (*mbtiles.Version, error) {
+    if s.Meta == nil {
+        return &mbtiles.Version{}, nil
+    }
+
+    return s.Meta, nil
+}
+
+func (s *Source) Close() error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.closed = true
+    return nil
+}
+
+// Fetches reports the number of tiles fetched from the source
+func (s *Source) Fetches() int {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    return s.fetches
+}
+
+// Closed reports if the source has been closed
+func (s *Source) Closed() bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    return s.closed
+}
+
+// ensure Source satisfies the interface
+var _ mbtiles.TileSource = &Source{}
@@ -0,0 +1,236 @@
+package mbtiles
+
+import (
+    "context"
+    "crypto/md5"
+    "fmt"
+    "osdata/osvtile/trace"
+    "sort"
+    "time"
+)
+
+// the tile location is packed into a single key, with the zoom in the top bits, so the keys sort by zoom, column
+// then row. Each of the column and row have 29 bits, enough for every tile up to zoom 29.
+const (
+    keyBits = 29
+    maxKeyZ = keyBits
+)
+
+func tileKey(x, y, z int) (uint64, bool) {
+    if z < 0 || z > maxKeyZ || x < 0 || y < 0 || x >= 1<<uint(z) || y >= 1<<uint(z) {
+        return 0, false
+    }
+
+    return uint64(z)<<(2*keyBits) | uint64(x)<<keyBits | uint64(y), true
+}
+
+// MemoryStats reports the size of a preloaded package
+type MemoryStats struct {
+    // Tiles is the number of tile locations in the package
+    Tiles int `json:"tiles"`
+    // Payloads is the number of distinct tiles, after identical tiles have been merged
+    Payloads int `json:"payloads"`
+    // Bytes is the memory held by the index and the tiles
+    Bytes int64 `json:"bytes"`
+    // LoadTime is how long the package took to read into memory
+    LoadTime time.Duration `json:"loadTime"`
+}
+
+// Memory is a tile source holding every tile of an MBTiles package in memory, so tiles are served without touching
+// the package. Each tile location is a sorted key pointing at a payload, with identical tiles (e.g. the empty sea
+// tiles that make up much of a package) stored only once.
+type Memory struct {
+    version *Version
+    // the sorted tile locations and the payload of each
+    keys []uint64
+    ids  []uint32
+    // payload i is data[offsets[i]:offsets[i+1]]
+    offsets []int64
+    data    []byte
+    stats   MemoryStats
+}
+
+// FetchTile returns the tile at the location, or `nil,nil` if there is no such tile. The row `y` is in the scheme of
+// the package. The returned tile is shared, so must not be modified.
+func (m *Memory) FetchTile(x, y, z int) ([]byte, error) {
+    return m.FetchTileContext(context.Background(), x, y, z)
+}
+
+// FetchTileContext is `FetchTile`, returning the context error if the context is already done
+func (m *Memory) FetchTileContext(ctx context.Context, x, y, z int) ([]byte, error) {
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+
+    key, ok := tileKey(x, y, z)
+
+    if !ok {
+        return nil, nil
+    }
+
+    i := sort.Search(len(m.keys), func(i int) bool { return m.keys[i] >= key })
+
+    if i == len(m.keys) || m.keys[i] != key {
+        return nil, nil
+    }
+
+    id := m.ids[i]
+    start, end := m.offsets[id], m.offsets[id+1]
+
+    return m.data[start:end:end], nil
+}
+
+// Version reports the metadata read from the package when it was loaded
+func (m *Memory) Version() (*Version, error) {
+    return m.version, nil
+}
+
+// VersionContext is `Version`, returning the context error if the context is already done
+func (m *Memory) VersionContext(ctx context.Context) (*Version, error) {
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+
+    return m.version, nil
+}
+
+// Stats reports the size of the package in memory and how long it took to load
+func (m *Memory) Stats() MemoryStats {
+    return m.stats
+}
+
+// Close is a no-op, the tiles are released once the source is no longer referenced. They are left in place so that
+// any fetch still in flight completes.
+func (m *Memory) Close() error {
+    return nil
+}
+
+// byKey sorts the keys along with their payloads
+type byKey struct {
+    keys []uint64
+    ids  []uint32
+}
+
+func (b byKey) Len() int           { return len(b.keys) }
+func (b byKey) Less(i, j int) bool { return b.keys[i] < b.keys[j] }
+func (b byKey) Swap(i, j int) {
+    b.keys[i], b.keys[j] = b.keys[j], b.keys[i]
+    b.ids[i], b.ids[j] = b.ids[j], b.ids[i]
+}
+
+// Preload reads every tile of the MBTiles package into memory. The package is refused once the tiles read exceed the
+// limit (zero for no limit), counting identical tiles once - so a package larger than the limit loads if its distinct
+// tiles fit. The options are used to read the package, which is closed once loaded.
+func Preload(path string, limit int64, opts ...Option) (*Memory, error) {
+    return PreloadContext(context.Background(), path, limit, opts...)
+}
+
+// PreloadContext is `Preload`, reading the package under the given context. Its trace tags the logs of the load.
+func PreloadContext(ctx context.Context, path string, limit int64, opts ...Option) (*Memory, error) {
+    start := time.Now()
+
+    source, err := NewMVTContext(ctx, path, opts...)
+
+    if err != nil {
+        return nil, err
+    }
+
+    defer func() {
+        if err := source.Close(); err != nil {
+            trace.Printf(ctx, "error closing preloaded package: path = %s, error = %s", path, err)
+        }
+    }()
+
+    m := &Memory{offsets: []int64{0}}
+
+    if m.version, err = source.VersionContext(ctx); err != nil {
+        return nil, err
+    }
+
+    // the buffer is sized once when every tile fits within the limit, otherwise it grows as distinct tiles are read
+    // so the limit is never allocated up front for a package that is then refused
+    var size int64
+
+    if err := source.db.QueryRowContext(ctx, "select coalesce(sum(length(tile_data)), 0) from tiles").Scan(&size); err != nil {
+        return nil, err
+    }
+
+    if limit == 0 || size <= limit {
+        m.data = make([]byte, 0, size)
+    }
+
+    rows, err := source.db.QueryContext(ctx, "select zoom_level, tile_column, tile_row, tile_data from tiles order by zoom_level, tile_column, tile_row")
+
+    if err != nil {
+        return nil, err
+    }
+
+    defer func() {
+        if err := rows.Close(); err != nil {
+            trace.Printf(ctx, "error closing db rows: error = %s", err)
+        }
+    }()
+
+    payloads := map[[md5.Size]byte]uint32{}
+
+    for rows.Next() {
+        var x, y, z int
+        var tile []byte
+
+        if err := rows.Scan(&z, &x, &y, &tile); err != nil {
+            return nil, err
+        }
+
+        key, ok := tileKey(x, y, z)
+
+        if !ok {
+            return nil, fmt.Errorf("tile out of range: z = %d, x = %d, y = %d", z, x, y)
+        }
+
+        sum := md5.Sum(tile)
+        id, ok := payloads[sum]
+
+        if !ok {
+            if limit > 0 && int64(len(m.data)+len(tile)) > limit {
+                return nil, fmt.Errorf("package exceeds the preload limit: path = %s, limit = %d", path, limit)
+            }
+
+            id = uint32(len(payloads))
+            payloads[sum] = id
+            m.data = append(m.data, tile...)
+            m.offsets = append(m.offsets, int64(len(m.data)))
+        }
+
+        m.keys = append(m.keys, key)
+        m.ids = append(m.ids, id)
+    }
+
+    if err := rows.Err(); err != nil {
+        return nil, err
+    }
+
+    // give back the space not taken up, identical tiles being stored once
+    if len(m.data) < cap(m.data)/2 {
+        m.data = append([]byte(nil), m.data...)
+    }
+
+    // the keys are usually already sorted by the package index
+    if sorter := (byKey{keys: m.keys, ids: m.ids}); !sort.IsSorted(sorter) {
+        sort.Sort(sorter)
+    }
+
+    m.stats = MemoryStats{
+        Tiles:    len(m.keys),
+        Payloads: len(payloads),
+        Bytes:    int64(cap(m.keys)*8 + cap(m.ids)*4 + cap(m.offsets)*8 + cap(m.data)),
+        LoadTime: time.Since(start),
+    }
+
+    trace.Printf(ctx, "preloaded MBTiles package: path = %s, tiles = %d, payloads = %d, bytes = %d, load time = %s",
+        path, m.stats.Tiles, m.stats.Payloads, m.stats.Bytes, m.stats.LoadTime)
+
+    return m, nil
+}
+
+// ensure Memory satisfies the interface
+var _ TileSource = &Memory{}
@@ -0,0 +1,154 @@
+package mbtiles
+
+import (
+    "bytes"
+    "context"
+    "database/sql"
+    "github.com/stretchr/testify/require"
+    "io/ioutil"
+    "log"
+    "os"
+    "osdata/osvtile/trace"
+    "testing"
+)
+
+func TestPreload(t *testing.T) {
+    dir, err := ioutil.TempDir("", "mbtiles-test")
+    require.NoError(t, err)
+    defer os.RemoveAll(dir)
+
+    path := createPackage(t, dir, 3)
+
+    // two sea tiles sharing a payload
+    db, err := sql.Open("sqlite3", path)
+    require.NoError(t, err)
+    _, err = db.Exec("insert into tiles values (3, 0, 7, 'sea'), (3, 7, 0, 'sea')")
+    require.NoError(t, err)
+    require.NoError(t, db.Close())
+
+    m, err := Preload(path, 0)
+    require.NoError(t, err)
+    defer m.Close()
+
+    stats := m.Stats()
+    require.Equal(t, 17, stats.Tiles)
+    require.Equal(t, 16, stats.Payloads)
+    require.True(t, stats.Bytes > 0)
+    require.True(t, stats.LoadTime > 0)
+
+    v, err := m.VersionContext(context.Background())
+    require.NoError(t, err)
+    require.Equal(t, "test", v.Name)
+
+    tile, err := m.FetchTileContext(context.Background(), 5, 5, 3)
+    require.NoError(t, err)
+    require.Equal(t, []byte("3/5/5"), tile)
+
+    // the non-context methods read the same tiles and metadata
+    tile, err = m.FetchTile(5, 5, 3)
+    require.NoError(t, err)
+    require.Equal(t, []byte("3/5/5"), tile)
+
+    v, err = m.Version()
+    require.NoError(t, err)
+    require.Equal(t, "test", v.Name)
+
+    tile, err = m.FetchTileContext(context.Background(), 0, 0, 0)
+    require.NoError(t, err)
+    require.Equal(t, []byte("0/0/0"), tile)
+
+    a, err := m.FetchTileContext(context.Background(), 0, 7, 3)
+    require.NoError(t, err)
+    b, err := m.FetchTileContext(context.Background(), 7, 0, 3)
+    require.NoError(t, err)
+    require.Equal(t, []byte("sea"), a)
+    require.Equal(t, &a[0], &b[0])
+
+    // missing and out of range tiles
+    for _, l := range [][3]int{{5, 4, 3}, {8, 8, 3}, {-1, 0, 3}, {0, 0, 40}} {
+        tile, err = m.FetchTileContext(context.Background(), l[0], l[1], l[2])
+        require.NoError(t, err)
+        require.Nil(t, tile)
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+
+    _, err = m.FetchTileContext(ctx, 5, 5, 3)
+    require.Equal(t, context.Canceled, err)
+
+    // the limit counts the distinct tiles read, not the size of the file
+    info, err := os.Stat(path)
+    require.NoError(t, err)
+
+    m, err = Preload(path, 128)
+    require.NoError(t, err)
+    require.True(t, info.Size() > 128)
+    require.Equal(t, 17, m.Stats().Tiles)
+
+    _, err = Preload(path, 64)
+    require.Error(t, err)
+    require.Contains(t, err.Error(), "exceeds the preload limit")
+}
+
+func TestPreload_Limit(t *testing.T) {
+    dir, err := ioutil.TempDir("", "mbtiles-test")
+    require.NoError(t, err)
+    defer os.RemoveAll(dir)
+
+    path := createPackage(t, dir, 2)
+
+    // a row of identical sea tiles, taking the tiles read well over their distinct size
+    db, err := sql.Open("sqlite3", path)
+    require.NoError(t, err)
+
+    for x := 0; x < 8; x++ {
+        _, err = db.Exec("insert into tiles values (3, ?, 0, 'seaseaseaseaseasea')", x)
+        require.NoError(t, err)
+    }
+
+    var total, distinct int
+    require.NoError(t, db.QueryRow("select sum(length(tile_data)) from tiles").Scan(&total))
+    require.NoError(t, db.QueryRow("select sum(length(tile_data)) from (select distinct tile_data from tiles)").Scan(&distinct))
+    require.NoError(t, db.Close())
+
+    // sized up front when every tile fits the limit
+    m, err := Preload(path, int64(total))
+    require.NoError(t, err)
+    require.Equal(t, distinct, len(m.data))
+
+    // grown as the distinct tiles are read, rather than sized to the limit
+    limit := (total + distinct) / 2
+    m, err = Preload(path, int64(limit))
+    require.NoError(t, err)
+    require.Equal(t, distinct, len(m.data))
+    require.True(t, cap(m.data) < limit)
+
+    _, err = Preload(path, int64(distinct-1))
+    require.Error(t, err)
+}
+
+func TestPreloadContext_Logging(t *testing.T) {
+    dir, err := ioutil.TempDir("", "mbtiles-test")
+    require.NoError(t, err)
+    defer os.RemoveAll(dir)
+
+    path := createPackage(t, dir, 1)
+
+    logs := &bytes.Buffer{}
+    log.SetOutput(logs)
+    defer log.SetOutput(os.Stderr)
+
+    // the logs of opening and loading the package carry the caller's trace
+    ctx := trace.NewContext(context.Background(), &trace.Trace{RequestID: "preload-request"})
+    m, err := PreloadContext(ctx, path, 0)
+    require.NoError(t, err)
+    require.NoError(t, m.Close())
+
+    lines := bytes.Split(bytes.TrimSpace(logs.Bytes()), []byte("\n"))
+    require.Len(t, lines, 2)
+
+    for _, line := range lines {
+        require.Contains(t, string(line), "requestId = preload-request")
+    }
+}
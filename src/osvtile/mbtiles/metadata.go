@@ -0,0 +1,143 @@
+package mbtiles
+
+import (
+    "encoding/json"
+    "fmt"
+    "strconv"
+    "strings"
+)
+
+// VectorLayer describes a layer within a vector tileset, as held in the `json` metadata value
+type VectorLayer struct {
+    ID          string            `json:"id"`
+    Fields      map[string]string `json:"fields"`
+    Description string            `json:"description,omitempty"`
+    Minzoom     *int              `json:"minzoom,omitempty"`
+    Maxzoom     *int              `json:"maxzoom,omitempty"`
+}
+
+// Tilestats holds the (optional) summary statistics of a vector tileset's layers and attributes
+type Tilestats struct {
+    LayerCount int              `json:"layerCount"`
+    Layers     []TilestatsLayer `json:"layers"`
+}
+
+// TilestatsLayer summarises the features in a single layer
+type TilestatsLayer struct {
+    Layer          string               `json:"layer"`
+    Count          int                  `json:"count"`
+    Geometry       string               `json:"geometry"`
+    AttributeCount int                  `json:"attributeCount"`
+    Attributes     []TilestatsAttribute `json:"attributes,omitempty"`
+}
+
+// TilestatsAttribute summarises the values of a single feature attribute
+type TilestatsAttribute struct {
+    Attribute string        `json:"attribute"`
+    Count     int           `json:"count"`
+    Type      string        `json:"type"`
+    Values    []interface{} `json:"values,omitempty"`
+    Min       *float64      `json:"min,omitempty"`
+    Max       *float64      `json:"max,omitempty"`
+}
+
+// parses a value such as `-0.173,51.3859,10` to a position type
+func parsePosition(value string) (*Position, error) {
+    parts := strings.Split(value, ",")
+
+    if len(parts) != 3 {
+        return nil, fmt.Errorf("invalid center, expected lon,lat,zoom: value = %s", value)
+    }
+
+    p := Position{}
+
+    for i, part := range parts {
+        f, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+
+        if err != nil {
+            return nil, fmt.Errorf("invalid center: value = %s, error = %s", value, err)
+        }
+
+        p[i] = f
+    }
+
+    if p.Lon() < -180 || p.Lon() > 180 || p.Lat() < -90 || p.Lat() > 90 {
+        return nil, fmt.Errorf("invalid center, outside of WGS84 range: value = %s", value)
+    }
+
+    return &p, nil
+}
+
+// parses a value such as `-9.0,49.8,2.1,61.0` to a bounding box type
+func parseBBox(value string) (*BBox, error) {
+    parts := strings.Split(value, ",")
+
+    if len(parts) != 4 {
+        return nil, fmt.Errorf("invalid bounds, expected left,bottom,right,top: value = %s", value)
+    }
+
+    b := BBox{}
+
+    for i, part := range parts {
+        f, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+
+        if err != nil {
+            return nil, fmt.Errorf("invalid bounds: value = %s, error = %s", value, err)
+        }
+
+        b[i] = f
+    }
+
+    if b.Left() < -180 || b.Right() > 180 || b.Bottom() < -90 || b.Top() > 90 {
+        return nil, fmt.Errorf("invalid bounds, outside of WGS84 range: value = %s", value)
+    }
+
+    if b.Left() > b.Right() || b.Bottom() > b.Top() {
+        return nil, fmt.Errorf("invalid bounds, left/bottom exceed right/top: value = %s", value)
+    }
+
+    return &b, nil
+}
+
+// parses the `json` metadata value holding the vector layers and tilestats
+func parseJSON(value string, v *Version) error {
+    meta := struct {
+        VectorLayers []VectorLayer `json:"vector_layers"`
+        Tilestats    *Tilestats    `json:"tilestats"`
+    }{}
+
+    if err := json.Unmarshal([]byte(value), &meta); err != nil {
+        return fmt.Errorf("invalid json metadata: error = %s", err)
+    }
+
+    for _, l := range meta.VectorLayers {
+        if l.ID == "" {
+            return fmt.Errorf("invalid json metadata, vector layer has no id")
+        }
+    }
+
+    v.VectorLayers = meta.VectorLayers
+    v.Tilestats = meta.Tilestats
+
+    return nil
+}
+
+// validate checks the parsed values are consistent with each other. The zoom range is only checked when the package
+// has both zooms, as a missing zoom is left at zero.
+func (v *Version) validate(hasMinzoom, hasMaxzoom bool) error {
+    if v.Minzoom < 0 || v.Maxzoom < 0 {
+        return fmt.Errorf("invalid zoom, must not be negative: minzoom = %d, maxzoom = %d", v.Minzoom, v.Maxzoom)
+    }
+
+    if hasMinzoom && hasMaxzoom && v.Minzoom > v.Maxzoom {
+        return fmt.Errorf("invalid zoom range: minzoom = %d, maxzoom = %d", v.Minzoom, v.Maxzoom)
+    }
+
+    switch v.Type {
+    case "", "overlay", "baselayer":
+    default:
+        return fmt.Errorf("invalid type, expected overlay or baselayer: type = %s", v.Type)
+    }
+
+    return nil
+}
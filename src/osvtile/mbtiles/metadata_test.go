@@ -0,0 +1,83 @@
+package mbtiles
+
+import (
+    "github.com/stretchr/testify/require"
+    "testing"
+)
+
+func TestParseBBox(t *testing.T) {
+    b, err := parseBBox("-9.0, 49.8,2.1,61")
+    require.NoError(t, err)
+    require.Equal(t, BBox{-9.0, 49.8, 2.1, 61}, *b)
+
+    _, err = parseBBox("-9.0,49.8,2.1")
+    require.Error(t, err)
+
+    _, err = parseBBox("-9.0,49.8,2.1,north")
+    require.Error(t, err)
+
+    _, err = parseBBox("-190,49.8,2.1,61")
+    require.Error(t, err)
+
+    _, err = parseBBox("2.1,61,-9.0,49.8")
+    require.Error(t, err)
+}
+
+func TestParsePosition(t *testing.T) {
+    p, err := parsePosition("-0.173,51.3859,10")
+    require.NoError(t, err)
+    require.Equal(t, -0.173, p.Lon())
+    require.Equal(t, 51.3859, p.Lat())
+    require.Equal(t, 10, p.Zoom())
+
+    _, err = parsePosition("-0.173,51.3859,10,1")
+    require.Error(t, err)
+
+    _, err = parsePosition("-0.173,95,10")
+    require.Error(t, err)
+}
+
+func TestParseJSON(t *testing.T) {
+    v := &Version{}
+
+    err := parseJSON(`{
+        "vector_layers": [{"id": "sea", "fields": {"type": "String"}, "minzoom": 0, "maxzoom": 14}],
+        "tilestats": {"layerCount": 1, "layers": [{"layer": "sea", "count": 2, "geometry": "Polygon"}]}
+    }`, v)
+    require.NoError(t, err)
+    require.Len(t, v.VectorLayers, 1)
+    require.Equal(t, "sea", v.VectorLayers[0].ID)
+    require.Equal(t, "String", v.VectorLayers[0].Fields["type"])
+    require.Equal(t, 14, *v.VectorLayers[0].Maxzoom)
+    require.Equal(t, 1, v.Tilestats.LayerCount)
+    require.Equal(t, "Polygon", v.Tilestats.Layers[0].Geometry)
+
+    require.Error(t, parseJSON(`{"vector_layers": [{"fields": {}}]}`, &Version{}))
+    require.Error(t, parseJSON(`not json`, &Version{}))
+}
+
+func TestVersion_Validate(t *testing.T) {
+    require.NoError(t, (&Version{Minzoom: 0, Maxzoom: 14, Type: "baselayer", Scheme: TMS}).validate(true, true))
+    require.Error(t, (&Version{Minzoom: 15, Maxzoom: 14}).validate(true, true))
+    require.Error(t, (&Version{Minzoom: -1}).validate(true, false))
+    require.Error(t, (&Version{Type: "underlay"}).validate(false, false))
+
+    // a minzoom without a maxzoom is not compared with the zero maxzoom
+    require.NoError(t, (&Version{Minzoom: 5}).validate(true, false))
+}
+
+func TestParseScheme(t *testing.T) {
+    s, err := ParseScheme("xyz")
+    require.NoError(t, err)
+    require.Equal(t, XYZ, s)
+
+    _, err = ParseScheme("wmts")
+    require.Error(t, err)
+}
+
+func TestFlipY(t *testing.T) {
+    require.Equal(t, 0, FlipY(0, 0))
+    require.Equal(t, 3, FlipY(0, 2))
+    require.Equal(t, 0, FlipY(3, 2))
+    require.Equal(t, 5, FlipY(FlipY(5, 10), 10))
+}
@@ -0,0 +1,138 @@
+package mbtiles
+
+import (
+    "context"
+    "database/sql/driver"
+    "fmt"
+    "github.com/mattn/go-sqlite3"
+    "net/url"
+    "runtime"
+    "strings"
+)
+
+// Option configures how an MBTiles package is read
+type Option func(o *options)
+
+type options struct {
+    conns     int
+    mmapSize  int64
+    pageCache int64
+    mutable   bool
+}
+
+// WithConns sets the number of read connections held open to the package, which is the number of tiles that can
+// be read at once. Defaults to GOMAXPROCS.
+func WithConns(n int) Option {
+    return func(o *options) {
+        o.conns = n
+    }
+}
+
+// WithMmapSize sets how many bytes of the package each connection reads through a memory map rather than through
+// the page cache, zero to leave SQLite's default (usually off). The map is shared by the OS between connections.
+func WithMmapSize(size int64) Option {
+    return func(o *options) {
+        o.mmapSize = size
+    }
+}
+
+// WithPageCache sets the bytes of the SQLite page cache of each connection, zero to leave SQLite's default (2MB)
+func WithPageCache(size int64) Option {
+    return func(o *options) {
+        o.pageCache = size
+    }
+}
+
+// WithMutable opens the package in the normal read-only mode, rather than immutable mode. Immutable mode skips all
+// file locking and change detection, so the package must not change while the server runs: there is no reload, so
+// stop the server before replacing the file, or use mutable mode for packages which are modified while served.
+//
+// Mutable mode costs about half the read rate: every query is its own read transaction, which takes and releases a
+// shared file lock, checks for a hot journal and re-reads the file change counter to validate the page cache.
+func WithMutable(mutable bool) Option {
+    return func(o *options) {
+        o.mutable = mutable
+    }
+}
+
+// dsn builds the URI to open the package read-only. The driver passes `file:` URIs to SQLite as is, any other name
+// has its query string dropped.
+//
+// The connections are opened with `_mutex=no`, SQLite's multi-thread mode, which is safe as long as a connection is
+// never used by two goroutines at once. `database/sql` guarantees this: a connection (and its prepared statements)
+// is held by a single goroutine for the length of each query and returned to the pool once the rows are closed. The
+// per-connection mutex SQLite would otherwise take on every call is never contended, so is only overhead.
+func (o *options) dsn(path string) string {
+    escaped := strings.NewReplacer("%", "%25", "?", "%3f", "#", "%23").Replace(path)
+
+    query := url.Values{}
+    query.Set("mode", "ro")
+    query.Set("_mutex", "no")
+    query.Set("_query_only", "true")
+
+    if !o.mutable {
+        query.Set("immutable", "1")
+    }
+
+    return fmt.Sprintf("file:%s?%s", escaped, query.Encode())
+}
+
+// pragmas are run on every new connection
+func (o *options) pragmas() []string {
+    var pragmas []string
+
+    if o.mmapSize > 0 {
+        pragmas = append(pragmas, fmt.Sprintf("pragma mmap_size = %d", o.mmapSize))
+    }
+
+    // a negative cache size is in KiB rather than pages
+    if o.pageCache > 0 {
+        pragmas = append(pragmas, fmt.Sprintf("pragma cache_size = -%d", (o.pageCache+1023)/1024))
+    }
+
+    return pragmas
+}
+
+func newOptions(opts []Option) *options {
+    o := &options{
+        conns: runtime.GOMAXPROCS(0),
+    }
+
+    for _, opt := range opts {
+        opt(o)
+    }
+
+    if o.conns < 1 {
+        o.conns = 1
+    }
+
+    return o
+}
+
+// connector opens connections to the package, running the pragmas on each new connection
+type connector struct {
+    dsn     string
+    pragmas []string
+    driver  *sqlite3.SQLiteDriver
+}
+
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+    conn, err := c.driver.Open(c.dsn)
+
+    if err != nil {
+        return nil, err
+    }
+
+    for _, pragma := range c.pragmas {
+        if _, err := conn.(*sqlite3.SQLiteConn).Exec(pragma, nil); err != nil {
+            _ = conn.Close()
+            return nil, fmt.Errorf("failed to set pragma: pragma = %s, error = %s", pragma, err)
+        }
+    }
+
+    return conn, nil
+}
+
+func (c *connector) Driver() driver.Driver {
+    return c.driver
+}
@@ -0,0 +1,28 @@
+package mbtiles
+
+import "fmt"
+
+// Scheme is the tile row numbering used by a tileset or a request
+type Scheme string
+
+const (
+    // TMS numbers rows from the bottom (south) of the map - this is the MBTiles default
+    TMS Scheme = "tms"
+    // XYZ numbers rows from the top (north) of the map, as used by most web map clients
+    XYZ Scheme = "xyz"
+)
+
+// ParseScheme converts a scheme name, returning an error for anything other than `tms` or `xyz`
+func ParseScheme(value string) (Scheme, error) {
+    switch Scheme(value) {
+    case TMS, XYZ:
+        return Scheme(value), nil
+    default:
+        return "", fmt.Errorf("invalid scheme, expected tms or xyz: scheme = %s", value)
+    }
+}
+
+// FlipY converts a tile row between the TMS and XYZ schemes at the given zoom
+func FlipY(y, z int) int {
+    return (1 << uint(z)) - 1 - y
+}
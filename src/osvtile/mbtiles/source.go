@@ -0,0 +1,28 @@
+package mbtiles
+
+import (
+    "context"
+)
+
+// TileSource is anything that can provide tiles and their metadata to the web handlers. MBTiles is the standard
+// implementation, but other storage backends, composite sources or in-memory fakes can be served up in the same way.
+// Sources should give up on a fetch once the context is done, returning the context error.
+type TileSource interface {
+    // FetchTile will return the tile at the given location and zoom, or `nil,nil` if no such tile exists
+    FetchTile(x, y, z int) ([]byte, error)
+
+    // FetchTileContext is `FetchTile`, giving up once the context is done
+    FetchTileContext(ctx context.Context, x, y, z int) ([]byte, error)
+
+    // Version will report the metadata of the tile source
+    Version() (*Version, error)
+
+    // VersionContext is `Version`, giving up once the context is done
+    VersionContext(ctx context.Context) (*Version, error)
+
+    // Close will release any resources held by the tile source
+    Close() error
+}
+
+// ensure MBTiles satisfies the interface
+var _ TileSource = &MBTiles{}
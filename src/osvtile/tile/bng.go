@@ -0,0 +1,117 @@
+package tile
+
+import (
+    "math"
+    "osdata/osvtile/mbtiles"
+)
+
+// British National Grid: a transverse mercator projection of the OSGB36 datum on the Airy 1830 ellipsoid
+const (
+    airyA     = 6377563.396
+    airyB     = 6356256.909
+    grs80A    = 6378137.0
+    grs80B    = 6356752.3141
+    bngF0     = 0.9996012717
+    bngLat0   = 49 * math.Pi / 180
+    bngLon0   = -2 * math.Pi / 180
+    bngE0     = 400000.0
+    bngN0     = -100000.0
+    arcSecond = math.Pi / (180 * 3600)
+)
+
+// FromBNG converts a British National Grid easting and northing to a WGS84 longitude and latitude. The datum shift
+// uses the OSGB36 to WGS84 Helmert transformation, which is accurate to a few metres - plenty for selecting tiles.
+func FromBNG(easting, northing float64) (float64, float64) {
+    lat, lon := bngToOSGB36(easting, northing)
+    return osgb36ToWGS84(lat, lon)
+}
+
+// BBoxFromBNG converts a British National Grid bounding box (min easting, min northing, max easting, max northing)
+// to the WGS84 bounding box enclosing it
+func BBoxFromBNG(b mbtiles.BBox) mbtiles.BBox {
+    out := mbtiles.BBox{180, 90, -180, -90}
+
+    // the grid is not aligned with the meridians, so every corner is needed for the enclosing box
+    for _, corner := range [][2]float64{{b[0], b[1]}, {b[0], b[3]}, {b[2], b[1]}, {b[2], b[3]}} {
+        lon, lat := FromBNG(corner[0], corner[1])
+        out[0] = math.Min(out[0], lon)
+        out[1] = math.Min(out[1], lat)
+        out[2] = math.Max(out[2], lon)
+        out[3] = math.Max(out[3], lat)
+    }
+
+    return out
+}
+
+// bngToOSGB36 is the inverse transverse mercator projection, returning the OSGB36 latitude and longitude in radians
+func bngToOSGB36(e, n float64) (float64, float64) {
+    a, b := airyA, airyB
+    e2 := 1 - (b*b)/(a*a)
+    n1 := (a - b) / (a + b)
+    n2, n3 := n1*n1, n1*n1*n1
+
+    meridional := func(lat float64) float64 {
+        d, s := lat-bngLat0, lat+bngLat0
+        return b * bngF0 * ((1+n1+5.0/4*n2+5.0/4*n3)*d -
+            (3*n1+3*n2+21.0/8*n3)*math.Sin(d)*math.Cos(s) +
+            (15.0/8*n2+15.0/8*n3)*math.Sin(2*d)*math.Cos(2*s) -
+            (35.0/24*n3)*math.Sin(3*d)*math.Cos(3*s))
+    }
+
+    lat := bngLat0
+    m := 0.0
+
+    for i := 0; i < 100 && math.Abs(n-bngN0-m) >= 0.00001; i++ {
+        lat = (n-bngN0-m)/(a*bngF0) + lat
+        m = meridional(lat)
+    }
+
+    sin, cos, tan := math.Sin(lat), math.Cos(lat), math.Tan(lat)
+    nu := a * bngF0 / math.Sqrt(1-e2*sin*sin)
+    rho := a * bngF0 * (1 - e2) / math.Pow(1-e2*sin*sin, 1.5)
+    eta2 := nu/rho - 1
+
+    vii := tan / (2 * rho * nu)
+    viii := tan / (24 * rho * math.Pow(nu, 3)) * (5 + 3*tan*tan + eta2 - 9*tan*tan*eta2)
+    ix := tan / (720 * rho * math.Pow(nu, 5)) * (61 + 90*tan*tan + 45*math.Pow(tan, 4))
+    x := 1 / (cos * nu)
+    xi := 1 / (cos * 6 * math.Pow(nu, 3)) * (nu/rho + 2*tan*tan)
+    xii := 1 / (cos * 120 * math.Pow(nu, 5)) * (5 + 28*tan*tan + 24*math.Pow(tan, 4))
+    xiia := 1 / (cos * 5040 * math.Pow(nu, 7)) * (61 + 662*tan*tan + 1320*math.Pow(tan, 4) + 720*math.Pow(tan, 6))
+
+    de := e - bngE0
+
+    return lat - vii*de*de + viii*math.Pow(de, 4) - ix*math.Pow(de, 6),
+        bngLon0 + x*de - xi*math.Pow(de, 3) + xii*math.Pow(de, 5) - xiia*math.Pow(de, 7)
+}
+
+// osgb36ToWGS84 shifts an OSGB36 latitude and longitude (radians) to a WGS84 longitude and latitude (degrees)
+func osgb36ToWGS84(lat, lon float64) (float64, float64) {
+    // to cartesian on the Airy ellipsoid
+    e2 := 1 - (airyB*airyB)/(airyA*airyA)
+    nu := airyA / math.Sqrt(1-e2*math.Sin(lat)*math.Sin(lat))
+    x1 := nu * math.Cos(lat) * math.Cos(lon)
+    y1 := nu * math.Cos(lat) * math.Sin(lon)
+    z1 := (1 - e2) * nu * math.Sin(lat)
+
+    // the Helmert transformation, OSGB36 to WGS84
+    tx, ty, tz := 446.448, -125.157, 542.060
+    s := -20.4894e-6
+    rx, ry, rz := 0.1502*arcSecond, 0.2470*arcSecond, 0.8421*arcSecond
+
+    x2 := tx + (1+s)*x1 - rz*y1 + ry*z1
+    y2 := ty + rz*x1 + (1+s)*y1 - rx*z1
+    z2 := tz - ry*x1 + rx*y1 + (1+s)*z1
+
+    // back to latitude and longitude on the GRS80 ellipsoid
+    e2 = 1 - (grs80B*grs80B)/(grs80A*grs80A)
+    p := math.Sqrt(x2*x2 + y2*y2)
+    lat = math.Atan2(z2, p*(1-e2))
+
+    for i := 0; i < 10; i++ {
+        nu = grs80A / math.Sqrt(1-e2*math.Sin(lat)*math.Sin(lat))
+        lat = math.Atan2(z2+e2*nu*math.Sin(lat), p)
+    }
+
+    return math.Atan2(y2, x2) * 180 / math.Pi, lat * 180 / math.Pi
+}
@@ -0,0 +1,65 @@
+package tile
+
+import (
+    "math"
+    "osdata/osvtile/mbtiles"
+)
+
+// MaxLat is the latitude limit of the web mercator projection
+const MaxLat = 85.0511287798066
+
+// Range is an inclusive block of XYZ tiles at a single zoom
+type Range struct {
+    Z    int
+    MinX int
+    MinY int
+    MaxX int
+    MaxY int
+}
+
+// Contains checks if the tile at x, y (XYZ) is within the range
+func (r Range) Contains(x, y int) bool {
+    return x >= r.MinX && x <= r.MaxX && y >= r.MinY && y <= r.MaxY
+}
+
+// Count reports the number of tiles in the range
+func (r Range) Count() int64 {
+    return int64(r.MaxX-r.MinX+1) * int64(r.MaxY-r.MinY+1)
+}
+
+// RangeFor finds the tiles at the zoom which intersect the WGS84 bounding box
+func RangeFor(b mbtiles.BBox, z int) Range {
+    minX, maxY := position(b.Left(), b.Bottom(), z)
+    maxX, minY := position(b.Right(), b.Top(), z)
+
+    return Range{Z: z, MinX: minX, MinY: minY, MaxX: maxX, MaxY: maxY}
+}
+
+// Intersects checks if the tile intersects the WGS84 bounding box
+func Intersects(k Key, b mbtiles.BBox) bool {
+    return RangeFor(b, k.Z).Contains(k.X, k.Y)
+}
+
+// position finds the XYZ tile containing the lon/lat at the zoom, clamped to the tile grid
+func position(lon, lat float64, z int) (int, int) {
+    n := math.Exp2(float64(z))
+    lat = math.Max(-MaxLat, math.Min(MaxLat, lat))
+    rad := lat * math.Pi / 180
+
+    x := int(math.Floor((lon + 180) / 360 * n))
+    y := int(math.Floor((1 - math.Log(math.Tan(rad)+1/math.Cos(rad))/math.Pi) / 2 * n))
+
+    return clamp(x, int(n)-1), clamp(y, int(n)-1)
+}
+
+func clamp(v, max int) int {
+    if v < 0 {
+        return 0
+    }
+
+    if v > max {
+        return max
+    }
+
+    return v
+}
@@ -0,0 +1,2 @@
+// Package tile handles tile coordinates: cache keys, and the mapping between tiles and WGS84 bounding boxes
+package tile
@@ -0,0 +1,38 @@
+package tile
+
+import "osdata/osvtile/mbtiles"
+
+// Filter selects tiles by tileset, format, zoom range and/or bounding box. Unset criteria match every tile, so the
+// zero value matches everything.
+type Filter struct {
+    Tileset string        `json:"tileset,omitempty"`
+    Format  string        `json:"format,omitempty"`
+    Minzoom *int          `json:"minzoom,omitempty"`
+    Maxzoom *int          `json:"maxzoom,omitempty"`
+    BBox    *mbtiles.BBox `json:"bbox,omitempty"`
+}
+
+// Match checks if the tile is selected by the filter
+func (f *Filter) Match(k Key) bool {
+    if f.Tileset != "" && f.Tileset != k.Tileset {
+        return false
+    }
+
+    if f.Format != "" && f.Format != k.Format {
+        return false
+    }
+
+    if f.Minzoom != nil && k.Z < *f.Minzoom {
+        return false
+    }
+
+    if f.Maxzoom != nil && k.Z > *f.Maxzoom {
+        return false
+    }
+
+    if f.BBox != nil && !Intersects(k, *f.BBox) {
+        return false
+    }
+
+    return true
+}
@@ -0,0 +1,54 @@
+package tile
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+)
+
+// Key identifies a single tile of a tileset in a given format (e.g. `mvt` or `png`), the row `Y` is always in the
+// XYZ scheme
+type Key struct {
+    Tileset string
+    Format  string
+    Z       int
+    X       int
+    Y       int
+}
+
+// String encodes the key in the form `tileset/format/z/x/y`, as used for the cache keys
+func (k Key) String() string {
+    return fmt.Sprintf("%s/%s/%d/%d/%d", k.Tileset, k.Format, k.Z, k.X, k.Y)
+}
+
+// ParseKey decodes a key encoded by `Key.String()`
+func ParseKey(value string) (Key, error) {
+    parts := strings.Split(value, "/")
+
+    if len(parts) != 5 || parts[0] == "" || parts[1] == "" {
+        return Key{}, fmt.Errorf("invalid tile key: key = %s", value)
+    }
+
+    k := Key{Tileset: parts[0], Format: parts[1]}
+
+    for i, dst := range []*int{&k.Z, &k.X, &k.Y} {
+        v, err := strconv.Atoi(parts[i+2])
+
+        if err != nil || v < 0 {
+            return Key{}, fmt.Errorf("invalid tile key: key = %s", value)
+        }
+
+        *dst = v
+    }
+
+    return k, nil
+}
+
+// Namespace reports the tileset of an encoded key, this is used to group the cache entries by tileset
+func Namespace(key string) string {
+    if i := strings.IndexByte(key, '/'); i >= 0 {
+        return key[:i]
+    }
+
+    return key
+}
@@ -0,0 +1,66 @@
+package tile
+
+import (
+    "github.com/stretchr/testify/require"
+    "osdata/osvtile/mbtiles"
+    "testing"
+)
+
+func TestKey_ParseString(t *testing.T) {
+    k := Key{Tileset: "zoomstack", Format: "mvt", Z: 14, X: 8123, Y: 5432}
+    require.Equal(t, "zoomstack/mvt/14/8123/5432", k.String())
+    require.Equal(t, "zoomstack", Namespace(k.String()))
+
+    p, err := ParseKey(k.String())
+    require.NoError(t, err)
+    require.Equal(t, k, p)
+
+    for _, bad := range []string{
+        "", "zoomstack/mvt/1/2", "/mvt/1/2/3", "zoomstack//1/2/3", "zoomstack/mvt/a/2/3", "zoomstack/mvt/1/2/-3",
+    } {
+        _, err = ParseKey(bad)
+        require.Error(t, err, bad)
+    }
+}
+
+func TestRangeFor(t *testing.T) {
+    world := mbtiles.BBox{-180, -90, 180, 90}
+    require.Equal(t, Range{Z: 0}, RangeFor(world, 0))
+    require.Equal(t, Range{Z: 2, MaxX: 3, MaxY: 3}, RangeFor(world, 2))
+    require.Equal(t, int64(16), RangeFor(world, 2).Count())
+
+    // Southampton, tile 14/8128/5491 in XYZ
+    soton := mbtiles.BBox{-1.40, 50.904, -1.39, 50.906}
+    r := RangeFor(soton, 14)
+    require.True(t, r.Contains(8128, 5491))
+    require.Equal(t, int64(1), r.Count())
+}
+
+func TestFilter_Match(t *testing.T) {
+    five, ten := 5, 10
+    k := Key{Tileset: "zoomstack", Format: "mvt", Z: 7, X: 63, Y: 42}
+
+    require.True(t, (&Filter{}).Match(k))
+    require.True(t, (&Filter{Format: "mvt"}).Match(k))
+    require.False(t, (&Filter{Format: "png"}).Match(k))
+    require.True(t, (&Filter{Tileset: "zoomstack", Minzoom: &five, Maxzoom: &ten}).Match(k))
+    require.False(t, (&Filter{Tileset: "hillshade"}).Match(k))
+    require.False(t, (&Filter{Maxzoom: &five}).Match(k))
+    require.False(t, (&Filter{Minzoom: &ten}).Match(k))
+    require.True(t, (&Filter{BBox: &mbtiles.BBox{-2, 50, -1, 51}}).Match(k))
+    require.False(t, (&Filter{BBox: &mbtiles.BBox{10, 50, 11, 51}}).Match(k))
+}
+
+func TestFromBNG(t *testing.T) {
+    // the worked example from the OS guide to coordinate systems, 52°39'28.72"N 1°42'57.79"E in WGS84
+    lon, lat := FromBNG(651409.903, 313177.270)
+    require.InDelta(t, 1.716053, lon, 0.00002)
+    require.InDelta(t, 52.657978, lat, 0.00002)
+
+    // Hampshire
+    b := BBoxFromBNG(mbtiles.BBox{400000, 100000, 480000, 170000})
+    require.True(t, b.Left() < -1.4 && b.Left() > -2.1, "%v", b)
+    require.True(t, b.Right() > -1.0 && b.Right() < -0.8, "%v", b)
+    require.True(t, b.Bottom() > 50.6 && b.Bottom() < 50.8, "%v", b)
+    require.True(t, b.Top() > 51.3 && b.Top() < 51.5, "%v", b)
+}
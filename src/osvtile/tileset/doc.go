@@ -0,0 +1,2 @@
+// Package tileset holds the named tile packages served up by osvtiled
+package tileset
@@ -0,0 +1,330 @@
+package tileset
+
+import (
+    "context"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "os"
+    "osdata/osvtile/container/lru"
+    "osdata/osvtile/mbtiles"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Registry holds the set of loaded tilesets keyed by their name
+type Registry struct {
+    rw   *sync.RWMutex
+    sets map[string]*Tileset
+}
+
+// Load will open the MBTiles package described by the config and add it to the registry, reading the whole package
+// into memory if the config asks for it to be preloaded. The name must be unique within the registry.
+func (r *Registry) Load(c Config) (*Tileset, error) {
+    if err := r.checkName(c.Name); err != nil {
+        return nil, err
+    }
+
+    opts, err := readOptions(c)
+
+    if err != nil {
+        return nil, fmt.Errorf("invalid tileset config: name = %s, error = %s", c.Name, err)
+    }
+
+    limit, err := preloadLimit(c)
+
+    if err != nil {
+        return nil, fmt.Errorf("invalid tileset config: name = %s, error = %s", c.Name, err)
+    }
+
+    source, err := open(c, limit, opts)
+
+    if err != nil {
+        return nil, fmt.Errorf("failed to load MBTiles package: path = %s, error = %s", c.Path, err)
+    }
+
+    // the package details are read before the tileset is published, as requests may read them as soon as it is
+    info, _ := os.Stat(c.Path)
+    t, err := r.add(c, source, info)
+
+    if err != nil {
+        _ = source.Close()
+        return nil, err
+    }
+
+    return t, nil
+}
+
+// Add will register an already opened tile source under the configured name, the config path is informational only.
+// The registry takes ownership of the source and will close it when the registry is closed.
+func (r *Registry) Add(c Config, source mbtiles.TileSource) (*Tileset, error) {
+    if err := r.checkName(c.Name); err != nil {
+        return nil, err
+    }
+
+    return r.add(c, source, nil)
+}
+
+// add builds the tileset and publishes it to the registry, the file info of its package is optional and may be nil
+func (r *Registry) add(c Config, source mbtiles.TileSource, info os.FileInfo) (*Tileset, error) {
+    v, err := source.VersionContext(context.Background())
+
+    if err != nil {
+        return nil, fmt.Errorf("failed to load tile source version: name = %s, error = %s", c.Name, err)
+    }
+
+    t := &Tileset{
+        Name:    c.Name,
+        Path:    c.Path,
+        Source:  source,
+        Version: v,
+        Scheme:  mbtiles.TMS,
+    }
+
+    if info != nil {
+        t.ModTime = info.ModTime().UTC()
+        t.Size = info.Size()
+    }
+
+    if v.Scheme != "" {
+        t.Scheme = v.Scheme
+    }
+
+    if c.Scheme != "" {
+        if t.Scheme, err = mbtiles.ParseScheme(c.Scheme); err != nil {
+            return nil, fmt.Errorf("invalid tileset config: name = %s, error = %s", c.Name, err)
+        }
+    }
+
+    if c.MaxAge != "" {
+        if t.MaxAge, err = time.ParseDuration(c.MaxAge); err != nil || t.MaxAge < 0 {
+            return nil, fmt.Errorf("invalid tileset config, bad maxAge: name = %s, maxAge = %s", c.Name, c.MaxAge)
+        }
+    }
+
+    if c.CacheSize != "" {
+        if t.CacheSize, err = lru.ParseSize(c.CacheSize); err != nil {
+            return nil, fmt.Errorf("invalid tileset config, bad cacheSize: name = %s, error = %s", c.Name, err)
+        }
+    }
+
+    if c.CacheTTL != "" {
+        if t.CacheTTL, err = time.ParseDuration(c.CacheTTL); err != nil || t.CacheTTL < 0 {
+            return nil, fmt.Errorf("invalid tileset config, bad cacheTTL: name = %s, cacheTTL = %s", c.Name, c.CacheTTL)
+        }
+    }
+
+    if c.FetchTimeout != "" {
+        if t.FetchTimeout, err = time.ParseDuration(c.FetchTimeout); err != nil || t.FetchTimeout < 0 {
+            return nil, fmt.Errorf("invalid tileset config, bad fetchTimeout: name = %s, fetchTimeout = %s", c.Name, c.FetchTimeout)
+        }
+    }
+
+    if t.CacheZooms, err = parseZooms(c.CacheZooms); err != nil {
+        return nil, fmt.Errorf("invalid tileset config, bad cacheZooms: name = %s, error = %s", c.Name, err)
+    }
+
+    r.rw.Lock()
+    defer r.rw.Unlock()
+
+    if _, ok := r.sets[c.Name]; ok {
+        return nil, fmt.Errorf("duplicate tileset name: name = %s", c.Name)
+    }
+
+    r.sets[c.Name] = t
+    log.Printf("loaded tileset: name = %s, path = %s, scheme = %s, version = %v", t.Name, t.Path, t.Scheme, v)
+
+    return t, nil
+}
+
+// open reads the package as the config asks, either through a pool of connections or preloaded into memory
+func open(c Config, limit int64, opts []mbtiles.Option) (mbtiles.TileSource, error) {
+    if c.Preload {
+        return mbtiles.Preload(c.Path, limit, opts...)
+    }
+
+    return mbtiles.NewMVT(c.Path, opts...)
+}
+
+// preloadLimit parses the most tile data a preloaded package may hold, zero for no limit
+func preloadLimit(c Config) (int64, error) {
+    if c.PreloadLimit == "" {
+        return 0, nil
+    }
+
+    limit, err := lru.ParseSize(c.PreloadLimit)
+
+    if err != nil {
+        return 0, fmt.Errorf("bad preloadLimit: %s", err)
+    }
+
+    return limit, nil
+}
+
+// readOptions converts the config for reading the MBTiles package
+func readOptions(c Config) ([]mbtiles.Option, error) {
+    opts := []mbtiles.Option{mbtiles.WithMutable(c.Mutable)}
+
+    if c.ReadConns < 0 {
+        return nil, fmt.Errorf("bad readConns: readConns = %d", c.ReadConns)
+    }
+
+    if c.ReadConns > 0 {
+        opts = append(opts, mbtiles.WithConns(c.ReadConns))
+    }
+
+    if c.MmapSize != "" {
+        size, err := lru.ParseSize(c.MmapSize)
+
+        if err != nil {
+            return nil, fmt.Errorf("bad mmapSize: %s", err)
+        }
+
+        opts = append(opts, mbtiles.WithMmapSize(size))
+    }
+
+    if c.PageCache != "" {
+        size, err := lru.ParseSize(c.PageCache)
+
+        if err != nil {
+            return nil, fmt.Errorf("bad pageCache: %s", err)
+        }
+
+        opts = append(opts, mbtiles.WithPageCache(size))
+    }
+
+    return opts, nil
+}
+
+// parseZooms converts the zoom band configs, ensuring that the bands do not overlap
+func parseZooms(configs []ZoomConfig) ([]ZoomBudget, error) {
+    var zooms []ZoomBudget
+
+    for _, zc := range configs {
+        if zc.Minzoom < 0 || zc.Minzoom > zc.Maxzoom {
+            return nil, fmt.Errorf("invalid zoom band: minzoom = %d, maxzoom = %d", zc.Minzoom, zc.Maxzoom)
+        }
+
+        size, err := lru.ParseSize(zc.Size)
+
+        if err != nil {
+            return nil, err
+        }
+
+        for _, z := range zooms {
+            if zc.Minzoom <= z.Maxzoom && zc.Maxzoom >= z.Minzoom {
+                return nil, fmt.Errorf("overlapping zoom bands: %d-%d and %d-%d", z.Minzoom, z.Maxzoom, zc.Minzoom, zc.Maxzoom)
+            }
+        }
+
+        zooms = append(zooms, ZoomBudget{Minzoom: zc.Minzoom, Maxzoom: zc.Maxzoom, Size: size, Pinned: zc.Pinned})
+    }
+
+    return zooms, nil
+}
+
+// checkName ensures the name can be used in a route and is not already in use
+func (r *Registry) checkName(name string) error {
+    if !validName.MatchString(name) {
+        return fmt.Errorf("invalid tileset name: name = %s", name)
+    }
+
+    // reserved for the TMS route prefix and the TileJSON of the default tileset, `/tiles.json`
+    if name == string(mbtiles.TMS) || name == "tiles" {
+        return fmt.Errorf("reserved tileset name: name = %s", name)
+    }
+
+    r.rw.RLock()
+    defer r.rw.RUnlock()
+
+    if _, ok := r.sets[name]; ok {
+        return fmt.Errorf("duplicate tileset name: name = %s", name)
+    }
+
+    return nil
+}
+
+// LoadDir will load every `.mbtiles` file found in the given directory, naming each tileset after its file. The
+// options for each tileset are taken from the defaults.
+func (r *Registry) LoadDir(dir string, defaults Config) ([]*Tileset, error) {
+    files, err := ioutil.ReadDir(dir)
+
+    if err != nil {
+        return nil, err
+    }
+
+    var loaded []*Tileset
+
+    for _, f := range files {
+        if f.IsDir() || !strings.EqualFold(filepath.Ext(f.Name()), ".mbtiles") {
+            continue
+        }
+
+        path := filepath.Join(dir, f.Name())
+        t, err := r.Load(Config{Name: NameFromPath(path), Path: path}.WithDefaults(defaults))
+
+        if err != nil {
+            return loaded, err
+        }
+
+        loaded = append(loaded, t)
+    }
+
+    return loaded, nil
+}
+
+// Get will return the named tileset or nil if no such tileset has been loaded
+func (r *Registry) Get(name string) *Tileset {
+    r.rw.RLock()
+    defer r.rw.RUnlock()
+
+    return r.sets[name]
+}
+
+// Names reports the sorted names of all the loaded tilesets
+func (r *Registry) Names() []string {
+    r.rw.RLock()
+    defer r.rw.RUnlock()
+
+    names := make([]string, 0, len(r.sets))
+
+    for name := range r.sets {
+        names = append(names, name)
+    }
+
+    sort.Strings(names)
+
+    return names
+}
+
+// Close will close all of the underlying tile sources, returning the last error encountered (if any)
+func (r *Registry) Close() error {
+    r.rw.Lock()
+    defer r.rw.Unlock()
+
+    var last error
+
+    for name, t := range r.sets {
+        log.Printf("closing tileset: name = %s", name)
+
+        if err := t.Source.Close(); err != nil {
+            log.Printf("error closing tileset: name = %s, error = %s", name, err)
+            last = err
+        }
+    }
+
+    r.sets = map[string]*Tileset{}
+
+    return last
+}
+
+// NewRegistry will create an empty registry
+func NewRegistry() *Registry {
+    return &Registry{
+        rw:   &sync.RWMutex{},
+        sets: map[string]*Tileset{},
+    }
+}
@@ -0,0 +1,208 @@
+package tileset
+
+import (
+    "database/sql"
+    "github.com/stretchr/testify/require"
+    "io/ioutil"
+    "os"
+    "osdata/osvtile/mbtiles"
+    "osdata/osvtile/mbtiles/mbtilestest"
+    "path/filepath"
+    "testing"
+)
+
+// createPackage writes an MBTiles package with the given metadata and a single tile at 0/0/0, returning its path
+func createPackage(t *testing.T, path string, meta map[string]string) string {
+    db, err := sql.Open("sqlite3", path)
+    require.NoError(t, err)
+    defer db.Close()
+
+    _, err = db.Exec(`
+        create table metadata (name text, value text);
+        create table tiles (zoom_level integer, tile_column integer, tile_row integer, tile_data blob);
+        insert into tiles values (0, 0, 0, 'tile');
+    `)
+    require.NoError(t, err)
+
+    for k, v := range meta {
+        _, err = db.Exec("insert into metadata (name, value) values (?, ?)", k, v)
+        require.NoError(t, err)
+    }
+
+    return path
+}
+
+func TestRegistry_Load(t *testing.T) {
+    dir, err := ioutil.TempDir("", "tileset-test")
+    require.NoError(t, err)
+    defer os.RemoveAll(dir)
+
+    path := createPackage(t, filepath.Join(dir, "zoomstack.mbtiles"), map[string]string{"name": "Zoomstack", "format": "pbf"})
+
+    r := NewRegistry()
+    defer r.Close()
+
+    ts, err := r.Load(Config{Name: "zoomstack", Path: path, MaxAge: "1h"})
+    require.NoError(t, err)
+    require.Equal(t, "Zoomstack", ts.Version.Name)
+    require.Equal(t, path, ts.Path)
+    require.False(t, ts.ModTime.IsZero())
+    require.True(t, ts.Size > 0)
+    require.Equal(t, ts, r.Get("zoomstack"))
+    require.Nil(t, r.Get("other"))
+
+    // names must be unique, valid in a route and not reserved
+    _, err = r.Load(Config{Name: "zoomstack", Path: path})
+    require.Error(t, err)
+
+    _, err = r.Load(Config{Name: "tms", Path: path})
+    require.Error(t, err)
+
+    _, err = r.Load(Config{Name: "zoom-stack", Path: path})
+    require.Error(t, err)
+
+    _, err = r.Load(Config{Name: "missing", Path: filepath.Join(dir, "missing.mbtiles")})
+    require.Error(t, err)
+
+    _, err = r.Load(Config{Name: "bad", Path: path, MaxAge: "soon"})
+    require.Error(t, err)
+    require.Nil(t, r.Get("bad"))
+
+    require.Equal(t, []string{"zoomstack"}, r.Names())
+}
+
+func TestRegistry_Add(t *testing.T) {
+    r := NewRegistry()
+
+    s := &mbtilestest.Source{Meta: &mbtiles.Version{Name: "memory", Format: "png"}}
+    ts, err := r.Add(Config{Name: "memory"}, s)
+    require.NoError(t, err)
+    require.Equal(t, s, ts.Source)
+    require.Empty(t, ts.Path)
+
+    _, err = r.Add(Config{Name: "memory"}, &mbtilestest.Source{})
+    require.Error(t, err)
+
+    _, err = r.Add(Config{Name: "tms"}, &mbtilestest.Source{})
+    require.Error(t, err)
+
+    _, err = r.Add(Config{Name: "tiles"}, &mbtilestest.Source{})
+    require.Error(t, err)
+
+    _, err = r.Add(Config{Name: "a.b"}, &mbtilestest.Source{})
+    require.Error(t, err)
+
+    // the registry closes the sources it holds
+    require.NoError(t, r.Close())
+    require.True(t, s.Closed())
+    require.Empty(t, r.Names())
+}
+
+func TestRegistry_LoadDir(t *testing.T) {
+    dir, err := ioutil.TempDir("", "tileset-test")
+    require.NoError(t, err)
+    defer os.RemoveAll(dir)
+
+    createPackage(t, filepath.Join(dir, "OS-Zoomstack.mbtiles"), map[string]string{"format": "pbf"})
+    createPackage(t, filepath.Join(dir, "hillshade.MBTILES"), map[string]string{"format": "png"})
+    require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "readme.txt"), []byte("not a package"), 0644))
+    require.NoError(t, os.Mkdir(filepath.Join(dir, "sub.mbtiles"), 0755))
+
+    r := NewRegistry()
+    defer r.Close()
+
+    loaded, err := r.LoadDir(dir, Config{MaxAge: "24h"})
+    require.NoError(t, err)
+    require.Len(t, loaded, 2)
+    require.Equal(t, []string{"OS_Zoomstack", "hillshade"}, r.Names())
+    require.Equal(t, "24h0m0s", r.Get("hillshade").MaxAge.String())
+
+    // loading the same packages again clashes with the loaded names
+    _, err = r.LoadDir(dir, Config{})
+    require.Error(t, err)
+
+    _, err = r.LoadDir(filepath.Join(dir, "missing"), Config{})
+    require.Error(t, err)
+}
+
+func TestNameFromPath(t *testing.T) {
+    for path, name := range map[string]string{
+        "/data/OS-Zoomstack.mbtiles":    "OS_Zoomstack",
+        "zoomstack.mbtiles":             "zoomstack",
+        "/data/hill shade v2.1.mbtiles": "hill_shade_v2_1",
+        "/data/über.mbtiles":            "_ber",
+        "/data/no_extension":            "no_extension",
+    } {
+        require.Equal(t, name, NameFromPath(path), path)
+    }
+}
+
+func TestConfig_WithDefaults(t *testing.T) {
+    defaults := Config{
+        Scheme:       "xyz",
+        MaxAge:       "1h",
+        CacheSize:    "64m",
+        CacheZooms:   []ZoomConfig{{Minzoom: 0, Maxzoom: 5, Size: "8m"}},
+        CacheTTL:     "10m",
+        FetchTimeout: "2s",
+        ReadConns:    4,
+        Mutable:      true,
+    }
+
+    // unset options are taken from the defaults
+    c := Config{Name: "a", Path: "a.mbtiles"}.WithDefaults(defaults)
+    require.Equal(t, "a", c.Name)
+    require.Equal(t, "a.mbtiles", c.Path)
+    require.Equal(t, "xyz", c.Scheme)
+    require.Equal(t, "1h", c.MaxAge)
+    require.Equal(t, "64m", c.CacheSize)
+    require.Equal(t, defaults.CacheZooms, c.CacheZooms)
+    require.Equal(t, "10m", c.CacheTTL)
+    require.Equal(t, "2s", c.FetchTimeout)
+    require.Equal(t, 4, c.ReadConns)
+    require.True(t, c.Mutable)
+
+    // set options are kept, an empty list of zoom bands turns off the default bands
+    c = Config{Scheme: "tms", MaxAge: "5m", CacheZooms: []ZoomConfig{}, ReadConns: 1}.WithDefaults(defaults)
+    require.Equal(t, "tms", c.Scheme)
+    require.Equal(t, "5m", c.MaxAge)
+    require.Empty(t, c.CacheZooms)
+    require.NotNil(t, c.CacheZooms)
+    require.Equal(t, 1, c.ReadConns)
+}
+
+func TestRegistry_Scheme(t *testing.T) {
+    dir, err := ioutil.TempDir("", "tileset-test")
+    require.NoError(t, err)
+    defer os.RemoveAll(dir)
+
+    tms := createPackage(t, filepath.Join(dir, "tms.mbtiles"), map[string]string{"format": "pbf"})
+    xyz := createPackage(t, filepath.Join(dir, "xyz.mbtiles"), map[string]string{"format": "pbf", "scheme": "xyz"})
+
+    r := NewRegistry()
+    defer r.Close()
+
+    // packages are TMS unless the metadata says otherwise, the config overrides both
+    for _, c := range []struct {
+        config Config
+        scheme mbtiles.Scheme
+    }{
+        {Config{Name: "a", Path: tms}, mbtiles.TMS},
+        {Config{Name: "b", Path: xyz}, mbtiles.XYZ},
+        {Config{Name: "c", Path: tms, Scheme: "xyz"}, mbtiles.XYZ},
+        {Config{Name: "d", Path: xyz, Scheme: "tms"}, mbtiles.TMS},
+    } {
+        ts, err := r.Load(c.config)
+        require.NoError(t, err)
+        require.Equal(t, c.scheme, ts.Scheme, c.config.Name)
+    }
+
+    _, err = r.Load(Config{Name: "e", Path: tms, Scheme: "google"})
+    require.Error(t, err)
+
+    // the row is only flipped when the requested scheme differs from the stored scheme
+    require.Equal(t, 3, r.Get("a").Row(0, 2, mbtiles.XYZ))
+    require.Equal(t, 0, r.Get("a").Row(0, 2, mbtiles.TMS))
+    require.Equal(t, 0, r.Get("b").Row(0, 2, mbtiles.XYZ))
+    require.Equal(t, 3, r.Get("b").Row(0, 2, mbtiles.TMS))
+}
@@ -0,0 +1,195 @@
+package tileset
+
+import (
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "osdata/osvtile/mbtiles"
+    "path/filepath"
+    "regexp"
+    "strings"
+    "time"
+)
+
+// valid tileset names - this must match the `{name}` route variable used by the web handlers
+var validName = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// Config describes a single tileset to be loaded into a registry. The scheme, if set, overrides the scheme given in
+// the package metadata. The max age is a duration such as `24h` which sets how long clients may cache the tiles.
+type Config struct {
+    Name   string `json:"name"`
+    Path   string `json:"path"`
+    Scheme string `json:"scheme,omitempty"`
+    MaxAge string `json:"maxAge,omitempty"`
+    // CacheSize reserves part of the tile cache for the tileset, e.g. `128m`
+    CacheSize string `json:"cacheSize,omitempty"`
+    // CacheZooms reserves parts of the tile cache for bands of zoom levels, separate to the cache size
+    CacheZooms []ZoomConfig `json:"cacheZooms,omitempty"`
+    // CacheTTL is how long tiles stay in the tile cache and disk tier before being fetched again, e.g. `1h`
+    CacheTTL string `json:"cacheTTL,omitempty"`
+    // FetchTimeout is the deadline for each fetch of a tile from the package, e.g. `2s`
+    FetchTimeout string `json:"fetchTimeout,omitempty"`
+    // ReadConns is the number of connections reading the package at once, zero for the default
+    ReadConns int `json:"readConns,omitempty"`
+    // MmapSize is how much of the package each connection reads through a memory map, e.g. `1g`
+    MmapSize string `json:"mmapSize,omitempty"`
+    // PageCache is the size of the SQLite page cache of each connection, e.g. `16m`
+    PageCache string `json:"pageCache,omitempty"`
+    // Mutable opens the package in normal read-only mode, for packages which may be modified while served
+    Mutable bool `json:"mutable,omitempty"`
+    // Preload reads the whole package into memory when loaded, rather than reading tiles from it as requested
+    Preload bool `json:"preload,omitempty"`
+    // PreloadLimit is the most tile data a preloaded package may hold, identical tiles counted once, e.g. `1g`
+    PreloadLimit string `json:"preloadLimit,omitempty"`
+}
+
+// ZoomConfig reserves part of the tile cache for a band of zoom levels. Tiles in a pinned band are never evicted.
+type ZoomConfig struct {
+    Minzoom int    `json:"minzoom"`
+    Maxzoom int    `json:"maxzoom"`
+    Size    string `json:"size"`
+    Pinned  bool   `json:"pinned,omitempty"`
+}
+
+// ZoomBudget is the parsed form of a zoom band config
+type ZoomBudget struct {
+    Minzoom int
+    Maxzoom int
+    Size    int64
+    Pinned  bool
+}
+
+// budgetPrefix starts the names of the cache budgets of tilesets, so a tileset named `default` has a budget apart from
+// the default budget of the cache
+const budgetPrefix = "tileset:"
+
+// Name reports the name of the band's cache budget within the given tileset
+func (z ZoomBudget) Name(tileset string) string {
+    return fmt.Sprintf("%s%s/z%d-%d", budgetPrefix, tileset, z.Minzoom, z.Maxzoom)
+}
+
+// WithDefaults returns a copy of the config with any unset options taken from the defaults
+func (c Config) WithDefaults(defaults Config) Config {
+    if c.Scheme == "" {
+        c.Scheme = defaults.Scheme
+    }
+
+    if c.MaxAge == "" {
+        c.MaxAge = defaults.MaxAge
+    }
+
+    if c.CacheSize == "" {
+        c.CacheSize = defaults.CacheSize
+    }
+
+    if c.CacheZooms == nil {
+        c.CacheZooms = defaults.CacheZooms
+    }
+
+    if c.CacheTTL == "" {
+        c.CacheTTL = defaults.CacheTTL
+    }
+
+    if c.FetchTimeout == "" {
+        c.FetchTimeout = defaults.FetchTimeout
+    }
+
+    if c.ReadConns == 0 {
+        c.ReadConns = defaults.ReadConns
+    }
+
+    if c.MmapSize == "" {
+        c.MmapSize = defaults.MmapSize
+    }
+
+    if c.PageCache == "" {
+        c.PageCache = defaults.PageCache
+    }
+
+    c.Mutable = c.Mutable || defaults.Mutable
+    c.Preload = c.Preload || defaults.Preload
+
+    if c.PreloadLimit == "" {
+        c.PreloadLimit = defaults.PreloadLimit
+    }
+
+    return c
+}
+
+// Tileset is a named tile source along with the version information read when it was added. The path is empty for
+// sources that do not come from an MBTiles file.
+type Tileset struct {
+    Name    string
+    Path    string
+    Source  mbtiles.TileSource
+    Version *mbtiles.Version
+    // Scheme is the row numbering of the stored tiles
+    Scheme mbtiles.Scheme
+    // ModTime is when the underlying package was last modified, zero if not known
+    ModTime time.Time
+    // Size is the byte size of the underlying package, zero if not known
+    Size int64
+    // MaxAge is how long clients may cache tiles for, zero to leave caching to the client
+    MaxAge time.Duration
+    // CacheSize is the tile cache reserved for the tileset, zero to share the default cache
+    CacheSize int64
+    // CacheZooms are the tile cache reservations for bands of zoom levels
+    CacheZooms []ZoomBudget
+    // CacheTTL is how long tiles stay in the tile cache, zero to keep them until evicted
+    CacheTTL time.Duration
+    // FetchTimeout is the deadline for each fetch from the source, zero for no deadline
+    FetchTimeout time.Duration
+}
+
+// BudgetName reports the name of the tileset's cache budget, e.g. `tileset:zoomstack`
+func (t *Tileset) BudgetName() string {
+    return budgetPrefix + t.Name
+}
+
+// Row converts a tile row given in the requested scheme to the row stored in the tileset
+func (t *Tileset) Row(y, z int, requested mbtiles.Scheme) int {
+    if requested == t.Scheme {
+        return y
+    }
+
+    return mbtiles.FlipY(y, z)
+}
+
+func (t *Tileset) String() string {
+    return fmt.Sprintf("tileset: {name = %s, path = %s}", t.Name, t.Path)
+}
+
+// ReadConfig will load the list of tilesets from a JSON config file of the form:
+//
+//  {"tilesets": [{"name": "zoomstack", "path": "/data/zoomstack.mbtiles"}]}
+func ReadConfig(path string) ([]Config, error) {
+    data, err := ioutil.ReadFile(path)
+
+    if err != nil {
+        return nil, err
+    }
+
+    file := struct {
+        Tilesets []Config `json:"tilesets"`
+    }{}
+
+    if err := json.Unmarshal(data, &file); err != nil {
+        return nil, fmt.Errorf("failed to parse tileset config: path = %s, error = %s", path, err)
+    }
+
+    return file.Tilesets, nil
+}
+
+// NameFromPath derives a tileset name from the MBTiles file name, e.g. `/data/OS-Zoomstack.mbtiles` becomes
+// `OS_Zoomstack`. Any characters not allowed in a tileset name are replaced with an underscore.
+func NameFromPath(path string) string {
+    base := filepath.Base(path)
+    base = strings.TrimSuffix(base, filepath.Ext(base))
+
+    return strings.Map(func(r rune) rune {
+        if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' {
+            return r
+        }
+        return '_'
+    }, base)
+}
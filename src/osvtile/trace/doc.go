@@ -0,0 +1,2 @@
+// Package trace holds the request ID and W3C trace context of a request, carried in its context and added to the logs
+package trace
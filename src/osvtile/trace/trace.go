@@ -0,0 +1,116 @@
+package trace
+
+import (
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "fmt"
+    "log"
+    "regexp"
+    "strings"
+    "time"
+)
+
+var (
+    // valid request IDs taken from a client, anything else is replaced to keep the logs clean
+    validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:\-]{1,128}$`)
+    // the version, trace ID, parent ID and flags of a traceparent header
+    validTraceparent = regexp.MustCompile(`^([0-9a-f]{2})-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})(-.*)?$`)
+)
+
+// Traceparent is a W3C trace context `traceparent` header, see https://www.w3.org/TR/trace-context/
+type Traceparent struct {
+    Version  string
+    TraceID  string
+    ParentID string
+    Flags    string
+}
+
+// String encodes the traceparent as a header value
+func (t *Traceparent) String() string {
+    return fmt.Sprintf("%s-%s-%s-%s", t.Version, t.TraceID, t.ParentID, t.Flags)
+}
+
+// ParseTraceparent decodes a traceparent header. Versions later than `00` may have extra fields, which are ignored.
+func ParseTraceparent(value string) (*Traceparent, error) {
+    m := validTraceparent.FindStringSubmatch(strings.TrimSpace(value))
+
+    if m == nil || m[1] == "ff" || (m[1] == "00" && m[5] != "") {
+        return nil, fmt.Errorf("invalid traceparent: value = %s", value)
+    }
+
+    if m[2] == strings.Repeat("0", 32) || m[3] == strings.Repeat("0", 16) {
+        return nil, fmt.Errorf("invalid traceparent, zero id: value = %s", value)
+    }
+
+    return &Traceparent{Version: m[1], TraceID: m[2], ParentID: m[3], Flags: m[4]}, nil
+}
+
+// Trace identifies a request in the logs, the parent is nil if the client did not send a valid traceparent
+type Trace struct {
+    RequestID string
+    Parent    *Traceparent
+}
+
+// TraceID reports the trace ID of the parent, or an empty string if there is no parent
+func (t *Trace) TraceID() string {
+    if t.Parent == nil {
+        return ""
+    }
+
+    return t.Parent.TraceID
+}
+
+// ValidRequestID checks if a request ID given by a client can be used as is
+func ValidRequestID(id string) bool {
+    return validRequestID.MatchString(id)
+}
+
+// NewRequestID generates a random request ID of 32 hex characters
+func NewRequestID() string {
+    b := make([]byte, 16)
+
+    if _, err := rand.Read(b); err != nil {
+        // only fails if the system has no source of randomness, the time is unique enough for the logs
+        return fmt.Sprintf("%032x", time.Now().UnixNano())
+    }
+
+    return hex.EncodeToString(b)
+}
+
+type contextKey int
+
+const traceKey contextKey = 0
+
+// NewContext returns a copy of the context carrying the trace
+func NewContext(ctx context.Context, t *Trace) context.Context {
+    return context.WithValue(ctx, traceKey, t)
+}
+
+// FromContext returns the trace carried by the context, or nil if there is none
+func FromContext(ctx context.Context) *Trace {
+    if ctx == nil {
+        return nil
+    }
+
+    t, _ := ctx.Value(traceKey).(*Trace)
+
+    return t
+}
+
+// Printf logs as `log.Printf`, adding the request and trace IDs from the context to the end of the line
+func Printf(ctx context.Context, format string, v ...interface{}) {
+    t := FromContext(ctx)
+
+    if t == nil {
+        log.Printf(format, v...)
+        return
+    }
+
+    if t.Parent == nil {
+        log.Printf(format+", requestId = %s", append(v, t.RequestID)...)
+        return
+    }
+
+    log.Printf(format+", requestId = %s, traceId = %s", append(v, t.RequestID, t.Parent.TraceID)...)
+}
@@ -0,0 +1,71 @@
+package trace
+
+import (
+    "bytes"
+    "context"
+    "github.com/stretchr/testify/require"
+    "log"
+    "os"
+    "strings"
+    "testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+    p, err := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+    require.NoError(t, err)
+    require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", p.TraceID)
+    require.Equal(t, "00f067aa0ba902b7", p.ParentID)
+    require.Equal(t, "01", p.Flags)
+    require.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", p.String())
+
+    // later versions may add fields
+    p, err = ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra")
+    require.NoError(t, err)
+    require.Equal(t, "01", p.Version)
+
+    for _, value := range []string{
+        "",
+        "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+        "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+        "00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+        "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+        "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+        "00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01",
+    } {
+        _, err := ParseTraceparent(value)
+        require.Error(t, err, value)
+    }
+}
+
+func TestRequestID(t *testing.T) {
+    id := NewRequestID()
+    require.Len(t, id, 32)
+    require.NotEqual(t, id, NewRequestID())
+    require.True(t, ValidRequestID(id))
+
+    require.True(t, ValidRequestID("f0e1-d2c3.b4:a5_96"))
+    require.False(t, ValidRequestID(""))
+    require.False(t, ValidRequestID("abc def"))
+    require.False(t, ValidRequestID("abc\ndef"))
+    require.False(t, ValidRequestID(strings.Repeat("a", 129)))
+}
+
+func TestPrintf(t *testing.T) {
+    b := &bytes.Buffer{}
+    log.SetOutput(b)
+    defer log.SetOutput(os.Stderr)
+
+    Printf(context.Background(), "no trace: key = %s", "a")
+    require.True(t, strings.HasSuffix(b.String(), "no trace: key = a\n"))
+
+    b.Reset()
+    ctx := NewContext(context.Background(), &Trace{RequestID: "abc"})
+    Printf(ctx, "request: key = %s", "a")
+    require.True(t, strings.HasSuffix(b.String(), "request: key = a, requestId = abc\n"))
+
+    b.Reset()
+    parent, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+    ctx = NewContext(context.Background(), &Trace{RequestID: "abc", Parent: parent})
+    Printf(ctx, "traced: key = %s", "a")
+    require.True(t, strings.HasSuffix(b.String(), "traced: key = a, requestId = abc, traceId = 4bf92f3577b34da6a3ce929d0e0e4736\n"))
+}
@@ -0,0 +1,329 @@
+package web
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net"
+    "strings"
+    "sync"
+    "time"
+)
+
+// access log formats
+const (
+    // AccessLogJSON writes a JSON object per request
+    AccessLogJSON = "json"
+    // AccessLogCombined writes the Apache combined log format, followed by the optional fields as `name=value` pairs
+    AccessLogCombined = "combined"
+    // AccessLogLegacy writes the original free-text request lines
+    AccessLogLegacy = "legacy"
+)
+
+// AccessFields selects the optional fields written to the access log
+type AccessFields uint
+
+const (
+    FieldRequestID AccessFields = 1 << iota
+    FieldTraceID
+    FieldTileset
+    FieldTile
+    FieldCache
+    FieldBytes
+    FieldFetchTime
+    // FieldsAll selects every optional field
+    FieldsAll = FieldRequestID | FieldTraceID | FieldTileset | FieldTile | FieldCache | FieldBytes | FieldFetchTime
+)
+
+// names of the optional fields, as used in the JSON format and `ParseAccessFields`
+var accessFieldNames = []struct {
+    name  string
+    field AccessFields
+}{
+    {"requestId", FieldRequestID},
+    {"traceId", FieldTraceID},
+    {"tileset", FieldTileset},
+    {"tile", FieldTile},
+    {"cache", FieldCache},
+    {"bytes", FieldBytes},
+    {"fetchTime", FieldFetchTime},
+}
+
+// ParseAccessFields parses a comma separated list of the optional field names, or `all` for every field
+func ParseAccessFields(s string) (AccessFields, error) {
+    var fields AccessFields
+
+    for _, name := range strings.Split(s, ",") {
+        name = strings.TrimSpace(name)
+
+        if name == "" {
+            continue
+        }
+
+        if name == "all" {
+            fields |= FieldsAll
+            continue
+        }
+
+        found := false
+
+        for _, f := range accessFieldNames {
+            if strings.EqualFold(name, f.name) {
+                fields |= f.field
+                found = true
+            }
+        }
+
+        if !found {
+            return 0, fmt.Errorf("unknown access log field: field = %s", name)
+        }
+    }
+
+    return fields, nil
+}
+
+// AccessEntry is a handled request, as written to the access log. The tile fields are only set for tile requests,
+// with the tile coordinates as requested.
+type AccessEntry struct {
+    Start      time.Time
+    Duration   time.Duration
+    RemoteAddr string
+    Method     string
+    URI        string
+    Proto      string
+    Referer    string
+    UserAgent  string
+    Status     int
+    Bytes      int
+    RequestID  string
+    // TraceID is from the W3C traceparent sent by the client, if any
+    TraceID string
+    Tileset string
+    Z, X, Y int
+    // Cache reports how the tile was resolved, e.g. `hit` or `miss`
+    Cache string
+    // FetchTime is how long the tile took to load from the tile source, zero if it was not loaded
+    FetchTime time.Duration
+}
+
+// AccessLogger writes the access log entry for each handled request
+type AccessLogger interface {
+    Log(e *AccessEntry)
+}
+
+// accessLogger formats each entry as a line, written to the output in a single write
+type accessLogger struct {
+    mu     *sync.Mutex
+    out    io.Writer
+    fields AccessFields
+    format func(b *bytes.Buffer, e *AccessEntry, fields AccessFields)
+}
+
+func (l *accessLogger) Log(e *AccessEntry) {
+    b := &bytes.Buffer{}
+    l.format(b, e, l.fields)
+    b.WriteByte('\n')
+
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    _, _ = l.out.Write(b.Bytes())
+}
+
+// formatLegacy writes the original request line, with the timestamp prefix of the standard logger, followed by any
+// optional fields in the same style
+func formatLegacy(b *bytes.Buffer, e *AccessEntry, fields AccessFields) {
+    start := e.Start.UnixNano()
+
+    b.WriteString(time.Now().Format("2006/01/02 15:04:05 "))
+    fmt.Fprintf(
+        b, "Request handled: addr: %s, method: %s, uri:%s, userAgent: %s, startTime: %d, deltaTime: %d, status:%d",
+        e.RemoteAddr, e.Method, e.URI, e.UserAgent, start/1000, e.Duration.Nanoseconds()/1000, e.Status,
+    )
+
+    if fields&FieldRequestID != 0 && e.RequestID != "" {
+        fmt.Fprintf(b, ", requestId: %s", e.RequestID)
+    }
+
+    if fields&FieldTraceID != 0 && e.TraceID != "" {
+        fmt.Fprintf(b, ", traceId: %s", e.TraceID)
+    }
+
+    if e.Tileset != "" {
+        if fields&FieldTileset != 0 {
+            fmt.Fprintf(b, ", tileset: %s", e.Tileset)
+        }
+
+        if fields&FieldTile != 0 {
+            fmt.Fprintf(b, ", tile: %d/%d/%d", e.Z, e.X, e.Y)
+        }
+
+        if fields&FieldCache != 0 && e.Cache != "" {
+            fmt.Fprintf(b, ", cache: %s", e.Cache)
+        }
+    }
+
+    if fields&FieldBytes != 0 {
+        fmt.Fprintf(b, ", bytes: %d", e.Bytes)
+    }
+
+    if fields&FieldFetchTime != 0 && e.FetchTime > 0 {
+        fmt.Fprintf(b, ", fetchTime: %d", e.FetchTime.Nanoseconds()/1000)
+    }
+}
+
+// formatCombined writes the Apache combined log format, the optional fields follow as `name=value` pairs. The bytes
+// written are always included as part of the combined format.
+func formatCombined(b *bytes.Buffer, e *AccessEntry, fields AccessFields) {
+    host, _, err := net.SplitHostPort(e.RemoteAddr)
+
+    if err != nil {
+        host = e.RemoteAddr
+    }
+
+    size := "-"
+
+    if e.Bytes > 0 {
+        size = fmt.Sprintf("%d", e.Bytes)
+    }
+
+    fmt.Fprintf(
+        b, `%s - - [%s] "%s %s %s" %d %s "%s" "%s"`,
+        orDash(host), e.Start.Format("02/Jan/2006:15:04:05 -0700"), e.Method, e.URI, e.Proto, e.Status, size,
+        orDash(e.Referer), orDash(e.UserAgent),
+    )
+
+    if fields&FieldRequestID != 0 && e.RequestID != "" {
+        fmt.Fprintf(b, " requestId=%s", e.RequestID)
+    }
+
+    if fields&FieldTraceID != 0 && e.TraceID != "" {
+        fmt.Fprintf(b, " traceId=%s", e.TraceID)
+    }
+
+    if e.Tileset != "" {
+        if fields&FieldTileset != 0 {
+            fmt.Fprintf(b, " tileset=%s", e.Tileset)
+        }
+
+        if fields&FieldTile != 0 {
+            fmt.Fprintf(b, " tile=%d/%d/%d", e.Z, e.X, e.Y)
+        }
+
+        if fields&FieldCache != 0 && e.Cache != "" {
+            fmt.Fprintf(b, " cache=%s", e.Cache)
+        }
+    }
+
+    if fields&FieldFetchTime != 0 && e.FetchTime > 0 {
+        fmt.Fprintf(b, " fetchTime=%.3fms", e.FetchTime.Seconds()*1000)
+    }
+}
+
+func orDash(s string) string {
+    if s == "" {
+        return "-"
+    }
+
+    return strings.Replace(s, `"`, `\"`, -1)
+}
+
+// jsonTile is the tile coordinates in a JSON log entry
+type jsonTile struct {
+    Z int `json:"z"`
+    X int `json:"x"`
+    Y int `json:"y"`
+}
+
+// jsonEntry is the JSON log entry, with the durations in milliseconds
+type jsonEntry struct {
+    Time       string    `json:"time"`
+    RemoteAddr string    `json:"remoteAddr"`
+    Method     string    `json:"method"`
+    URI        string    `json:"uri"`
+    Proto      string    `json:"proto"`
+    Status     int       `json:"status"`
+    Duration   float64   `json:"durationMs"`
+    Referer    string    `json:"referer,omitempty"`
+    UserAgent  string    `json:"userAgent,omitempty"`
+    RequestID  string    `json:"requestId,omitempty"`
+    TraceID    string    `json:"traceId,omitempty"`
+    Tileset    string    `json:"tileset,omitempty"`
+    Tile       *jsonTile `json:"tile,omitempty"`
+    Cache      string    `json:"cache,omitempty"`
+    Bytes      *int      `json:"bytes,omitempty"`
+    FetchTime  float64   `json:"fetchTimeMs,omitempty"`
+}
+
+// formatJSON writes the entry as a single line JSON object
+func formatJSON(b *bytes.Buffer, e *AccessEntry, fields AccessFields) {
+    j := &jsonEntry{
+        Time:       e.Start.UTC().Format(time.RFC3339Nano),
+        RemoteAddr: e.RemoteAddr,
+        Method:     e.Method,
+        URI:        e.URI,
+        Proto:      e.Proto,
+        Status:     e.Status,
+        Duration:   e.Duration.Seconds() * 1000,
+        Referer:    e.Referer,
+        UserAgent:  e.UserAgent,
+    }
+
+    if fields&FieldRequestID != 0 {
+        j.RequestID = e.RequestID
+    }
+
+    if fields&FieldTraceID != 0 {
+        j.TraceID = e.TraceID
+    }
+
+    if e.Tileset != "" {
+        if fields&FieldTileset != 0 {
+            j.Tileset = e.Tileset
+        }
+
+        if fields&FieldTile != 0 {
+            j.Tile = &jsonTile{Z: e.Z, X: e.X, Y: e.Y}
+        }
+
+        if fields&FieldCache != 0 {
+            j.Cache = e.Cache
+        }
+    }
+
+    if fields&FieldBytes != 0 {
+        j.Bytes = &e.Bytes
+    }
+
+    if fields&FieldFetchTime != 0 {
+        j.FetchTime = e.FetchTime.Seconds() * 1000
+    }
+
+    // the entry only holds strings and numbers, so cannot fail to encode
+    data, _ := json.Marshal(j)
+    b.Write(data)
+}
+
+// NewAccessLogger creates an access logger writing the given format and optional fields to the output. An unknown
+// format is an error.
+func NewAccessLogger(out io.Writer, format string, fields AccessFields) (AccessLogger, error) {
+    l := &accessLogger{
+        mu:     &sync.Mutex{},
+        out:    out,
+        fields: fields,
+    }
+
+    switch format {
+    case AccessLogJSON:
+        l.format = formatJSON
+    case AccessLogCombined:
+        l.format = formatCombined
+    case AccessLogLegacy:
+        l.format = formatLegacy
+    default:
+        return nil, fmt.Errorf("unknown access log format: format = %s", format)
+    }
+
+    return l, nil
+}
@@ -0,0 +1,108 @@
+package web
+
+import (
+    "bytes"
+    "encoding/json"
+    "github.com/stretchr/testify/require"
+    "strings"
+    "testing"
+    "time"
+)
+
+// entry is a tile request served from the tile source
+func entry() *AccessEntry {
+    return &AccessEntry{
+        Start:      time.Date(2020, 2, 1, 12, 30, 45, 0, time.UTC),
+        Duration:   1500 * time.Microsecond,
+        RemoteAddr: "10.0.0.1:51234",
+        Method:     "GET",
+        URI:        "/zoomstack/14/8100/5400/tile.mvt",
+        Proto:      "HTTP/1.1",
+        UserAgent:  "test",
+        Status:     200,
+        Bytes:      2048,
+        RequestID:  "abc123",
+        Tileset:    "zoomstack",
+        Z:          14,
+        X:          8100,
+        Y:          5400,
+        Cache:      CacheMiss,
+        FetchTime:  500 * time.Microsecond,
+    }
+}
+
+func TestParseAccessFields(t *testing.T) {
+    fields, err := ParseAccessFields("")
+    require.NoError(t, err)
+    require.Equal(t, AccessFields(0), fields)
+
+    fields, err = ParseAccessFields("tileset, cache")
+    require.NoError(t, err)
+    require.Equal(t, FieldTileset|FieldCache, fields)
+
+    fields, err = ParseAccessFields("all")
+    require.NoError(t, err)
+    require.Equal(t, FieldsAll, fields)
+
+    _, err = ParseAccessFields("tileset,colour")
+    require.Error(t, err)
+}
+
+func TestAccessLogger_JSON(t *testing.T) {
+    b := &bytes.Buffer{}
+    logger, err := NewAccessLogger(b, AccessLogJSON, FieldsAll)
+    require.NoError(t, err)
+
+    logger.Log(entry())
+    require.True(t, strings.HasSuffix(b.String(), "}\n"))
+
+    logged := map[string]interface{}{}
+    require.NoError(t, json.Unmarshal(b.Bytes(), &logged))
+    require.Equal(t, "2020-02-01T12:30:45Z", logged["time"])
+    require.Equal(t, 1.5, logged["durationMs"])
+    require.Equal(t, "abc123", logged["requestId"])
+    require.Equal(t, map[string]interface{}{"z": 14.0, "x": 8100.0, "y": 5400.0}, logged["tile"])
+    require.Equal(t, "miss", logged["cache"])
+    require.Equal(t, 2048.0, logged["bytes"])
+    require.Equal(t, 0.5, logged["fetchTimeMs"])
+
+    // only the selected optional fields are written
+    b.Reset()
+    logger, _ = NewAccessLogger(b, AccessLogJSON, FieldTileset)
+    logger.Log(entry())
+
+    logged = map[string]interface{}{}
+    require.NoError(t, json.Unmarshal(b.Bytes(), &logged))
+    require.Equal(t, "zoomstack", logged["tileset"])
+    require.NotContains(t, logged, "requestId")
+    require.NotContains(t, logged, "tile")
+    require.NotContains(t, logged, "bytes")
+}
+
+func TestAccessLogger_Combined(t *testing.T) {
+    b := &bytes.Buffer{}
+    logger, err := NewAccessLogger(b, AccessLogCombined, FieldRequestID|FieldTile|FieldCache)
+    require.NoError(t, err)
+
+    logger.Log(entry())
+    require.Equal(t,
+        `10.0.0.1 - - [01/Feb/2020:12:30:45 +0000] "GET /zoomstack/14/8100/5400/tile.mvt HTTP/1.1" 200 2048 "-" "test"`+
+            " requestId=abc123 tile=14/8100/5400 cache=miss\n",
+        b.String(),
+    )
+}
+
+func TestAccessLogger_Legacy(t *testing.T) {
+    b := &bytes.Buffer{}
+    logger, err := NewAccessLogger(b, AccessLogLegacy, 0)
+    require.NoError(t, err)
+
+    logger.Log(entry())
+    require.True(t, strings.HasSuffix(b.String(),
+        "Request handled: addr: 10.0.0.1:51234, method: GET, uri:/zoomstack/14/8100/5400/tile.mvt, userAgent: test, "+
+            "startTime: 1580560245000000, deltaTime: 1500, status:200\n",
+    ))
+
+    _, err = NewAccessLogger(b, "common", 0)
+    require.Error(t, err)
+}
@@ -0,0 +1,109 @@
+package web
+
+import (
+    "context"
+    "crypto/subtle"
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "net/http"
+    "osdata/osvtile/tile"
+    "osdata/osvtile/trace"
+    "strconv"
+    "strings"
+)
+
+// maxFilterSize limits the size of a tile filter in a request body
+const maxFilterSize = 64 * 1024
+
+// PurgeResponse reports the cache entries freed by a purge, from memory and the disk tier
+type PurgeResponse struct {
+    Entries     int   `json:"entries"`
+    Bytes       int64 `json:"bytes"`
+    DiskEntries int   `json:"diskEntries"`
+    DiskBytes   int64 `json:"diskBytes"`
+}
+
+// NewAdminHandler wraps the admin handlers, rejecting any request which does not carry the bearer token
+func NewAdminHandler(token string, h http.Handler) http.Handler {
+    expected := []byte("Bearer " + token)
+
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        auth := []byte(r.Header.Get("Authorization"))
+
+        if subtle.ConstantTimeCompare(auth, expected) != 1 {
+            w.Header().Set("WWW-Authenticate", `Bearer realm="osvtiled"`)
+            writeError(r.Context(), w, &Error{Code: http.StatusUnauthorized, Status: http.StatusUnauthorized, Message: "unauthorized"})
+            return
+        }
+
+        h.ServeHTTP(w, r)
+    })
+}
+
+// NewPurgeHandler purges tiles from the cache. The request body is an optional JSON filter, e.g.
+//
+//  {"tileset": "zoomstack", "minzoom": 10, "maxzoom": 14, "bbox": [-1.5, 50.8, -1.3, 51.0]}
+//
+// Omitted fields match every tile, so an empty body purges the whole cache.
+func NewPurgeHandler(tiles *TileFetcher) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        filter, err := readFilter(w, r)
+
+        if err != nil {
+            writeError(r.Context(), w, &Error{Code: http.StatusBadRequest, Status: http.StatusBadRequest, Message: err.Error()})
+            return
+        }
+
+        purged := tiles.Purge(*filter)
+        trace.Printf(r.Context(), "purged cache: filter = %+v, entries = %d, bytes = %d, disk entries = %d, disk bytes = %d",
+            *filter, purged.Entries, purged.Bytes, purged.DiskEntries, purged.DiskBytes)
+
+        writeJSON(r.Context(), w, http.StatusOK, purged)
+    }
+}
+
+// readFilter decodes and validates the tile filter in the request body
+func readFilter(w http.ResponseWriter, r *http.Request) (*tile.Filter, error) {
+    filter := &tile.Filter{}
+    body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxFilterSize))
+
+    if err != nil {
+        return nil, fmt.Errorf("failed to read request: error = %s", err)
+    }
+
+    if len(strings.TrimSpace(string(body))) > 0 {
+        if err := json.Unmarshal(body, filter); err != nil {
+            return nil, fmt.Errorf("invalid filter: error = %s", err)
+        }
+    }
+
+    if filter.Minzoom != nil && filter.Maxzoom != nil && *filter.Minzoom > *filter.Maxzoom {
+        return nil, fmt.Errorf("invalid filter, minzoom exceeds maxzoom")
+    }
+
+    if filter.BBox != nil {
+        if err := checkBBox(*filter.BBox); err != nil {
+            return nil, fmt.Errorf("invalid filter: error = %s", err)
+        }
+    }
+
+    return filter, nil
+}
+
+// writeJSON writes the value as a JSON response, logging any failure with the IDs of the request context
+func writeJSON(ctx context.Context, w http.ResponseWriter, status int, v interface{}) {
+    packet, _ := json.Marshal(v)
+    w.Header().Set("content-type", "application/json")
+    w.Header().Set("content-length", strconv.Itoa(len(packet)))
+    w.WriteHeader(status)
+
+    if _, err := w.Write(packet); err != nil {
+        trace.Printf(ctx, "failed to write response to client: error = %s", err)
+    }
+}
+
+// writeError writes the error as a JSON response
+func writeError(ctx context.Context, w http.ResponseWriter, e *Error) {
+    writeJSON(ctx, w, e.Status, e)
+}
@@ -0,0 +1,165 @@
+package web
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "github.com/gorilla/mux"
+    "github.com/stretchr/testify/require"
+    "log"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "osdata/osvtile/container/lru"
+    "osdata/osvtile/mbtiles/mbtilestest"
+    "osdata/osvtile/tile"
+    "osdata/osvtile/tileset"
+    "strings"
+    "testing"
+)
+
+func TestAdminHandler(t *testing.T) {
+    h := NewAdminHandler("secret", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.WriteHeader(http.StatusNoContent)
+    }))
+
+    for auth, status := range map[string]int{
+        "":               http.StatusUnauthorized,
+        "secret":         http.StatusUnauthorized,
+        "Bearer wrong":   http.StatusUnauthorized,
+        "Bearer secret ": http.StatusUnauthorized,
+        "Basic secret":   http.StatusUnauthorized,
+        "Bearer secret":  http.StatusNoContent,
+    } {
+        w := get(h, "/admin/cache/purge", "Authorization", auth)
+        require.Equal(t, status, w.Code, auth)
+
+        if status == http.StatusUnauthorized {
+            require.Equal(t, `Bearer realm="osvtiled"`, w.Header().Get("WWW-Authenticate"))
+            require.JSONEq(t, `{"code": 401, "message": "unauthorized"}`, w.Body.String())
+        }
+    }
+}
+
+func TestPurgeHandler(t *testing.T) {
+    cache := lru.New(1024*1024, lru.WithNamespaces(tile.Namespace))
+    tiles := NewTileFetcher(cache, nil, nil)
+    h := NewPurgeHandler(tiles)
+
+    // fill the cache with every tile up to zoom 2 of two tilesets, each tile holding its own key
+    fill := func() {
+        for _, name := range []string{"a", "b"} {
+            for z := 0; z <= 2; z++ {
+                for x := 0; x < 1<<uint(z); x++ {
+                    for y := 0; y < 1<<uint(z); y++ {
+                        key := tile.Key{Tileset: name, Format: "mvt", Z: z, X: x, Y: y}
+                        _, _, err := tiles.Fetch(context.Background(), key, func(ctx context.Context) ([]byte, error) {
+                            return []byte(key.String()), nil
+                        })
+                        require.NoError(t, err)
+                    }
+                }
+            }
+        }
+    }
+
+    purge := func(body string) (*httptest.ResponseRecorder, *PurgeResponse) {
+        w := httptest.NewRecorder()
+        h.ServeHTTP(w, httptest.NewRequest("POST", "/admin/cache/purge", strings.NewReader(body)))
+
+        purged := &PurgeResponse{}
+
+        if w.Code == http.StatusOK {
+            require.NoError(t, json.Unmarshal(w.Body.Bytes(), purged))
+        }
+
+        return w, purged
+    }
+
+    for _, c := range []struct {
+        filter  string
+        entries int
+    }{
+        {`{"tileset": "a"}`, 21},
+        {`{"minzoom": 1, "maxzoom": 1}`, 8},
+        {`{"tileset": "b", "minzoom": 2}`, 16},
+        // London is in columns 1 and 2, row 1 at zoom 2, and within the single tiles of zooms 0 and 1
+        {`{"tileset": "a", "bbox": [-0.5, 51.3, 0.3, 51.7]}`, 1 + 2 + 2},
+        {`{"tileset": "c"}`, 0},
+        {``, 42},
+    } {
+        fill()
+
+        w, purged := purge(c.filter)
+        require.Equal(t, http.StatusOK, w.Code, c.filter)
+        require.Equal(t, c.entries, purged.Entries, c.filter)
+        require.Equal(t, 42-c.entries, cache.Status().Elements, c.filter)
+
+        cache.Purge(func(key string) bool { return true })
+    }
+
+    // the bytes freed are the size of the purged tiles
+    fill()
+    _, purged := purge(`{"tileset": "a", "maxzoom": 0}`)
+    require.Equal(t, int64(len("a/mvt/0/0/0")), purged.Bytes)
+
+    for _, filter := range []string{
+        `{"minzoom": 5, "maxzoom": 2}`,
+        `{"bbox": [10, 10, 5, 5]}`,
+        `{"bbox": [-200, 0, 0, 10]}`,
+        `{"tileset": 1}`,
+        `not json`,
+        `{"tileset": "` + strings.Repeat("a", maxFilterSize) + `"}`,
+    } {
+        w, _ := purge(filter)
+        require.Equal(t, http.StatusBadRequest, w.Code, filter)
+    }
+}
+
+func TestAdminHandlers_Logging(t *testing.T) {
+    logs := &bytes.Buffer{}
+    log.SetOutput(logs)
+    defer log.SetOutput(os.Stderr)
+
+    tilesets := tileset.NewRegistry()
+    _, err := tilesets.Add(tileset.Config{Name: "fake"}, mbtilestest.NewSource("pbf"))
+    require.NoError(t, err)
+
+    tiles := NewTileFetcher(lru.New(1024*1024), nil, nil)
+    seeder := NewSeedHandler(tilesets, tiles, 0)
+
+    r := mux.NewRouter()
+    r.Handle("/admin/cache/purge", NewPurgeHandler(tiles))
+    r.Handle("/admin/cache/seed", seeder)
+    h := NewTraceHandler(r)
+
+    serve := func(path, body string) {
+        req := httptest.NewRequest("POST", path, strings.NewReader(body))
+        req.Header.Set("X-Request-ID", "admin-request")
+        req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+        w := httptest.NewRecorder()
+        h.ServeHTTP(w, req)
+        require.True(t, w.Code < 300, w.Body.String())
+    }
+
+    // the request and trace IDs end the log lines of the handlers, and of the seed job run for the request
+    serve("/admin/cache/purge", `{"tileset": "fake"}`)
+    serve("/admin/cache/seed", `{"tileset": "fake", "bbox": [-180, -85, 180, 85], "maxzoom": 1}`)
+
+    // waits for the job to finish logging
+    seeder.Cancel()
+
+    ids := ", requestId = admin-request, traceId = 4bf92f3577b34da6a3ce929d0e0e4736\n"
+
+    for _, prefix := range []string{"purged cache: ", "seeding tiles: ", "seeded tiles: "} {
+        line := ""
+
+        for _, l := range strings.SplitAfter(logs.String(), "\n") {
+            if strings.Contains(l, prefix) {
+                line = l
+            }
+        }
+
+        require.True(t, strings.HasSuffix(line, ids), "log line = %q", line)
+    }
+}
@@ -0,0 +1,92 @@
+package web
+
+import (
+    "fmt"
+    "osdata/osvtile/container/disk"
+    "osdata/osvtile/container/lru"
+    "osdata/osvtile/tile"
+    "osdata/osvtile/tileset"
+    "time"
+)
+
+// CacheBudgets builds the cache budgets reserved by the tilesets, along with the func that maps each cache key to its
+// budget. A tile goes to the budget of its zoom band if it has one, otherwise to the budget of its tileset, or else
+// the default budget.
+func CacheBudgets(tilesets *tileset.Registry) ([]lru.Budget, lru.BudgetFunc) {
+    var budgets []lru.Budget
+    sets := map[string]*tileset.Tileset{}
+
+    for _, name := range tilesets.Names() {
+        ts := tilesets.Get(name)
+
+        if ts.CacheSize == 0 && len(ts.CacheZooms) == 0 {
+            continue
+        }
+
+        sets[name] = ts
+
+        if ts.CacheSize > 0 {
+            budgets = append(budgets, lru.Budget{Name: ts.BudgetName(), MaxSize: ts.CacheSize})
+        }
+
+        for _, z := range ts.CacheZooms {
+            budgets = append(budgets, lru.Budget{Name: z.Name(name), MaxSize: z.Size, Pinned: z.Pinned})
+        }
+    }
+
+    return budgets, func(key string) string {
+        ts, ok := sets[tile.Namespace(key)]
+
+        if !ok {
+            return lru.DefaultBudget
+        }
+
+        if len(ts.CacheZooms) > 0 {
+            if k, err := tile.ParseKey(key); err == nil {
+                for _, z := range ts.CacheZooms {
+                    if k.Z >= z.Minzoom && k.Z <= z.Maxzoom {
+                        return z.Name(ts.Name)
+                    }
+                }
+            }
+        }
+
+        if ts.CacheSize > 0 {
+            return ts.BudgetName()
+        }
+
+        return lru.DefaultBudget
+    }
+}
+
+// CacheTTLs builds the func that maps each cache key to the cache TTL of its tileset
+func CacheTTLs(tilesets *tileset.Registry) lru.TTLFunc {
+    ttls := map[string]time.Duration{}
+
+    for _, name := range tilesets.Names() {
+        if ts := tilesets.Get(name); ts.CacheTTL > 0 {
+            ttls[name] = ts.CacheTTL
+        }
+    }
+
+    return func(key string) time.Duration {
+        return ttls[tile.Namespace(key)]
+    }
+}
+
+// DiskSources builds the func that stamps each disk cache key with the modified time and size of its tileset's
+// package, as the snapshots do, so tiles cached from a package that has since been replaced are not served. Tilesets
+// without a package file are not stamped.
+func DiskSources(tilesets *tileset.Registry) disk.SourceFunc {
+    stamps := map[string]string{}
+
+    for _, name := range tilesets.Names() {
+        if ts := tilesets.Get(name); !ts.ModTime.IsZero() {
+            stamps[name] = fmt.Sprintf("%d-%d", ts.ModTime.UnixNano(), ts.Size)
+        }
+    }
+
+    return func(key string) string {
+        return stamps[tile.Namespace(key)]
+    }
+}
@@ -0,0 +1,67 @@
+package web
+
+import (
+    "github.com/stretchr/testify/require"
+    "osdata/osvtile/container/lru"
+    "osdata/osvtile/mbtiles/mbtilestest"
+    "osdata/osvtile/tile"
+    "osdata/osvtile/tileset"
+    "testing"
+    "time"
+)
+
+func TestCacheBudgets(t *testing.T) {
+    tilesets := tileset.NewRegistry()
+    _, err := tilesets.Add(tileset.Config{Name: "default", CacheSize: "1k"}, mbtilestest.NewSource("pbf"))
+    require.NoError(t, err)
+    _, err = tilesets.Add(tileset.Config{Name: "zoomstack", CacheSize: "2k", CacheZooms: []tileset.ZoomConfig{
+        {Minzoom: 0, Maxzoom: 5, Size: "1k", Pinned: true},
+    }}, mbtilestest.NewSource("pbf"))
+    require.NoError(t, err)
+    _, err = tilesets.Add(tileset.Config{Name: "shared"}, mbtilestest.NewSource("pbf"))
+    require.NoError(t, err)
+
+    budgets, budget := CacheBudgets(tilesets)
+    require.Equal(t, []lru.Budget{
+        {Name: "tileset:default", MaxSize: 1024},
+        {Name: "tileset:zoomstack", MaxSize: 2048},
+        {Name: "tileset:zoomstack/z0-5", MaxSize: 1024, Pinned: true},
+    }, budgets)
+
+    key := func(name string, z int) string {
+        return tile.Key{Tileset: name, Format: "mvt", Z: z}.String()
+    }
+
+    // a tileset named default keeps to its own budget, apart from the default budget of the cache
+    require.Equal(t, "tileset:default", budget(key("default", 3)))
+    require.Equal(t, "tileset:zoomstack/z0-5", budget(key("zoomstack", 3)))
+    require.Equal(t, "tileset:zoomstack", budget(key("zoomstack", 10)))
+    require.Equal(t, lru.DefaultBudget, budget(key("shared", 3)))
+
+    cache := lru.New(8*1024, lru.WithBudgets(budget, budgets...))
+    status := cache.Status()
+    require.Len(t, status.Budgets, 4)
+    require.Equal(t, int64(4*1024), status.Budgets[lru.DefaultBudget].MaxSize)
+    require.Equal(t, int64(1024), status.Budgets["tileset:default"].MaxSize)
+}
+
+func TestDiskSources(t *testing.T) {
+    tilesets := tileset.NewRegistry()
+    ts, err := tilesets.Add(tileset.Config{Name: "packaged"}, mbtilestest.NewSource("pbf"))
+    require.NoError(t, err)
+    ts.ModTime, ts.Size = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), 1024
+    _, err = tilesets.Add(tileset.Config{Name: "memory"}, mbtilestest.NewSource("pbf"))
+    require.NoError(t, err)
+
+    source := DiskSources(tilesets)
+    stamp := source(tile.Key{Tileset: "packaged", Format: "mvt"}.String())
+    require.NotEmpty(t, stamp)
+    require.Equal(t, stamp, source(tile.Key{Tileset: "packaged", Format: "mvt", Z: 3}.String()))
+
+    // a replaced package has a new stamp
+    ts.Size = 2048
+    require.NotEqual(t, stamp, DiskSources(tilesets)(tile.Key{Tileset: "packaged", Format: "mvt"}.String()))
+
+    // tilesets without a package are not stamped
+    require.Empty(t, source(tile.Key{Tileset: "memory", Format: "mvt"}.String()))
+}
@@ -0,0 +1,66 @@
+package web
+
+import (
+    "fmt"
+    "net/http"
+    "osdata/osvtile/tileset"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// quoteETag wraps a tile hash as a strong entity tag
+func quoteETag(md5 string) string {
+    return fmt.Sprintf(`"%s"`, md5)
+}
+
+// etagMatch checks if the etag is listed in an If-None-Match header value. The weak comparison is used as
+// required for If-None-Match, so `W/"abc"` matches `"abc"`.
+func etagMatch(header, etag string) bool {
+    for _, candidate := range strings.Split(header, ",") {
+        candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+
+        if candidate == "*" || candidate == etag {
+            return true
+        }
+    }
+
+    return false
+}
+
+// notModified determines if the client already holds the current version of the tile. If-None-Match takes precedence
+// over If-Modified-Since, which is only considered when the modified time of the tileset is known.
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+    if inm := r.Header.Get("If-None-Match"); inm != "" {
+        return etagMatch(inm, etag)
+    }
+
+    ims := r.Header.Get("If-Modified-Since")
+
+    if ims == "" || modified.IsZero() {
+        return false
+    }
+
+    since, err := http.ParseTime(ims)
+
+    if err != nil {
+        return false
+    }
+
+    // http dates only have second precision
+    return !modified.Truncate(time.Second).After(since)
+}
+
+// setCacheHeaders adds the validators and client caching headers configured for the tileset
+func setCacheHeaders(h http.Header, ts *tileset.Tileset, etag string) {
+    h.Set("etag", etag)
+
+    if !ts.ModTime.IsZero() {
+        h.Set("last-modified", ts.ModTime.Format(http.TimeFormat))
+    }
+
+    if ts.MaxAge > 0 {
+        h.Set("cache-control", "public, max-age="+strconv.FormatInt(int64(ts.MaxAge/time.Second), 10))
+        h.Set("expires", time.Now().UTC().Add(ts.MaxAge).Format(http.TimeFormat))
+    }
+}
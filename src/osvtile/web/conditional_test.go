@@ -0,0 +1,79 @@
+package web
+
+import (
+    "github.com/stretchr/testify/require"
+    "net/http"
+    "osdata/osvtile/mbtiles/mbtilestest"
+    "osdata/osvtile/tileset"
+    "testing"
+    "time"
+)
+
+func TestServeTile_Conditional(t *testing.T) {
+    tilesets := tileset.NewRegistry()
+    ts, err := tilesets.Add(tileset.Config{Name: "cached", Scheme: "tms", MaxAge: "1h"}, mbtilestest.NewSource("pbf"))
+    require.NoError(t, err)
+    ts.ModTime = time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+    _, err = tilesets.Add(tileset.Config{Name: "uncached", Scheme: "tms"}, mbtilestest.NewSource("pbf"))
+    require.NoError(t, err)
+
+    r := newTileRouter(tilesets)
+    path := "/cached/0/0/0/tile.mvt"
+
+    // max-age and expires come from the tileset max age
+    w := get(r, path)
+    require.Equal(t, http.StatusOK, w.Code)
+    require.Equal(t, "tile", w.Body.String())
+    require.Equal(t, "public, max-age=3600", w.Header().Get("cache-control"))
+    require.Equal(t, "Sat, 01 Jun 2019 12:00:00 GMT", w.Header().Get("last-modified"))
+
+    expires, err := http.ParseTime(w.Header().Get("expires"))
+    require.NoError(t, err)
+    require.WithinDuration(t, time.Now().Add(time.Hour), expires, 5*time.Second)
+
+    etag := w.Header().Get("etag")
+    require.Regexp(t, `^"[0-9a-f]{32}"$`, etag)
+
+    modified := ts.ModTime.Format(http.TimeFormat)
+    before := ts.ModTime.Add(-time.Hour).Format(http.TimeFormat)
+
+    for _, c := range []struct {
+        name    string
+        headers []string
+        status  int
+    }{
+        {"strong", []string{"If-None-Match", etag}, http.StatusNotModified},
+        {"weak", []string{"If-None-Match", "W/" + etag}, http.StatusNotModified},
+        {"list", []string{"If-None-Match", `"other", W/"another",` + etag}, http.StatusNotModified},
+        {"any", []string{"If-None-Match", "*"}, http.StatusNotModified},
+        {"changed", []string{"If-None-Match", `"other"`}, http.StatusOK},
+        {"modified since", []string{"If-Modified-Since", before}, http.StatusOK},
+        {"not modified since", []string{"If-Modified-Since", modified}, http.StatusNotModified},
+        {"bad date", []string{"If-Modified-Since", "yesterday"}, http.StatusOK},
+        // If-None-Match takes precedence over If-Modified-Since
+        {"changed, not modified since", []string{"If-None-Match", `"other"`, "If-Modified-Since", modified}, http.StatusOK},
+        {"matched, modified since", []string{"If-None-Match", etag, "If-Modified-Since", before}, http.StatusNotModified},
+    } {
+        w := get(r, path, c.headers...)
+        require.Equal(t, c.status, w.Code, c.name)
+        require.Equal(t, etag, w.Header().Get("etag"), c.name)
+        require.Equal(t, "public, max-age=3600", w.Header().Get("cache-control"), c.name)
+
+        if c.status == http.StatusNotModified {
+            require.Empty(t, w.Body.Bytes(), c.name)
+            require.Empty(t, w.Header().Get("content-length"), c.name)
+            require.Empty(t, w.Header().Get("content-encoding"), c.name)
+        }
+    }
+
+    // no caching headers without a max age, and If-Modified-Since needs a known modified time
+    w = get(r, "/uncached/0/0/0/tile.mvt", "If-Modified-Since", modified)
+    require.Equal(t, http.StatusOK, w.Code)
+    require.Equal(t, etag, w.Header().Get("etag"))
+    require.Empty(t, w.Header().Get("cache-control"))
+    require.Empty(t, w.Header().Get("expires"))
+    require.Empty(t, w.Header().Get("last-modified"))
+
+    w = get(r, "/uncached/0/0/0/tile.mvt", "If-None-Match", etag)
+    require.Equal(t, http.StatusNotModified, w.Code)
+}
@@ -0,0 +1,233 @@
+package web
+
+import (
+    "context"
+    "crypto/md5"
+    "fmt"
+    "osdata/osvtile/container/disk"
+    "osdata/osvtile/container/lru"
+    "osdata/osvtile/tile"
+    "osdata/osvtile/trace"
+    "sync"
+    "time"
+)
+
+// FetcherStatus reports the state of the tile cache along with the number of coalesced requests and the disk tier
+// (if enabled)
+type FetcherStatus struct {
+    *lru.Status
+    Coalesced int64        `json:"coalesced"`
+    Disk      *disk.Status `json:"disk,omitempty"`
+}
+
+// TileFetcher resolves tiles through the cache, then the optional disk tier, falling back to the tile source on a
+// miss. Concurrent misses for the same key are coalesced into a single fetch. A fetch in flight when the cache is
+// purged still returns its tile to the callers, but does not store it - so a purge is never undone by a fetch which
+// started before it.
+type TileFetcher struct {
+    cache   lru.Cache
+    disk    *disk.Store
+    flight  *flight
+    metrics *Metrics
+    // held for writing by a purge, which bumps the generation, and for reading while a fetched tile is stored
+    purging    *sync.RWMutex
+    generation uint64
+}
+
+// how a fetch was resolved, as reported in the access log
+const (
+    // CacheHit is a tile found in the memory cache
+    CacheHit = "hit"
+    // CacheMiss is a tile fetched from the tile source
+    CacheMiss = "miss"
+    // CacheNegative is a tile known to be missing from the negative cache
+    CacheNegative = "negative"
+    // CacheDisk is a tile read from the disk tier
+    CacheDisk = "disk"
+    // CacheCoalesced is a tile shared from a fetch already in flight
+    CacheCoalesced = "coalesced"
+)
+
+// FetchFunc loads a tile from its source, or returns `nil,nil` if the tile does not exist. The context carries the
+// values of the caller which runs the fetch, and is cancelled once every caller waiting on the fetch has gone.
+type FetchFunc func(ctx context.Context) ([]byte, error)
+
+// Fetch returns the tile and its md5 hash for the key, using the fetch func to load the tile on a cache miss. A nil
+// tile is returned if the tile does not exist, missing tiles are remembered in the negative cache. The context error
+// is returned if the context is done before the tile is loaded.
+func (f *TileFetcher) Fetch(ctx context.Context, k tile.Key, fetch FetchFunc) ([]byte, string, error) {
+    tile, md5, _, err := f.fetch(ctx, k, fetch)
+    return tile, md5, err
+}
+
+// fetch is `Fetch`, also reporting how the tile was resolved
+func (f *TileFetcher) fetch(ctx context.Context, k tile.Key, fetch FetchFunc) ([]byte, string, string, error) {
+    key := k.String()
+
+    if tile, md5 := f.cache.Get(key); tile != nil {
+        return tile, md5, CacheHit, nil
+    }
+
+    if f.cache.Missing(key) {
+        return nil, "", CacheNegative, nil
+    }
+
+    // only set by the caller that runs the fetch, others share its result
+    result := CacheMiss
+
+    tile, md5, err, shared := f.flight.Do(ctx, key, func(ctx context.Context) ([]byte, string, error) {
+        gen := f.currentGeneration()
+
+        if e := f.fromDisk(ctx, key); e != nil {
+            result = CacheDisk
+            return e.Value, f.store(ctx, key, e.Value, gen, e), nil
+        }
+
+        if f.metrics != nil {
+            fetch = f.metrics.timeFetch(k.Tileset, fetch)
+        }
+
+        tile, err := fetch(ctx)
+
+        if err != nil {
+            return nil, "", err
+        }
+
+        return tile, f.store(ctx, key, tile, gen, nil), nil
+    })
+
+    if shared {
+        result = CacheCoalesced
+    }
+
+    return tile, md5, result, err
+}
+
+// currentGeneration reports the number of purges so far, taken before a fetch so its tile is only stored if the cache
+// has not been purged since
+func (f *TileFetcher) currentGeneration() uint64 {
+    f.purging.RLock()
+    defer f.purging.RUnlock()
+
+    return f.generation
+}
+
+// store caches the fetched tile, returning its md5 hash. A tile read from the disk tier is passed with its disk entry
+// and cached until the entry expires, a tile fetched from source is also written to the disk tier. A nil tile is
+// recorded as missing. Nothing is stored if the cache has been purged since the fetch started at the generation.
+func (f *TileFetcher) store(ctx context.Context, key string, tile []byte, gen uint64, cached *disk.Entry) string {
+    f.purging.RLock()
+    defer f.purging.RUnlock()
+
+    if gen != f.generation {
+        trace.Printf(ctx, "not caching tile fetched before a purge: key = %s", key)
+
+        if tile == nil {
+            return ""
+        }
+
+        return fmt.Sprintf("%x", md5.Sum(tile))
+    }
+
+    if tile == nil {
+        f.cache.SetMissing(key)
+        return ""
+    }
+
+    if cached != nil && !cached.Expires.IsZero() {
+        ttl := time.Until(cached.Expires)
+
+        if ttl <= 0 {
+            // expired since it was read
+            return fmt.Sprintf("%x", md5.Sum(tile))
+        }
+
+        return f.cache.SetWithTTL(key, tile, ttl)
+    }
+
+    if cached != nil {
+        return f.cache.Set(key, tile)
+    }
+
+    sum := f.cache.Set(key, tile)
+    f.toDisk(ctx, key, tile, sum)
+
+    return sum
+}
+
+// fromDisk reads the tile from the disk tier, a failed read is treated as a miss so the tile is fetched from source.
+// Expired entries are reported as missing by the disk tier.
+func (f *TileFetcher) fromDisk(ctx context.Context, key string) *disk.Entry {
+    if f.disk == nil {
+        return nil
+    }
+
+    e, err := f.disk.GetEntry(key)
+
+    if err != nil {
+        trace.Printf(ctx, "failed to read tile from disk cache: key = %s, error = %s", key, err)
+        return nil
+    }
+
+    return e
+}
+
+// toDisk writes the tile to the disk tier, failures are only logged as the tile can always be fetched from source
+func (f *TileFetcher) toDisk(ctx context.Context, key string, tile []byte, md5 string) {
+    if f.disk == nil {
+        return
+    }
+
+    if err := f.disk.Set(key, tile, md5); err != nil {
+        trace.Printf(ctx, "failed to write tile to disk cache: key = %s, error = %s", key, err)
+    }
+}
+
+// Purge removes the tiles selected by the filter from the cache and disk tier, returning the number of entries and
+// bytes freed from each. Fetches in flight are not stored once they complete.
+func (f *TileFetcher) Purge(filter tile.Filter) *PurgeResponse {
+    f.purging.Lock()
+    defer f.purging.Unlock()
+
+    f.generation++
+
+    match := func(key string) bool {
+        k, err := tile.ParseKey(key)
+        return err == nil && filter.Match(k)
+    }
+
+    purged := &PurgeResponse{}
+    purged.Entries, purged.Bytes = f.cache.Purge(match)
+
+    if f.disk != nil {
+        purged.DiskEntries, purged.DiskBytes = f.disk.Purge(match)
+    }
+
+    return purged
+}
+
+// Status reports the current state of the fetcher
+func (f *TileFetcher) Status() *FetcherStatus {
+    status := &FetcherStatus{
+        Status:    f.cache.Status(),
+        Coalesced: f.flight.Coalesced(),
+    }
+
+    if f.disk != nil {
+        status.Disk = f.disk.Status()
+    }
+
+    return status
+}
+
+// NewTileFetcher creates a fetcher backed by the given cache and disk tier, recording the source fetches in the
+// metrics. The disk tier and metrics are optional and may be nil.
+func NewTileFetcher(cache lru.Cache, store *disk.Store, metrics *Metrics) *TileFetcher {
+    return &TileFetcher{
+        cache:   cache,
+        disk:    store,
+        flight:  newFlight(),
+        metrics: metrics,
+        purging: &sync.RWMutex{},
+    }
+}
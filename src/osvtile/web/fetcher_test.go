@@ -0,0 +1,126 @@
+package web
+
+import (
+    "context"
+    "github.com/stretchr/testify/require"
+    "io/ioutil"
+    "os"
+    "osdata/osvtile/container/disk"
+    "osdata/osvtile/container/lru"
+    "osdata/osvtile/tile"
+    "testing"
+    "time"
+)
+
+func TestTileFetcher_Disk(t *testing.T) {
+    dir, err := ioutil.TempDir("", "fetcher-test")
+    require.NoError(t, err)
+    defer os.RemoveAll(dir)
+
+    store, err := disk.Open(dir, 1024*1024)
+    require.NoError(t, err)
+
+    key := tile.Key{Tileset: "zoomstack", Format: "mvt", Z: 1, X: 0, Y: 1}
+    fetches := 0
+    fetch := func(ctx context.Context) ([]byte, error) {
+        fetches++
+        return []byte("tile"), nil
+    }
+
+    f := NewTileFetcher(lru.New(1024*1024), store, nil)
+    value, md5, err := f.Fetch(context.Background(), key, fetch)
+    require.NoError(t, err)
+    require.Equal(t, []byte("tile"), value)
+    require.Equal(t, 1, fetches)
+
+    // a new memory cache, as after a restart, is filled from the disk tier rather than the source
+    store, err = disk.Open(dir, 1024*1024)
+    require.NoError(t, err)
+
+    f = NewTileFetcher(lru.New(1024*1024), store, nil)
+    again, md5Again, err := f.Fetch(context.Background(), key, fetch)
+    require.NoError(t, err)
+    require.Equal(t, value, again)
+    require.Equal(t, md5, md5Again)
+    require.Equal(t, 1, fetches)
+
+    status := f.Status()
+    require.Equal(t, int64(1), status.Disk.Hits)
+    require.Equal(t, 1, status.Elements)
+
+    purged := f.Purge(tile.Filter{Tileset: "zoomstack"})
+    require.Equal(t, 1, purged.Entries)
+    require.Equal(t, 1, purged.DiskEntries)
+}
+
+func TestTileFetcher_DiskTTL(t *testing.T) {
+    dir, err := ioutil.TempDir("", "fetcher-test")
+    require.NoError(t, err)
+    defer os.RemoveAll(dir)
+
+    ttl := func(key string) time.Duration { return 50 * time.Millisecond }
+
+    store, err := disk.Open(dir, 1024*1024, disk.WithTTL(ttl))
+    require.NoError(t, err)
+
+    key := tile.Key{Tileset: "zoomstack", Format: "mvt", Z: 1, X: 0, Y: 1}
+    fetches := 0
+    fetch := func(ctx context.Context) ([]byte, error) {
+        fetches++
+        return []byte("tile"), nil
+    }
+
+    f := NewTileFetcher(lru.New(1024*1024, lru.WithTTL(ttl)), store, nil)
+    _, _, err = f.Fetch(context.Background(), key, fetch)
+    require.NoError(t, err)
+
+    // a new memory cache is filled from the disk tier while the entry is live
+    f = NewTileFetcher(lru.New(1024*1024, lru.WithTTL(ttl)), store, nil)
+    _, _, result, err := f.fetch(context.Background(), key, fetch)
+    require.NoError(t, err)
+    require.Equal(t, CacheDisk, result)
+    require.Equal(t, 1, fetches)
+
+    // once expired, neither the memory cache nor the disk tier serve the tile
+    time.Sleep(60 * time.Millisecond)
+
+    _, _, result, err = f.fetch(context.Background(), key, fetch)
+    require.NoError(t, err)
+    require.Equal(t, CacheMiss, result)
+    require.Equal(t, 2, fetches)
+    require.Equal(t, int64(1), f.Status().Disk.Expired)
+}
+
+func TestTileFetcher_PurgeInFlight(t *testing.T) {
+    cache := lru.New(1024*1024, lru.WithNegative(100, time.Minute))
+    f := NewTileFetcher(cache, nil, nil)
+
+    key := tile.Key{Tileset: "zoomstack", Format: "mvt", Z: 1, X: 0, Y: 1}
+    started, release := make(chan struct{}), make(chan struct{})
+    done := make(chan []byte)
+
+    go func() {
+        value, _, err := f.Fetch(context.Background(), key, func(ctx context.Context) ([]byte, error) {
+            close(started)
+            <-release
+            return []byte("stale"), nil
+        })
+        require.NoError(t, err)
+        done <- value
+    }()
+
+    // the purge lands while the fetch is in flight, so the fetched tile is returned but not cached
+    <-started
+    f.Purge(tile.Filter{})
+    close(release)
+
+    require.Equal(t, []byte("stale"), <-done)
+    require.False(t, cache.Exists(key.String()))
+
+    // the next fetch is cached as normal
+    _, _, err := f.Fetch(context.Background(), key, func(ctx context.Context) ([]byte, error) {
+        return []byte("fresh"), nil
+    })
+    require.NoError(t, err)
+    require.True(t, cache.Exists(key.String()))
+}
@@ -0,0 +1,155 @@
+package web
+
+import (
+    "context"
+    "errors"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// errFetchPanicked is given to the callers waiting on a fetch that panicked, the panic carries on up the stack of the
+// caller that ran the fetch
+var errFetchPanicked = errors.New("tile fetch panicked")
+
+// call is a fetch in flight, the waiters block on the done channel until the result is ready. The fetch is cancelled
+// once every caller waiting on it has given up.
+type call struct {
+    done    chan struct{}
+    tile    []byte
+    md5     string
+    err     error
+    waiters int
+    cancel  context.CancelFunc
+}
+
+// flight coalesces concurrent fetches for the same key so only one of them does the work, the others wait for and
+// share its result
+type flight struct {
+    mu        *sync.Mutex
+    calls     map[string]*call
+    coalesced int64
+}
+
+// Do will run the fetch for the key unless one is already in flight, in which case the caller waits for that fetch
+// to complete. The shared flag reports if the result came from another caller's fetch.
+//
+// The fetch is run by the first caller, with a context that keeps the values of the caller's context but is only
+// cancelled once every waiting caller's context is done, so one client going away does not fail the fetch for the
+// others. A caller whose context is done stops waiting and gets the context error, the first caller still waits for
+// the fetch to return.
+func (f *flight) Do(
+    ctx context.Context, key string, fetch func(ctx context.Context) ([]byte, string, error),
+) (tile []byte, md5 string, err error, shared bool) {
+    f.mu.Lock()
+
+    if c, ok := f.calls[key]; ok {
+        c.waiters++
+        f.mu.Unlock()
+        atomic.AddInt64(&f.coalesced, 1)
+
+        select {
+        case <-c.done:
+            return c.tile, c.md5, c.err, true
+        case <-ctx.Done():
+            f.leave(key, c)
+            return nil, "", ctx.Err(), true
+        }
+    }
+
+    fctx, cancel := context.WithCancel(detach(ctx))
+    c := &call{done: make(chan struct{}), waiters: 1, cancel: cancel}
+    f.calls[key] = c
+    f.mu.Unlock()
+
+    if ctx.Done() != nil {
+        go func() {
+            select {
+            case <-c.done:
+            case <-ctx.Done():
+                f.leave(key, c)
+            }
+        }()
+    }
+
+    // the call is always completed, even if the fetch panics, so the waiters are released and the key is not left
+    // stuck in flight
+    panicked := true
+
+    defer func() {
+        if panicked {
+            c.tile, c.md5, c.err = nil, "", errFetchPanicked
+        }
+
+        f.mu.Lock()
+        if f.calls[key] == c {
+            delete(f.calls, key)
+        }
+        f.mu.Unlock()
+
+        close(c.done)
+        cancel()
+    }()
+
+    c.tile, c.md5, c.err = fetch(fctx)
+    panicked = false
+
+    return c.tile, c.md5, c.err, false
+}
+
+// leave stops a caller waiting on the call, cancelling the fetch if no one is left waiting. An abandoned call is
+// forgotten straight away so later callers start a new fetch rather than sharing a cancelled one.
+func (f *flight) leave(key string, c *call) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+
+    c.waiters--
+
+    if c.waiters > 0 {
+        return
+    }
+
+    if f.calls[key] == c {
+        delete(f.calls, key)
+    }
+
+    c.cancel()
+}
+
+// Coalesced reports the number of callers that waited on another caller's fetch
+func (f *flight) Coalesced() int64 {
+    return atomic.LoadInt64(&f.coalesced)
+}
+
+func newFlight() *flight {
+    return &flight{
+        mu:    &sync.Mutex{},
+        calls: map[string]*call{},
+    }
+}
+
+// detached is a context with the values of its parent, but not its deadline or cancellation
+type detached struct {
+    parent context.Context
+}
+
+func (d detached) Deadline() (time.Time, bool) {
+    return time.Time{}, false
+}
+
+func (d detached) Done() <-chan struct{} {
+    return nil
+}
+
+func (d detached) Err() error {
+    return nil
+}
+
+func (d detached) Value(key interface{}) interface{} {
+    return d.parent.Value(key)
+}
+
+// detach returns a context with the values of the given context, which is never cancelled
+func detach(ctx context.Context) context.Context {
+    return detached{parent: ctx}
+}
@@ -0,0 +1,166 @@
+package web
+
+import (
+    "context"
+    "github.com/stretchr/testify/require"
+    "osdata/osvtile/trace"
+    "runtime"
+    "sync"
+    "sync/atomic"
+    "testing"
+)
+
+func TestFlight_Coalesce(t *testing.T) {
+    f := newFlight()
+
+    var fetches int64
+    release := make(chan struct{})
+    started := make(chan struct{})
+
+    wg := &sync.WaitGroup{}
+    results := make([][]byte, 10)
+    shared := make([]bool, 10)
+
+    // the leader blocks in its fetch until all the followers are waiting on it
+    wg.Add(1)
+    go func() {
+        defer wg.Done()
+        results[0], _, _, _ = f.Do(context.Background(), "a", func(ctx context.Context) ([]byte, string, error) {
+            atomic.AddInt64(&fetches, 1)
+            close(started)
+            <-release
+            return []byte("aaaa"), "md5", nil
+        })
+    }()
+
+    <-started
+
+    for i := 1; i < len(results); i++ {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            results[i], _, _, shared[i] = f.Do(context.Background(), "a", func(ctx context.Context) ([]byte, string, error) {
+                atomic.AddInt64(&fetches, 1)
+                return []byte("bbbb"), "md5", nil
+            })
+        }(i)
+    }
+
+    for f.Coalesced() != int64(len(results)-1) {
+        runtime.Gosched()
+    }
+
+    close(release)
+    wg.Wait()
+
+    require.Equal(t, int64(1), fetches)
+
+    for i, r := range results {
+        require.Equal(t, []byte("aaaa"), r)
+        require.Equal(t, i != 0, shared[i])
+    }
+
+    // once complete, the next call fetches again
+    tile, _, _, again := f.Do(context.Background(), "a", func(ctx context.Context) ([]byte, string, error) {
+        return []byte("cccc"), "md5", nil
+    })
+    require.False(t, again)
+    require.Equal(t, []byte("cccc"), tile)
+}
+
+func TestFlight_Cancel(t *testing.T) {
+    f := newFlight()
+
+    started := make(chan context.Context, 1)
+    fetch := func(ctx context.Context) ([]byte, string, error) {
+        started <- ctx
+        <-ctx.Done()
+        return nil, "", ctx.Err()
+    }
+
+    leaderCtx, cancelLeader := context.WithCancel(trace.NewContext(context.Background(), &trace.Trace{RequestID: "leader"}))
+    leaderErr := make(chan error)
+    go func() {
+        _, _, err, _ := f.Do(leaderCtx, "a", fetch)
+        leaderErr <- err
+    }()
+
+    fetchCtx := <-started
+    require.Equal(t, "leader", trace.FromContext(fetchCtx).RequestID)
+
+    // a follower giving up does not cancel the fetch
+    followerCtx, cancelFollower := context.WithCancel(context.Background())
+    followerErr := make(chan error)
+    go func() {
+        _, _, err, _ := f.Do(followerCtx, "a", fetch)
+        followerErr <- err
+    }()
+
+    for f.Coalesced() != 1 {
+        runtime.Gosched()
+    }
+
+    cancelFollower()
+    require.Equal(t, context.Canceled, <-followerErr)
+    require.NoError(t, fetchCtx.Err())
+
+    // once the leader gives up too, no one is waiting and the fetch is cancelled
+    cancelLeader()
+    require.Equal(t, context.Canceled, <-leaderErr)
+    require.Equal(t, context.Canceled, fetchCtx.Err())
+
+    // the next call fetches again
+    tile, _, err, shared := f.Do(context.Background(), "a", func(ctx context.Context) ([]byte, string, error) {
+        return []byte("aaaa"), "md5", nil
+    })
+    require.NoError(t, err)
+    require.False(t, shared)
+    require.Equal(t, []byte("aaaa"), tile)
+}
+
+func TestFlight_Panic(t *testing.T) {
+    f := newFlight()
+
+    started := make(chan struct{})
+    release := make(chan struct{})
+    recovered := make(chan interface{})
+
+    go func() {
+        defer func() {
+            recovered <- recover()
+        }()
+
+        f.Do(context.Background(), "a", func(ctx context.Context) ([]byte, string, error) {
+            close(started)
+            <-release
+            panic("boom")
+        })
+    }()
+
+    <-started
+
+    followerErr := make(chan error)
+    go func() {
+        _, _, err, _ := f.Do(context.Background(), "a", func(ctx context.Context) ([]byte, string, error) {
+            return []byte("bbbb"), "md5", nil
+        })
+        followerErr <- err
+    }()
+
+    for f.Coalesced() != 1 {
+        runtime.Gosched()
+    }
+
+    // the panic carries on up the leader's stack, the follower is released with an error
+    close(release)
+    require.Equal(t, "boom", <-recovered)
+    require.Equal(t, errFetchPanicked, <-followerErr)
+
+    // the key is not left in flight
+    tile, _, err, shared := f.Do(context.Background(), "a", func(ctx context.Context) ([]byte, string, error) {
+        return []byte("cccc"), "md5", nil
+    })
+    require.NoError(t, err)
+    require.False(t, shared)
+    require.Equal(t, []byte("cccc"), tile)
+}
@@ -0,0 +1,62 @@
+package web
+
+import (
+    "net/http"
+    "osdata/osvtile/tileset"
+)
+
+// TileFormat describes how the tiles of an MBTiles format are cached and served
+type TileFormat struct {
+    // Name is the format used in the cache keys, e.g. `mvt`
+    Name string
+    // File is the file name of the tile routes, e.g. `tile.mvt`
+    File            string
+    ContentType     string
+    ContentEncoding string
+}
+
+// the tile formats that can be served
+var (
+    FormatMVT  = TileFormat{Name: "mvt", File: "tile.mvt", ContentType: "application/x-protobuf", ContentEncoding: "gzip"}
+    FormatPNG  = TileFormat{Name: "png", File: "hs.png", ContentType: "image/png"}
+    FormatJPG  = TileFormat{Name: "jpg", File: "tile.jpg", ContentType: "image/jpeg"}
+    FormatWebP = TileFormat{Name: "webp", File: "tile.webp", ContentType: "image/webp"}
+)
+
+// tileFormats maps the MBTiles `format` metadata values to the formats served
+var tileFormats = map[string]TileFormat{
+    "pbf":  FormatMVT,
+    "png":  FormatPNG,
+    "jpg":  FormatJPG,
+    "jpeg": FormatJPG,
+    "webp": FormatWebP,
+}
+
+// LookupFormat reports how the tiles of the MBTiles format are served, false if the format is not supported. Packages
+// without a format are taken to be PNG, as the hillshade is.
+func LookupFormat(format string) (TileFormat, bool) {
+    if format == "" {
+        return FormatPNG, true
+    }
+
+    f, ok := tileFormats[format]
+    return f, ok
+}
+
+// tilesetFormat reports how the tiles of the tileset are served, false if its format is not supported
+func tilesetFormat(ts *tileset.Tileset) (TileFormat, bool) {
+    if ts.Version == nil {
+        return FormatPNG, true
+    }
+
+    return LookupFormat(ts.Version.Format)
+}
+
+// setHeaders adds the content headers of the format
+func (f TileFormat) setHeaders(h http.Header) {
+    h.Set("content-type", f.ContentType)
+
+    if f.ContentEncoding != "" {
+        h.Set("content-encoding", f.ContentEncoding)
+    }
+}
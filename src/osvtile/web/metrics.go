@@ -1,7 +1,12 @@
 package web
 
 import (
+    "context"
+    "github.com/gorilla/mux"
+    "io"
     "net/http"
+    "osdata/osvtile/trace"
+    "strconv"
     "sync"
     "time"
 )
@@ -12,6 +17,13 @@ type Metrics struct {
     Status   map[int]int64    `json:"status"`
     Methods  map[string]int64 `json:"methods"`
     Start    time.Time        `json:"start"`
+    // Prometheus metrics, exposed by the /metrics endpoint
+    inFlight    *metric
+    requests    *metric
+    latency     *metric
+    tileSize    *metric
+    fetching    *metric
+    fetchTiming *metric
 }
 
 func (m *Metrics) Log(r *http.Request, status int) {
@@ -25,11 +37,189 @@ func (m *Metrics) Log(r *http.Request, status int) {
         m.Status[status] = 1
     }
 
-    if _, ok := m.Methods[r.Method]; ok {
-        m.Methods[r.Method]++
+    method := methodLabel(r.Method)
+
+    if _, ok := m.Methods[method]; ok {
+        m.Methods[method]++
     } else {
-        m.Methods[r.Method] = 1
+        m.Methods[method] = 1
+    }
+}
+
+// methods are the request methods counted by name, any other method is counted as "other" so a client cannot grow
+// the metrics by sending made up methods
+var methods = map[string]bool{
+    http.MethodGet:     true,
+    http.MethodHead:    true,
+    http.MethodPost:    true,
+    http.MethodPut:     true,
+    http.MethodPatch:   true,
+    http.MethodDelete:  true,
+    http.MethodConnect: true,
+    http.MethodOptions: true,
+    http.MethodTrace:   true,
+}
+
+// methodLabel maps the request method to one of the known HTTP methods, or "other"
+func methodLabel(method string) string {
+    if methods[method] {
+        return method
+    }
+
+    return "other"
+}
+
+// observe records the handled request in the Prometheus metrics, along with the size of any tile served
+func (m *Metrics) observe(r *http.Request, info *requestInfo, status int, elapsed time.Duration) {
+    m.requests.add(1, info.route, methodLabel(r.Method), strconv.Itoa(status))
+    m.latency.observe(elapsed.Seconds(), info.route, info.tileset)
+
+    if status == http.StatusOK && info.tileset != "" {
+        m.tileSize.observe(float64(info.size), info.tileset, info.format)
+    }
+}
+
+// timeFetch wraps the fetch of a tile from the tileset source to record how long it takes and the number in flight
+func (m *Metrics) timeFetch(tileset string, fetch FetchFunc) FetchFunc {
+    return func(ctx context.Context) ([]byte, error) {
+        m.fetching.add(1, tileset)
+        defer m.fetching.add(-1, tileset)
+
+        start := time.Now()
+        defer func() {
+            m.fetchTiming.observe(time.Since(start).Seconds(), tileset)
+        }()
+
+        return fetch(ctx)
+    }
+}
+
+// requestInfo is filled in as the request is routed and served, giving the labels of the request metrics and the
+// optional fields of the access log. It is only used by the goroutine serving the request.
+type requestInfo struct {
+    route     string
+    tileset   string
+    format    string
+    size      int
+    z, x, y   int
+    cache     string
+    fetchTime time.Duration
+}
+
+type contextKey int
+
+const requestInfoKey contextKey = 0
+
+// withRequestInfo adds an empty request info to the request context
+func withRequestInfo(r *http.Request) (*http.Request, *requestInfo) {
+    info := &requestInfo{route: "none"}
+    return r.WithContext(context.WithValue(r.Context(), requestInfoKey, info)), info
+}
+
+// getRequestInfo returns the request info from the request context, or a throwaway info if there is none
+func getRequestInfo(r *http.Request) *requestInfo {
+    if info, ok := r.Context().Value(requestInfoKey).(*requestInfo); ok {
+        return info
     }
+
+    return &requestInfo{}
+}
+
+// NewRouteHandler is router middleware which labels the request metrics with the path template of the matched route
+func NewRouteHandler(h http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if route := mux.CurrentRoute(r); route != nil {
+            if tmpl, err := route.GetPathTemplate(); err == nil {
+                getRequestInfo(r).route = tmpl
+            }
+        }
+
+        h.ServeHTTP(w, r)
+    })
+}
+
+// NewPrometheusHandler serves the request, tile fetch and cache metrics in the Prometheus text exposition format
+func NewPrometheusHandler(metrics *Metrics, tiles *TileFetcher) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("content-type", "text/plain; version=0.0.4; charset=utf-8")
+        w.WriteHeader(http.StatusOK)
+
+        if err := metrics.write(w, tiles.Status()); err != nil {
+            trace.Printf(r.Context(), "failed to write metrics to client: error = %s", err)
+        }
+    }
+}
+
+// write all of the metrics, with the cache metrics taken from the fetcher status
+func (m *Metrics) write(w io.Writer, status *FetcherStatus) error {
+    start := newGauge("osvtile_start_time_seconds", "Time the server started, in seconds since the epoch.")
+    start.set(float64(m.Start.UnixNano()) / 1e9)
+
+    metrics := []*metric{start, m.inFlight, m.requests, m.latency, m.tileSize, m.fetching, m.fetchTiming}
+    metrics = append(metrics, cacheMetrics(status)...)
+
+    for _, metric := range metrics {
+        if err := metric.write(w); err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+// cacheMetrics converts the fetcher status into metrics, the statistics are counters as they are never reset
+func cacheMetrics(status *FetcherStatus) []*metric {
+    counter := func(name, help string, value int64) *metric {
+        m := newCounter(name, help)
+        m.add(float64(value))
+        return m
+    }
+
+    gauge := func(name, help string, value int64) *metric {
+        m := newGauge(name, help)
+        m.set(float64(value))
+        return m
+    }
+
+    stats := status.Stats
+    metrics := []*metric{
+        counter("osvtile_cache_hits_total", "Tile cache lookups which found the tile.", stats.Hits),
+        counter("osvtile_cache_misses_total", "Tile cache lookups which did not find the tile.", stats.Misses),
+        counter("osvtile_cache_evictions_total", "Tiles evicted from the cache to make space.", stats.Evictions),
+        counter("osvtile_cache_evicted_bytes_total", "Bytes of the tiles evicted from the cache.", stats.EvictedBytes),
+        counter("osvtile_cache_rejections_total", "Tiles too large to be cached.", stats.Rejections),
+        counter("osvtile_cache_expired_total", "Tiles removed from the cache once past their TTL.", stats.Expired),
+        counter("osvtile_cache_coalesced_total", "Requests which waited on a tile fetch already in flight.", status.Coalesced),
+        gauge("osvtile_cache_elements", "Tiles held in the cache.", int64(status.Elements)),
+        gauge("osvtile_cache_size_bytes", "Bytes held in the cache, after deduplication.", status.Size),
+        gauge("osvtile_cache_max_size_bytes", "Maximum bytes held in the cache.", status.MaxSize),
+    }
+
+    namespaces := newGauge("osvtile_cache_namespace_size_bytes", "Bytes held in the cache by namespace.", "namespace")
+
+    for name, usage := range status.Namespaces {
+        namespaces.set(float64(usage.Size), name)
+    }
+
+    metrics = append(metrics, namespaces)
+
+    if status.Negative != nil {
+        metrics = append(metrics, counter(
+            "osvtile_cache_negative_hits_total", "Requests for tiles known to be missing.", status.Negative.Hits,
+        ))
+    }
+
+    if status.Disk != nil {
+        metrics = append(metrics,
+            counter("osvtile_disk_cache_hits_total", "Disk cache lookups which found the tile.", status.Disk.Hits),
+            counter("osvtile_disk_cache_misses_total", "Disk cache lookups which did not find the tile.", status.Disk.Misses),
+            counter("osvtile_disk_cache_evictions_total", "Tiles evicted from the disk cache.", status.Disk.Evictions),
+            counter("osvtile_disk_cache_corrupt_total", "Corrupt tiles removed from the disk cache.", status.Disk.Corrupt),
+            gauge("osvtile_disk_cache_size_bytes", "Bytes held in the disk cache.", status.Disk.Size),
+        )
+    }
+
+    return metrics
 }
 
 func NewMetrics() *Metrics {
@@ -39,5 +229,25 @@ func NewMetrics() *Metrics {
         Status:   map[int]int64{},
         Methods:  map[string]int64{},
         Start:    time.Now().UTC(),
+        inFlight: newGauge("osvtile_http_requests_in_flight", "Requests currently being served."),
+        requests: newCounter(
+            "osvtile_http_requests_total", "Requests handled, by route, method and status code.",
+            "route", "method", "code",
+        ),
+        latency: newHistogram(
+            "osvtile_http_request_duration_seconds", "Time taken to handle requests, by route and tileset.",
+            latencyBuckets, "route", "tileset",
+        ),
+        tileSize: newHistogram(
+            "osvtile_tile_size_bytes", "Size of the tiles served, by tileset and format.",
+            sizeBuckets, "tileset", "format",
+        ),
+        fetching: newGauge(
+            "osvtile_source_fetches_in_flight", "Tiles currently being fetched from the tileset sources.", "tileset",
+        ),
+        fetchTiming: newHistogram(
+            "osvtile_source_fetch_duration_seconds", "Time taken to fetch tiles from the tileset sources, by tileset.",
+            latencyBuckets, "tileset",
+        ),
     }
 }
@@ -0,0 +1,87 @@
+package web
+
+import (
+    "github.com/gorilla/mux"
+    "github.com/stretchr/testify/require"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "osdata/osvtile/container/lru"
+    "osdata/osvtile/mbtiles/mbtilestest"
+    "osdata/osvtile/tile"
+    "osdata/osvtile/tileset"
+    "strings"
+    "testing"
+)
+
+func TestPrometheusHandler(t *testing.T) {
+    tilesets := tileset.NewRegistry()
+    _, err := tilesets.Add(tileset.Config{Name: "fake", Scheme: "tms"}, mbtilestest.NewSource("pbf"))
+    require.NoError(t, err)
+
+    metrics := NewMetrics()
+    tiles := NewTileFetcher(lru.New(1024*1024, lru.WithNamespaces(tile.Namespace)), nil, metrics)
+
+    r := mux.NewRouter()
+    r.Use(NewRouteHandler)
+    r.HandleFunc("/{name:[A-Za-z0-9_]+}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}/tile.mvt", NewMVTRequestHandler(tilesets, "", tiles))
+    r.HandleFunc("/metrics", NewPrometheusHandler(metrics, tiles))
+    logger, err := NewAccessLogger(ioutil.Discard, AccessLogJSON, FieldsAll)
+    require.NoError(t, err)
+    h := NewRequestHandler(metrics, logger, r)
+
+    // the second request is a cache hit
+    for _, path := range []string{"/fake/1/1/0/tile.mvt", "/fake/1/1/0/tile.mvt", "/fake/1/0/0/tile.mvt"} {
+        h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+    }
+
+    w := httptest.NewRecorder()
+    h.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+    require.Equal(t, http.StatusOK, w.Code)
+    require.True(t, strings.HasPrefix(w.Header().Get("content-type"), "text/plain; version=0.0.4"))
+
+    body := w.Body.String()
+    route := `route="/{name:[A-Za-z0-9_]+}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}/tile.mvt"`
+
+    require.Contains(t, body, `osvtile_http_requests_total{`+route+`,method="GET",code="200"} 2`)
+    require.Contains(t, body, `osvtile_http_requests_total{`+route+`,method="GET",code="404"} 1`)
+    require.Contains(t, body, `osvtile_http_request_duration_seconds_count{`+route+`,tileset="fake"} 3`)
+    require.Contains(t, body, `osvtile_tile_size_bytes_bucket{tileset="fake",format="mvt",le="256"} 2`)
+    require.Contains(t, body, `osvtile_source_fetch_duration_seconds_count{tileset="fake"} 2`)
+    require.Contains(t, body, `osvtile_source_fetches_in_flight{tileset="fake"} 0`)
+    require.Contains(t, body, "osvtile_http_requests_in_flight 1\n")
+    require.Contains(t, body, "osvtile_cache_hits_total 1\n")
+    require.Contains(t, body, "osvtile_cache_misses_total 2\n")
+    require.Contains(t, body, `osvtile_cache_namespace_size_bytes{namespace="fake"} 4`)
+
+    // made up methods share a single label
+    h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("BREW", "/fake/1/1/0/tile.mvt", nil))
+    h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("FROB", "/fake/1/1/0/tile.mvt", nil))
+
+    w = httptest.NewRecorder()
+    h.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+    body = w.Body.String()
+
+    require.Contains(t, body, `osvtile_http_requests_total{`+route+`,method="other",code="200"} 2`)
+    require.NotContains(t, body, `method="BREW"`)
+    require.Equal(t, int64(2), metrics.Methods["other"])
+}
+
+func TestRequestHandler_InFlight(t *testing.T) {
+    metrics := NewMetrics()
+    logger, err := NewAccessLogger(ioutil.Discard, AccessLogJSON, FieldsAll)
+    require.NoError(t, err)
+
+    h := NewRequestHandler(metrics, logger, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        panic("handler failed")
+    }))
+
+    // the server recovers the panic, the request must no longer count as in flight
+    require.Panics(t, func() {
+        h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+    })
+
+    b := &strings.Builder{}
+    require.NoError(t, metrics.inFlight.write(b))
+    require.Contains(t, b.String(), "\nosvtile_http_requests_in_flight 0\n")
+}
@@ -0,0 +1,200 @@
+package web
+
+import (
+    "fmt"
+    "io"
+    "math"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+// metric kinds, as given in the `# TYPE` line of the Prometheus text format
+const (
+    counterKind   = "counter"
+    gaugeKind     = "gauge"
+    histogramKind = "histogram"
+)
+
+var (
+    // latencyBuckets are the upper bounds, in seconds, of the request and fetch duration histograms
+    latencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+    // sizeBuckets are the upper bounds, in bytes, of the tile size histogram
+    sizeBuckets = []float64{256, 1024, 4096, 16384, 65536, 262144, 1048576, 4194304}
+    // escapes label values for the text format
+    labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+// series holds the value of a metric for one set of label values. Histograms count the observations in each bucket,
+// the buckets are made cumulative when written.
+type series struct {
+    labels  []string
+    value   float64
+    buckets []uint64
+    count   uint64
+}
+
+// metric is a counter, gauge or histogram with a series for each set of label values, written out in the Prometheus
+// text exposition format
+type metric struct {
+    mu      *sync.Mutex
+    name    string
+    help    string
+    kind    string
+    labels  []string
+    buckets []float64
+    series  map[string]*series
+}
+
+// get returns the series for the label values, creating it if needed. The lock must be held.
+func (m *metric) get(values []string) *series {
+    if len(values) != len(m.labels) {
+        panic(fmt.Sprintf("metric %s has labels %v, given values %v", m.name, m.labels, values))
+    }
+
+    key := strings.Join(values, "\xff")
+    s, ok := m.series[key]
+
+    if !ok {
+        s = &series{labels: values}
+
+        if m.kind == histogramKind {
+            s.buckets = make([]uint64, len(m.buckets))
+        }
+
+        m.series[key] = s
+    }
+
+    return s
+}
+
+// add the delta to the counter or gauge
+func (m *metric) add(delta float64, values ...string) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    m.get(values).value += delta
+}
+
+// set the value of the gauge
+func (m *metric) set(value float64, values ...string) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    m.get(values).value = value
+}
+
+// observe records the value in the histogram, the series value holds the sum of the observations
+func (m *metric) observe(value float64, values ...string) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    s := m.get(values)
+    s.value += value
+    s.count++
+
+    if i := sort.SearchFloat64s(m.buckets, value); i < len(m.buckets) {
+        s.buckets[i]++
+    }
+}
+
+// write the metric in the text format, with the series sorted by their label values
+func (m *metric) write(w io.Writer) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    keys := make([]string, 0, len(m.series))
+
+    for k := range m.series {
+        keys = append(keys, k)
+    }
+
+    sort.Strings(keys)
+
+    b := &strings.Builder{}
+    fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+
+    for _, k := range keys {
+        s := m.series[k]
+
+        if m.kind != histogramKind {
+            fmt.Fprintf(b, "%s%s %s\n", m.name, m.format(s.labels, ""), formatValue(s.value))
+            continue
+        }
+
+        cumulative := uint64(0)
+
+        for i, le := range m.buckets {
+            cumulative += s.buckets[i]
+            fmt.Fprintf(b, "%s_bucket%s %d\n", m.name, m.format(s.labels, formatValue(le)), cumulative)
+        }
+
+        fmt.Fprintf(b, "%s_bucket%s %d\n", m.name, m.format(s.labels, "+Inf"), s.count)
+        fmt.Fprintf(b, "%s_sum%s %s\n", m.name, m.format(s.labels, ""), formatValue(s.value))
+        fmt.Fprintf(b, "%s_count%s %d\n", m.name, m.format(s.labels, ""), s.count)
+    }
+
+    _, err := io.WriteString(w, b.String())
+
+    return err
+}
+
+// format the label pairs of a series, adding the `le` label of a histogram bucket if given
+func (m *metric) format(values []string, le string) string {
+    pairs := make([]string, 0, len(values)+1)
+
+    for i, v := range values {
+        pairs = append(pairs, fmt.Sprintf(`%s="%s"`, m.labels[i], labelEscaper.Replace(v)))
+    }
+
+    if le != "" {
+        pairs = append(pairs, fmt.Sprintf(`le="%s"`, le))
+    }
+
+    if len(pairs) == 0 {
+        return ""
+    }
+
+    return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// formatValue writes whole numbers without an exponent, as they are for counts and bytes
+func formatValue(v float64) string {
+    if v == math.Trunc(v) && math.Abs(v) < 1e15 {
+        return strconv.FormatInt(int64(v), 10)
+    }
+
+    return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func newMetric(kind, name, help string, buckets []float64, labels []string) *metric {
+    m := &metric{
+        mu:      &sync.Mutex{},
+        name:    name,
+        help:    help,
+        kind:    kind,
+        labels:  labels,
+        buckets: buckets,
+        series:  map[string]*series{},
+    }
+
+    // metrics without labels are always reported, even before they are first updated
+    if len(labels) == 0 {
+        m.get(nil)
+    }
+
+    return m
+}
+
+func newCounter(name, help string, labels ...string) *metric {
+    return newMetric(counterKind, name, help, nil, labels)
+}
+
+func newGauge(name, help string, labels ...string) *metric {
+    return newMetric(gaugeKind, name, help, nil, labels)
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *metric {
+    return newMetric(histogramKind, name, help, buckets, labels)
+}
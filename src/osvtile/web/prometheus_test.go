@@ -0,0 +1,68 @@
+package web
+
+import (
+    "bytes"
+    "github.com/stretchr/testify/require"
+    "testing"
+)
+
+func TestMetric_Histogram(t *testing.T) {
+    m := newHistogram("test_seconds", "Test histogram.", []float64{0.25, 1}, "route")
+
+    m.observe(0.125, "/a")
+    m.observe(0.25, "/a")
+    m.observe(0.5, "/a")
+    m.observe(4, "/a")
+    m.observe(1, `/"b"`)
+
+    b := &bytes.Buffer{}
+    require.NoError(t, m.write(b))
+    require.Equal(t, `# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{route="/\"b\"",le="0.25"} 0
+test_seconds_bucket{route="/\"b\"",le="1"} 1
+test_seconds_bucket{route="/\"b\"",le="+Inf"} 1
+test_seconds_sum{route="/\"b\""} 1
+test_seconds_count{route="/\"b\""} 1
+test_seconds_bucket{route="/a",le="0.25"} 2
+test_seconds_bucket{route="/a",le="1"} 3
+test_seconds_bucket{route="/a",le="+Inf"} 4
+test_seconds_sum{route="/a"} 4.875
+test_seconds_count{route="/a"} 4
+`, b.String())
+}
+
+func TestMetric_Counter(t *testing.T) {
+    m := newCounter("test_total", "Test counter.")
+
+    b := &bytes.Buffer{}
+    require.NoError(t, m.write(b))
+    require.Contains(t, b.String(), "\ntest_total 0\n")
+
+    m.add(3)
+    b.Reset()
+    require.NoError(t, m.write(b))
+    require.Contains(t, b.String(), "\ntest_total 3\n")
+}
+
+func TestMetric_Gauge(t *testing.T) {
+    m := newGauge("test_entries", "Test gauge.", "name", "path")
+
+    m.set(5, "b", `C:\tiles`)
+    m.set(2.5, "a", "line\none")
+    m.add(-1, "b", `C:\tiles`)
+    m.add(1, "c", `say "hi"`)
+
+    // label values escape backslashes, quotes and newlines
+    b := &bytes.Buffer{}
+    require.NoError(t, m.write(b))
+    require.Equal(t, `# HELP test_entries Test gauge.
+# TYPE test_entries gauge
+test_entries{name="a",path="line\none"} 2.5
+test_entries{name="b",path="C:\\tiles"} 4
+test_entries{name="c",path="say \"hi\""} 1
+`, b.String())
+
+    // the label values must match the label names
+    require.Panics(t, func() { m.set(1, "a") })
+}
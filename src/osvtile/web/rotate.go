@@ -0,0 +1,134 @@
+package web
+
+import (
+    "fmt"
+    "log"
+    "os"
+    "sync"
+)
+
+// RotatingFile is a log file which is rotated once it reaches its max size. The current file is renamed to
+// `<path>.1`, with older files shifted up to `<path>.<keep>`, and anything older removed. A failed rotation does not
+// stop the log, writes carry on appending to the current file and the rotation is tried again on the next write.
+type RotatingFile struct {
+    mu      *sync.Mutex
+    path    string
+    maxsize int64
+    keep    int
+    file    *os.File
+    size    int64
+    closed  bool
+}
+
+// Write appends to the file, rotating it first if the write would take it over the max size. A single write is
+// never split across files.
+func (f *RotatingFile) Write(p []byte) (int, error) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+
+    if f.closed {
+        return 0, os.ErrClosed
+    }
+
+    if f.maxsize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxsize && f.file != nil {
+        if err := f.rotate(); err != nil {
+            log.Printf("failed to rotate log file, appending to the current file: path = %s, error = %s", f.path, err)
+        }
+    }
+
+    // reopened after a failed rotation
+    if f.file == nil {
+        if err := f.open(); err != nil {
+            return 0, err
+        }
+    }
+
+    n, err := f.file.Write(p)
+    f.size += int64(n)
+
+    return n, err
+}
+
+// rotate closes the current file, shifts the old files along and opens a new file. The lock must be held.
+func (f *RotatingFile) rotate() error {
+    if err := f.file.Close(); err != nil {
+        return err
+    }
+
+    f.file = nil
+
+    for i := f.keep - 1; i >= 1; i-- {
+        from := fmt.Sprintf("%s.%d", f.path, i)
+
+        if _, err := os.Stat(from); err == nil {
+            if err := os.Rename(from, fmt.Sprintf("%s.%d", f.path, i+1)); err != nil {
+                return err
+            }
+        }
+    }
+
+    if f.keep > 0 {
+        if err := os.Rename(f.path, f.path+".1"); err != nil {
+            return err
+        }
+    } else if err := os.Remove(f.path); err != nil {
+        return err
+    }
+
+    return f.open()
+}
+
+// open the file for appending, picking up the size of any existing file
+func (f *RotatingFile) open() error {
+    file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+
+    if err != nil {
+        return err
+    }
+
+    info, err := file.Stat()
+
+    if err != nil {
+        _ = file.Close()
+        return err
+    }
+
+    f.file = file
+    f.size = info.Size()
+
+    return nil
+}
+
+// Close the file, any later writes fail
+func (f *RotatingFile) Close() error {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+
+    f.closed = true
+
+    if f.file == nil {
+        return nil
+    }
+
+    err := f.file.Close()
+    f.file = nil
+
+    return err
+}
+
+// OpenRotatingFile opens the log file for appending, rotating it at the max size (zero to never rotate) and keeping
+// the given number of old files
+func OpenRotatingFile(path string, maxsize int64, keep int) (*RotatingFile, error) {
+    f := &RotatingFile{
+        mu:      &sync.Mutex{},
+        path:    path,
+        maxsize: maxsize,
+        keep:    keep,
+    }
+
+    if err := f.open(); err != nil {
+        return nil, err
+    }
+
+    return f, nil
+}
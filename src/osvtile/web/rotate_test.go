@@ -0,0 +1,87 @@
+package web
+
+import (
+    "github.com/stretchr/testify/require"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+    dir, err := ioutil.TempDir("", "rotate-test")
+    require.NoError(t, err)
+    defer os.RemoveAll(dir)
+
+    path := filepath.Join(dir, "access.log")
+    f, err := OpenRotatingFile(path, 10, 2)
+    require.NoError(t, err)
+
+    for _, line := range []string{"aaaaaa\n", "bbbbbb\n", "cccccc\n", "dddddd\n"} {
+        _, err := f.Write([]byte(line))
+        require.NoError(t, err)
+    }
+
+    require.NoError(t, f.Close())
+
+    // each write goes over the max size, so rotates the file, with only the newest two old files kept
+    read := func(path string) string {
+        data, err := ioutil.ReadFile(path)
+        require.NoError(t, err)
+        return string(data)
+    }
+
+    require.Equal(t, "dddddd\n", read(path))
+    require.Equal(t, "cccccc\n", read(path+".1"))
+    require.Equal(t, "bbbbbb\n", read(path+".2"))
+    _, err = os.Stat(path + ".3")
+    require.True(t, os.IsNotExist(err))
+
+    // reopening appends to the existing file
+    f, err = OpenRotatingFile(path, 10, 2)
+    require.NoError(t, err)
+    _, err = f.Write([]byte("e\n"))
+    require.NoError(t, err)
+    require.NoError(t, f.Close())
+    require.Equal(t, "dddddd\ne\n", read(path))
+
+    _, err = f.Write([]byte("f\n"))
+    require.Error(t, err)
+}
+
+func TestRotatingFile_RotateFailure(t *testing.T) {
+    dir, err := ioutil.TempDir("", "rotate-test")
+    require.NoError(t, err)
+    defer os.RemoveAll(dir)
+
+    // a directory in the way of the first old file makes the rename fail
+    path := filepath.Join(dir, "access.log")
+    require.NoError(t, os.MkdirAll(filepath.Join(path+".1", "blocked"), 0755))
+
+    f, err := OpenRotatingFile(path, 10, 1)
+    require.NoError(t, err)
+    defer f.Close()
+
+    for _, line := range []string{"aaaaaa\n", "bbbbbb\n"} {
+        _, err := f.Write([]byte(line))
+        require.NoError(t, err)
+    }
+
+    // the log carries on in the current file
+    data, err := ioutil.ReadFile(path)
+    require.NoError(t, err)
+    require.Equal(t, "aaaaaa\nbbbbbb\n", string(data))
+
+    // and rotates once the rename can succeed
+    require.NoError(t, os.RemoveAll(path+".1"))
+    _, err = f.Write([]byte("cccccc\n"))
+    require.NoError(t, err)
+
+    data, err = ioutil.ReadFile(path)
+    require.NoError(t, err)
+    require.Equal(t, "cccccc\n", string(data))
+
+    data, err = ioutil.ReadFile(path + ".1")
+    require.NoError(t, err)
+    require.Equal(t, "aaaaaa\nbbbbbb\n", string(data))
+}
@@ -0,0 +1,429 @@
+package web
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "osdata/osvtile/mbtiles"
+    "osdata/osvtile/tile"
+    "osdata/osvtile/tileset"
+    "osdata/osvtile/trace"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+const (
+    // defaultSeedConcurrency is the number of tiles fetched at once when the request does not say
+    defaultSeedConcurrency = 4
+    // maxSeedConcurrency stops a seed job from swamping the tile sources
+    maxSeedConcurrency = 64
+    // maxSeedZoom limits the zoom levels which can be seeded
+    maxSeedZoom = 22
+    // maxSeedBody limits the size of a seed request body
+    maxSeedBody = 64 * 1024
+    // CRSBNG selects British National Grid coordinates for a seed bbox
+    CRSBNG = "bng"
+    // CRSWGS84 selects WGS84 coordinates for a seed bbox, the default
+    CRSWGS84 = "wgs84"
+)
+
+// SeedRequest selects the tiles to load into the cache. The bbox is a WGS84 left, bottom, right, top unless the crs
+// is "bng", in which case it is a British National Grid min easting, min northing, max easting, max northing.
+type SeedRequest struct {
+    Tileset     string       `json:"tileset"`
+    BBox        mbtiles.BBox `json:"bbox"`
+    CRS         string       `json:"crs,omitempty"`
+    Minzoom     int          `json:"minzoom"`
+    Maxzoom     int          `json:"maxzoom"`
+    Concurrency int          `json:"concurrency,omitempty"`
+}
+
+// SeedProgress reports the progress of a seed job, with the bbox and zoom range as actually seeded
+type SeedProgress struct {
+    Tileset   string       `json:"tileset"`
+    Format    string       `json:"format"`
+    BBox      mbtiles.BBox `json:"bbox"`
+    Minzoom   int          `json:"minzoom"`
+    Maxzoom   int          `json:"maxzoom"`
+    Total     int64        `json:"total"`
+    Done      int64        `json:"done"`
+    Loaded    int64        `json:"loaded"`
+    Missing   int64        `json:"missing"`
+    Failed    int64        `json:"failed"`
+    Running   bool         `json:"running"`
+    Cancelled bool         `json:"cancelled"`
+    Elapsed   string       `json:"elapsed"`
+}
+
+// SeedJob loads every tile of a tileset within a bbox and zoom range through the fetcher, so they are held in the
+// cache and disk tier (if enabled)
+type SeedJob struct {
+    // updated atomically, first in the struct to keep them 64 bit aligned
+    done      int64
+    loaded    int64
+    missing   int64
+    failed    int64
+    running   int32
+    cancelled int32
+
+    tiles       *TileFetcher
+    ts          *tileset.Tileset
+    format      string
+    bbox        mbtiles.BBox
+    ranges      []tile.Range
+    total       int64
+    concurrency int
+    started     time.Time
+    finished    time.Time
+    mu          *sync.Mutex
+}
+
+// Run fetches the tiles, blocking until every tile has been tried or the context is done. Tiles not yet fetched when
+// the context is done are skipped.
+func (j *SeedJob) Run(ctx context.Context) {
+    j.mu.Lock()
+    j.started = time.Now()
+    j.mu.Unlock()
+    atomic.StoreInt32(&j.running, 1)
+
+    trace.Printf(ctx, "seeding tiles: tileset = %s, bbox = %v, zooms = %d-%d, tiles = %d, concurrency = %d",
+        j.ts.Name, j.bbox, j.minzoom(), j.maxzoom(), j.total, j.concurrency)
+
+    keys := make(chan tile.Key, j.concurrency)
+    wg := &sync.WaitGroup{}
+
+    for i := 0; i < j.concurrency; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+
+            for key := range keys {
+                j.fetch(ctx, key)
+            }
+        }()
+    }
+
+    j.plan(ctx, keys)
+    close(keys)
+    wg.Wait()
+
+    if ctx.Err() != nil {
+        atomic.StoreInt32(&j.cancelled, 1)
+    }
+
+    j.mu.Lock()
+    j.finished = time.Now()
+    j.mu.Unlock()
+    atomic.StoreInt32(&j.running, 0)
+
+    p := j.Progress()
+    trace.Printf(ctx, "seeded tiles: tileset = %s, tiles = %d, done = %d, loaded = %d, missing = %d, failed = %d, cancelled = %t, elapsed = %s",
+        p.Tileset, p.Total, p.Done, p.Loaded, p.Missing, p.Failed, p.Cancelled, p.Elapsed)
+}
+
+// plan sends the key of every tile in the job, stopping once the context is done
+func (j *SeedJob) plan(ctx context.Context, keys chan<- tile.Key) {
+    for _, r := range j.ranges {
+        for x := r.MinX; x <= r.MaxX; x++ {
+            for y := r.MinY; y <= r.MaxY; y++ {
+                select {
+                case keys <- tile.Key{Tileset: j.ts.Name, Format: j.format, Z: r.Z, X: x, Y: y}:
+                case <-ctx.Done():
+                    return
+                }
+            }
+        }
+    }
+}
+
+// fetch loads a single tile, failures are counted rather than stopping the job. Once the context is done the tile is
+// skipped, so is not counted at all.
+func (j *SeedJob) fetch(ctx context.Context, key tile.Key) {
+    if ctx.Err() != nil {
+        return
+    }
+
+    data, _, err := j.tiles.Fetch(ctx, key, sourceFetch(j.ts, key))
+
+    switch {
+    case err != nil && ctx.Err() != nil:
+        return
+    case err != nil:
+        atomic.AddInt64(&j.failed, 1)
+        trace.Printf(ctx, "failed to seed tile: key = %s, error = %s", key, err)
+    case data == nil:
+        atomic.AddInt64(&j.missing, 1)
+    default:
+        atomic.AddInt64(&j.loaded, 1)
+    }
+
+    atomic.AddInt64(&j.done, 1)
+}
+
+// Progress reports how far through the job is
+func (j *SeedJob) Progress() *SeedProgress {
+    j.mu.Lock()
+    started, finished := j.started, j.finished
+    j.mu.Unlock()
+
+    elapsed := time.Duration(0)
+
+    switch {
+    case !finished.IsZero():
+        elapsed = finished.Sub(started)
+    case !started.IsZero():
+        elapsed = time.Since(started)
+    }
+
+    return &SeedProgress{
+        Tileset:   j.ts.Name,
+        Format:    j.format,
+        BBox:      j.bbox,
+        Minzoom:   j.minzoom(),
+        Maxzoom:   j.maxzoom(),
+        Total:     j.total,
+        Done:      atomic.LoadInt64(&j.done),
+        Loaded:    atomic.LoadInt64(&j.loaded),
+        Missing:   atomic.LoadInt64(&j.missing),
+        Failed:    atomic.LoadInt64(&j.failed),
+        Running:   atomic.LoadInt32(&j.running) == 1,
+        Cancelled: atomic.LoadInt32(&j.cancelled) == 1,
+        Elapsed:   elapsed.Round(time.Millisecond).String(),
+    }
+}
+
+func (j *SeedJob) minzoom() int {
+    if len(j.ranges) == 0 {
+        return 0
+    }
+
+    return j.ranges[0].Z
+}
+
+func (j *SeedJob) maxzoom() int {
+    if len(j.ranges) == 0 {
+        return 0
+    }
+
+    return j.ranges[len(j.ranges)-1].Z
+}
+
+// NewSeedJob validates the request and plans the tiles to fetch. The zoom range is limited to the zooms of the
+// tileset, a range outside of the tileset zooms is an error.
+func NewSeedJob(tilesets *tileset.Registry, tiles *TileFetcher, req SeedRequest) (*SeedJob, error) {
+    ts := tilesets.Get(req.Tileset)
+
+    if ts == nil {
+        return nil, fmt.Errorf("unknown tileset: name = %s", req.Tileset)
+    }
+
+    format, ok := tilesetFormat(ts)
+
+    if !ok {
+        return nil, fmt.Errorf("unsupported tileset format: name = %s, format = %s", ts.Name, ts.Version.Format)
+    }
+
+    if req.Minzoom < 0 || req.Maxzoom > maxSeedZoom || req.Minzoom > req.Maxzoom {
+        return nil, fmt.Errorf("invalid zoom range, must be within 0-%d: minzoom = %d, maxzoom = %d",
+            maxSeedZoom, req.Minzoom, req.Maxzoom)
+    }
+
+    bbox := req.BBox
+
+    switch req.CRS {
+    case "", CRSWGS84:
+    case CRSBNG:
+        b := req.BBox
+
+        if b[0] < 0 || b[1] < 0 || b[2] > 700000 || b[3] > 1300000 || b[0] >= b[2] || b[1] >= b[3] {
+            return nil, fmt.Errorf("invalid bbox, must be a BNG min easting,min northing,max easting,max northing: bbox = %v", b)
+        }
+
+        bbox = tile.BBoxFromBNG(b)
+    default:
+        return nil, fmt.Errorf("unknown crs, must be %s or %s: crs = %s", CRSWGS84, CRSBNG, req.CRS)
+    }
+
+    if err := checkBBox(bbox); err != nil {
+        return nil, err
+    }
+
+    concurrency := req.Concurrency
+
+    if concurrency <= 0 {
+        concurrency = defaultSeedConcurrency
+    }
+
+    if concurrency > maxSeedConcurrency {
+        concurrency = maxSeedConcurrency
+    }
+
+    job := &SeedJob{
+        tiles:       tiles,
+        ts:          ts,
+        format:      format.Name,
+        bbox:        bbox,
+        concurrency: concurrency,
+        mu:          &sync.Mutex{},
+    }
+
+    minzoom, maxzoom := req.Minzoom, req.Maxzoom
+
+    if v := ts.Version; v != nil {
+        if minzoom < v.Minzoom {
+            minzoom = v.Minzoom
+        }
+
+        if maxzoom > v.Maxzoom {
+            maxzoom = v.Maxzoom
+        }
+
+        if minzoom > maxzoom {
+            return nil, fmt.Errorf("invalid zoom range, outside of the tileset zooms %d-%d: minzoom = %d, maxzoom = %d",
+                v.Minzoom, v.Maxzoom, req.Minzoom, req.Maxzoom)
+        }
+    }
+
+    for z := minzoom; z <= maxzoom; z++ {
+        r := tile.RangeFor(bbox, z)
+        job.ranges = append(job.ranges, r)
+        job.total += r.Count()
+    }
+
+    return job, nil
+}
+
+// checkBBox validates a WGS84 left, bottom, right, top bounding box
+func checkBBox(b mbtiles.BBox) error {
+    if b.Left() > b.Right() || b.Bottom() > b.Top() || b.Left() < -180 || b.Right() > 180 ||
+        b.Bottom() < -90 || b.Top() > 90 {
+        return fmt.Errorf("invalid bbox, must be a WGS84 left,bottom,right,top: bbox = %v", b)
+    }
+
+    return nil
+}
+
+// SeedHandler starts seed jobs, one at a time. A POST with a JSON seed request starts a job in the background and
+// returns its progress, e.g.
+//
+//  {"tileset": "zoomstack", "crs": "bng", "bbox": [400000, 100000, 480000, 170000], "minzoom": 6, "maxzoom": 14}
+//
+// A GET reports the progress of the current (or last) job and a DELETE cancels the running job. Requests for more
+// tiles than the maximum are refused.
+type SeedHandler struct {
+    mu       *sync.Mutex
+    tilesets *tileset.Registry
+    tiles    *TileFetcher
+    maxTiles int64
+    current  *SeedJob
+    cancel   context.CancelFunc
+    stopped  chan struct{}
+}
+
+func (h *SeedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    // a new job is read and planned before the lock is taken, so a slow client cannot hold up the other requests
+    if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+        h.start(w, r)
+        return
+    }
+
+    h.mu.Lock()
+    defer h.mu.Unlock()
+
+    switch r.Method {
+    case http.MethodGet:
+        if h.current == nil {
+            writeError(r.Context(), w, &Error{Code: http.StatusNotFound, Status: http.StatusNotFound, Message: "no seed job"})
+            return
+        }
+
+        writeJSON(r.Context(), w, http.StatusOK, h.current.Progress())
+    case http.MethodDelete:
+        if h.current == nil || !h.current.Progress().Running {
+            writeError(r.Context(), w, &Error{Code: http.StatusNotFound, Status: http.StatusNotFound, Message: "no seed job running"})
+            return
+        }
+
+        h.stop()
+        writeJSON(r.Context(), w, http.StatusOK, h.current.Progress())
+    }
+}
+
+// start plans the requested job and runs it in the background, the lock is only held to swap in the new job
+func (h *SeedHandler) start(w http.ResponseWriter, r *http.Request) {
+    req := SeedRequest{}
+
+    if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSeedBody)).Decode(&req); err != nil {
+        writeError(r.Context(), w, &Error{Code: http.StatusBadRequest, Status: http.StatusBadRequest, Message: fmt.Sprintf("invalid seed request: error = %s", err)})
+        return
+    }
+
+    job, err := NewSeedJob(h.tilesets, h.tiles, req)
+
+    if err != nil {
+        writeError(r.Context(), w, &Error{Code: http.StatusBadRequest, Status: http.StatusBadRequest, Message: err.Error()})
+        return
+    }
+
+    if h.maxTiles > 0 && job.total > h.maxTiles {
+        writeError(r.Context(), w, &Error{
+            Code: http.StatusBadRequest, Status: http.StatusBadRequest,
+            Message: fmt.Sprintf("too many tiles to seed, reduce the bbox or zoom range: tiles = %d, max = %d", job.total, h.maxTiles),
+        })
+        return
+    }
+
+    h.mu.Lock()
+    defer h.mu.Unlock()
+
+    if h.current != nil && h.current.Progress().Running {
+        writeError(r.Context(), w, &Error{Code: http.StatusConflict, Status: http.StatusConflict, Message: "a seed job is already running"})
+        return
+    }
+
+    // the job outlives the request, but keeps its IDs for logging
+    ctx, cancel := context.WithCancel(detach(r.Context()))
+    stopped := make(chan struct{})
+
+    h.current, h.cancel, h.stopped = job, cancel, stopped
+    atomic.StoreInt32(&job.running, 1)
+
+    go func() {
+        defer close(stopped)
+        defer cancel()
+
+        job.Run(ctx)
+    }()
+
+    writeJSON(r.Context(), w, http.StatusAccepted, job.Progress())
+}
+
+// stop cancels the current job, waiting for it to stop
+func (h *SeedHandler) stop() {
+    if h.cancel == nil {
+        return
+    }
+
+    h.cancel()
+    <-h.stopped
+}
+
+// Cancel stops any running job, waiting for the fetches in flight to finish, e.g. when the server shuts down
+func (h *SeedHandler) Cancel() {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+
+    h.stop()
+}
+
+// NewSeedHandler creates the handler for seed jobs, limiting each job to the max tiles (zero for no limit)
+func NewSeedHandler(tilesets *tileset.Registry, tiles *TileFetcher, maxTiles int64) *SeedHandler {
+    return &SeedHandler{
+        mu:       &sync.Mutex{},
+        tilesets: tilesets,
+        tiles:    tiles,
+        maxTiles: maxTiles,
+    }
+}
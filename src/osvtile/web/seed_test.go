@@ -0,0 +1,209 @@
+package web
+
+import (
+    "context"
+    "encoding/json"
+    "github.com/stretchr/testify/require"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "osdata/osvtile/container/lru"
+    "osdata/osvtile/mbtiles"
+    "osdata/osvtile/mbtiles/mbtilestest"
+    "osdata/osvtile/tile"
+    "osdata/osvtile/tileset"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+func TestSeedJob(t *testing.T) {
+    source := mbtilestest.NewSource("pbf")
+    tilesets := tileset.NewRegistry()
+    _, err := tilesets.Add(tileset.Config{Name: "fake", Scheme: "tms"}, source)
+    require.NoError(t, err)
+
+    cache := lru.New(1024*1024, lru.WithNegative(100, time.Minute))
+    tiles := NewTileFetcher(cache, nil, nil)
+
+    // the zooms are limited to those of the tileset
+    job, err := NewSeedJob(tilesets, tiles, SeedRequest{Tileset: "fake", BBox: mbtiles.BBox{-180, -85, 180, 85}, Maxzoom: 5})
+    require.NoError(t, err)
+
+    job.Run(context.Background())
+
+    p := job.Progress()
+    require.False(t, p.Running)
+    require.Equal(t, "mvt", p.Format)
+    require.Equal(t, 2, p.Maxzoom)
+    require.Equal(t, int64(1+4+16), p.Total)
+    require.Equal(t, p.Total, p.Done)
+    require.Equal(t, int64(1+2+4), p.Loaded)
+    require.Equal(t, p.Total-p.Loaded, p.Missing)
+    require.Equal(t, 21, source.Fetches())
+
+    // the diagonal in TMS rows is the anti-diagonal in XYZ
+    require.True(t, cache.Exists(tile.Key{Tileset: "fake", Format: "mvt", Z: 2, X: 0, Y: 3}.String()))
+    require.True(t, cache.Missing(tile.Key{Tileset: "fake", Format: "mvt", Z: 2, X: 0, Y: 0}.String()))
+
+    _, err = NewSeedJob(tilesets, tiles, SeedRequest{Tileset: "other", Maxzoom: 1})
+    require.Error(t, err)
+
+    // tilesets of unsupported formats are not seeded
+    _, err = tilesets.Add(tileset.Config{Name: "tiff"}, mbtilestest.NewSource("tiff"))
+    require.NoError(t, err)
+    _, err = NewSeedJob(tilesets, tiles, SeedRequest{Tileset: "tiff", Maxzoom: 1})
+    require.Error(t, err)
+
+    _, err = NewSeedJob(tilesets, tiles, SeedRequest{Tileset: "fake", Minzoom: 3, Maxzoom: 1})
+    require.Error(t, err)
+
+    _, err = NewSeedJob(tilesets, tiles, SeedRequest{Tileset: "fake", CRS: "bng", BBox: mbtiles.BBox{-1.5, 50, -1, 51}})
+    require.Error(t, err)
+
+    // Hampshire in British National Grid
+    job, err = NewSeedJob(tilesets, tiles, SeedRequest{Tileset: "fake", CRS: "bng", BBox: mbtiles.BBox{400000, 100000, 480000, 170000}})
+    require.NoError(t, err)
+    require.Equal(t, int64(1), job.Progress().Total)
+}
+
+func TestSeedJob_Zooms(t *testing.T) {
+    tilesets := tileset.NewRegistry()
+    _, err := tilesets.Add(tileset.Config{Name: "z0"}, &mbtilestest.Source{Meta: &mbtiles.Version{Format: "pbf"}})
+    require.NoError(t, err)
+    _, err = tilesets.Add(tileset.Config{Name: "z5_8"}, &mbtilestest.Source{Meta: &mbtiles.Version{Format: "pbf", Minzoom: 5, Maxzoom: 8}})
+    require.NoError(t, err)
+
+    tiles := NewTileFetcher(lru.New(1024*1024), nil, nil)
+    world := mbtiles.BBox{-180, -85, 180, 85}
+
+    // a package of only zoom 0 is still clamped
+    job, err := NewSeedJob(tilesets, tiles, SeedRequest{Tileset: "z0", BBox: world, Maxzoom: 14})
+    require.NoError(t, err)
+    require.Equal(t, 0, job.Progress().Maxzoom)
+    require.Equal(t, int64(1), job.Progress().Total)
+
+    job, err = NewSeedJob(tilesets, tiles, SeedRequest{Tileset: "z5_8", BBox: world, Minzoom: 0, Maxzoom: 6})
+    require.NoError(t, err)
+    require.Equal(t, 5, job.Progress().Minzoom)
+    require.Equal(t, 6, job.Progress().Maxzoom)
+
+    // a range outside of the package zooms is refused
+    _, err = NewSeedJob(tilesets, tiles, SeedRequest{Tileset: "z5_8", BBox: world, Minzoom: 9, Maxzoom: 12})
+    require.Error(t, err)
+
+    _, err = NewSeedJob(tilesets, tiles, SeedRequest{Tileset: "z5_8", BBox: world, Minzoom: 0, Maxzoom: 4})
+    require.Error(t, err)
+}
+
+func TestSeedHandler(t *testing.T) {
+    tilesets := tileset.NewRegistry()
+    source := mbtilestest.NewSource("pbf")
+    source.Tile = mbtilestest.Blocking
+    _, err := tilesets.Add(tileset.Config{Name: "slow"}, source)
+    require.NoError(t, err)
+
+    h := NewSeedHandler(tilesets, NewTileFetcher(lru.New(1024*1024), nil, nil), 10)
+
+    serve := func(method, body string) (*httptest.ResponseRecorder, *SeedProgress) {
+        w := httptest.NewRecorder()
+        h.ServeHTTP(w, httptest.NewRequest(method, "/admin/cache/seed", strings.NewReader(body)))
+
+        p := &SeedProgress{}
+
+        if w.Code < 300 {
+            require.NoError(t, json.Unmarshal(w.Body.Bytes(), p))
+        }
+
+        return w, p
+    }
+
+    w, _ := serve("GET", "")
+    require.Equal(t, http.StatusNotFound, w.Code)
+
+    w, _ = serve("DELETE", "")
+    require.Equal(t, http.StatusNotFound, w.Code)
+
+    // zooms 0-2 of the world is 21 tiles, over the max of 10
+    w, _ = serve("POST", `{"tileset": "slow", "bbox": [-180, -85, 180, 85], "maxzoom": 2}`)
+    require.Equal(t, http.StatusBadRequest, w.Code)
+    require.Contains(t, w.Body.String(), "too many tiles")
+
+    w, p := serve("POST", `{"tileset": "slow", "bbox": [-180, -85, 180, 85], "maxzoom": 1}`)
+    require.Equal(t, http.StatusAccepted, w.Code)
+    require.True(t, p.Running)
+    require.Equal(t, int64(5), p.Total)
+
+    w, _ = serve("POST", `{"tileset": "slow", "bbox": [-180, -85, 180, 85], "maxzoom": 1}`)
+    require.Equal(t, http.StatusConflict, w.Code)
+
+    // the fetches never finish, so only a cancel stops the job
+    w, p = serve("DELETE", "")
+    require.Equal(t, http.StatusOK, w.Code)
+    require.False(t, p.Running)
+    require.True(t, p.Cancelled)
+    require.Equal(t, int64(0), p.Failed)
+    require.True(t, p.Done < p.Total)
+
+    // a new job can then start, and is stopped by the server shutting down
+    w, _ = serve("POST", `{"tileset": "slow", "bbox": [-180, -85, 180, 85], "maxzoom": 1}`)
+    require.Equal(t, http.StatusAccepted, w.Code)
+
+    h.Cancel()
+
+    _, p = serve("GET", "")
+    require.False(t, p.Running)
+    require.True(t, p.Cancelled)
+
+    // cancelling with no job running does nothing
+    h.Cancel()
+}
+
+// readingBody reports when the request body is first read
+type readingBody struct {
+    r       io.Reader
+    reading chan struct{}
+    once    sync.Once
+}
+
+func (b *readingBody) Read(p []byte) (int, error) {
+    b.once.Do(func() { close(b.reading) })
+    return b.r.Read(p)
+}
+
+func TestSeedHandler_SlowBody(t *testing.T) {
+    h := NewSeedHandler(tileset.NewRegistry(), NewTileFetcher(lru.New(1024*1024), nil, nil), 10)
+
+    // a client which never finishes sending its request
+    pipe, sender := io.Pipe()
+    defer sender.Close()
+    body := &readingBody{r: pipe, reading: make(chan struct{})}
+
+    started := make(chan struct{})
+    go func() {
+        defer close(started)
+        h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/admin/cache/seed", body))
+    }()
+
+    <-body.reading
+
+    // the other requests and a shutdown are not held up while the body is read
+    done := make(chan struct{})
+    go func() {
+        defer close(done)
+        w := httptest.NewRecorder()
+        h.ServeHTTP(w, httptest.NewRequest("GET", "/admin/cache/seed", nil))
+        require.Equal(t, http.StatusNotFound, w.Code)
+        h.Cancel()
+    }()
+
+    select {
+    case <-done:
+    case <-time.After(time.Second):
+        t.Fatal("blocked by a request body still being read")
+    }
+
+    require.NoError(t, sender.Close())
+    <-started
+}
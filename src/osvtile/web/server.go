@@ -13,7 +13,8 @@ import (
 
 // Server type wraps a HTTP server
 type Server struct {
-	s *http.Server
+	s          *http.Server
+	onShutdown []func()
 }
 
 // NewServer constructs a web server which can then be invoked via the `Server.Run()` command.
@@ -31,13 +32,19 @@ func NewServer(router http.Handler, port int) *Server {
 	}
 }
 
+// OnShutdown registers a func to be called once the server has shut down, before `Server.Run()` returns. Funcs are
+// called in the order they were registered.
+func (s *Server) OnShutdown(fn func()) {
+	s.onShutdown = append(s.onShutdown, fn)
+}
+
 // Run will start the server and wait for error or shutdown - this will block the caller. Any error encountered
 // during server startup or operation will be returned to the caller here. The server can be exit'ed using a
 // SIGINT, SIGTERM or SIGQUIT interrupt
 func (s *Server) Run() error {
-	tchan := make(chan os.Signal)
+	tchan := make(chan os.Signal, 1)
 	echan := make(chan error)
-	signal.Notify(tchan, os.Interrupt, os.Kill, syscall.SIGQUIT)
+	signal.Notify(tchan, os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT)
 
 	go func() {
 		log.Printf("starting server: host = %s", s.s.Addr)
@@ -61,5 +68,10 @@ func (s *Server) Run() error {
 	if err := s.s.Shutdown(ctx); err != nil {
 		log.Printf("server shutdown failed to exit gracefully: error = %s", err)
 	}
+
+	for _, fn := range s.onShutdown {
+		fn()
+	}
+
 	return err
 }
@@ -0,0 +1,335 @@
+package web
+
+import (
+    "bufio"
+    "context"
+    "encoding/binary"
+    "encoding/json"
+    "fmt"
+    "hash/crc32"
+    "io"
+    "io/ioutil"
+    "os"
+    "osdata/osvtile/tile"
+    "osdata/osvtile/tileset"
+    "osdata/osvtile/trace"
+    "path/filepath"
+    "time"
+)
+
+const (
+    // snapshotMagic starts every snapshot file
+    snapshotMagic = "OSVTSNAP"
+    // snapshotVersion is bumped whenever the layout changes, older snapshots are then ignored
+    snapshotVersion uint16 = 1
+    // snapshot record types
+    recordValue byte = 'V'
+    recordKey   byte = 'K'
+    recordEnd   byte = 'E'
+    // maxSnapshotHeader limits the header length read from a snapshot, before anything else of it has been checked
+    maxSnapshotHeader = 1024 * 1024
+)
+
+// snapshotHeader records the tileset packages the cached tiles came from
+type snapshotHeader struct {
+    Created  time.Time                  `json:"created"`
+    Tilesets map[string]snapshotTileset `json:"tilesets"`
+}
+
+type snapshotTileset struct {
+    Path    string    `json:"path"`
+    ModTime time.Time `json:"modTime"`
+    Size    int64     `json:"size"`
+}
+
+// matches checks if the tileset is still backed by the same package as when the snapshot was written
+func (s snapshotTileset) matches(ts *tileset.Tileset) bool {
+    return ts != nil && !ts.ModTime.IsZero() && ts.ModTime.Equal(s.ModTime) && ts.Size == s.Size
+}
+
+// WriteSnapshot saves the cached tiles to a file so they can be loaded when the server next starts. Only tiles of
+// tilesets backed by an MBTiles file are saved. The layout is:
+//
+//  magic, version (uint16), header length (uint32), JSON header, records..., end record
+//
+// where the records are either a value (type, length uint32, crc32 uint32, bytes) or a key (type, length uint16,
+// bytes, index of its value uint32), so values shared by several tiles are written once. The records of each cache
+// shard are written coldest first, so loading them into a smaller cache keeps the hottest tiles. The context's trace
+// tags the logs of the write.
+func (f *TileFetcher) WriteSnapshot(ctx context.Context, path string, tilesets *tileset.Registry) (int, error) {
+    start := time.Now()
+    header := &snapshotHeader{Created: start.UTC(), Tilesets: map[string]snapshotTileset{}}
+
+    for _, name := range tilesets.Names() {
+        ts := tilesets.Get(name)
+
+        if ts.ModTime.IsZero() {
+            continue
+        }
+
+        header.Tilesets[name] = snapshotTileset{Path: ts.Path, ModTime: ts.ModTime, Size: ts.Size}
+    }
+
+    // write to a temporary file and rename, so a failed write never replaces a good snapshot
+    tmp, err := ioutil.TempFile(filepath.Dir(path), ".snapshot-")
+
+    if err != nil {
+        return 0, err
+    }
+
+    defer func() {
+        _ = tmp.Close()
+        _ = os.Remove(tmp.Name())
+    }()
+
+    w := bufio.NewWriterSize(tmp, 1024*1024)
+    packet, _ := json.Marshal(header)
+
+    _, _ = w.WriteString(snapshotMagic)
+    _ = binary.Write(w, binary.BigEndian, snapshotVersion)
+    _ = binary.Write(w, binary.BigEndian, uint32(len(packet)))
+    _, _ = w.Write(packet)
+
+    values := map[string]uint32{}
+    entries := 0
+
+    err = f.cache.Walk(func(key string, value []byte, md5 string) error {
+        k, err := tile.ParseKey(key)
+
+        if err != nil {
+            return nil
+        }
+
+        if _, ok := header.Tilesets[k.Tileset]; !ok {
+            return nil
+        }
+
+        index, ok := values[md5]
+
+        if !ok {
+            index = uint32(len(values))
+            values[md5] = index
+
+            _ = w.WriteByte(recordValue)
+            _ = binary.Write(w, binary.BigEndian, uint32(len(value)))
+            _ = binary.Write(w, binary.BigEndian, crc32.ChecksumIEEE(value))
+            _, _ = w.Write(value)
+        }
+
+        _ = w.WriteByte(recordKey)
+        _ = binary.Write(w, binary.BigEndian, uint16(len(key)))
+        _, _ = w.WriteString(key)
+        _ = binary.Write(w, binary.BigEndian, index)
+        entries++
+
+        return nil
+    })
+
+    if err != nil {
+        return 0, err
+    }
+
+    _ = w.WriteByte(recordEnd)
+
+    // bufio holds on to the first write error, so this reports any failure above
+    if err := w.Flush(); err != nil {
+        return 0, err
+    }
+
+    if err := tmp.Sync(); err != nil {
+        return 0, err
+    }
+
+    if err := tmp.Close(); err != nil {
+        return 0, err
+    }
+
+    if err := os.Rename(tmp.Name(), path); err != nil {
+        return 0, err
+    }
+
+    trace.Printf(ctx, "wrote cache snapshot: path = %s, entries = %d, values = %d, elapsed = %s",
+        path, entries, len(values), time.Since(start))
+
+    return entries, nil
+}
+
+// LoadSnapshot fills the cache from a snapshot file, returning the number of tiles loaded. A missing snapshot, or one
+// written by a different version, loads nothing. Tiles of tilesets whose MBTiles file has changed since the snapshot
+// was written are skipped. The context's trace tags the logs of the load.
+func (f *TileFetcher) LoadSnapshot(ctx context.Context, path string, tilesets *tileset.Registry) (int, error) {
+    start := time.Now()
+    file, err := os.Open(path)
+
+    if os.IsNotExist(err) {
+        return 0, nil
+    }
+
+    if err != nil {
+        return 0, err
+    }
+
+    defer file.Close()
+
+    r := bufio.NewReaderSize(file, 1024*1024)
+    header, err := readSnapshotHeader(r)
+
+    if err != nil {
+        return 0, err
+    }
+
+    if header == nil {
+        trace.Printf(ctx, "ignoring cache snapshot from another version: path = %s", path)
+        return 0, nil
+    }
+
+    valid := map[string]bool{}
+
+    for name, s := range header.Tilesets {
+        if valid[name] = s.matches(tilesets.Get(name)); !valid[name] {
+            trace.Printf(ctx, "ignoring cache snapshot of changed tileset: name = %s", name)
+        }
+    }
+
+    // no value larger than the cache is ever written, so a longer length is corrupt rather than a huge allocation
+    maxsize := f.cache.Status().MaxSize
+    var values [][]byte
+    entries := 0
+
+    for {
+        kind, err := r.ReadByte()
+
+        if err != nil {
+            return entries, truncated(err)
+        }
+
+        switch kind {
+        case recordEnd:
+            trace.Printf(ctx, "loaded cache snapshot: path = %s, created = %s, entries = %d, elapsed = %s",
+                path, header.Created, entries, time.Since(start))
+            return entries, nil
+        case recordValue:
+            value, err := readSnapshotValue(r, maxsize)
+
+            if err != nil {
+                return entries, err
+            }
+
+            values = append(values, value)
+        case recordKey:
+            key, index, err := readSnapshotKey(r)
+
+            if err != nil {
+                return entries, err
+            }
+
+            if int(index) >= len(values) {
+                return entries, fmt.Errorf("corrupt snapshot, unknown value: key = %s, index = %d", key, index)
+            }
+
+            if k, err := tile.ParseKey(key); err == nil && valid[k.Tileset] {
+                f.cache.Set(key, values[index])
+                entries++
+            }
+        default:
+            return entries, fmt.Errorf("corrupt snapshot, unknown record: type = %d", kind)
+        }
+    }
+}
+
+// readSnapshotHeader checks the magic and version, returning a nil header for another version
+func readSnapshotHeader(r io.Reader) (*snapshotHeader, error) {
+    magic := make([]byte, len(snapshotMagic))
+
+    if _, err := io.ReadFull(r, magic); err != nil || string(magic) != snapshotMagic {
+        return nil, fmt.Errorf("not a cache snapshot")
+    }
+
+    var version uint16
+    var length uint32
+
+    if err := binary.Read(r, binary.BigEndian, &version); err != nil {
+        return nil, truncated(err)
+    }
+
+    if version != snapshotVersion {
+        return nil, nil
+    }
+
+    if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+        return nil, truncated(err)
+    }
+
+    if length > maxSnapshotHeader {
+        return nil, fmt.Errorf("corrupt snapshot, header too large: length = %d", length)
+    }
+
+    packet := make([]byte, length)
+
+    if _, err := io.ReadFull(r, packet); err != nil {
+        return nil, truncated(err)
+    }
+
+    header := &snapshotHeader{}
+
+    if err := json.Unmarshal(packet, header); err != nil {
+        return nil, fmt.Errorf("invalid snapshot header: error = %s", err)
+    }
+
+    return header, nil
+}
+
+// readSnapshotValue reads a value record, refusing a length over the maximum size before allocating the value
+func readSnapshotValue(r io.Reader, maxsize int64) ([]byte, error) {
+    var length, sum uint32
+
+    if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+        return nil, truncated(err)
+    }
+
+    if int64(length) > maxsize {
+        return nil, fmt.Errorf("corrupt snapshot, value too large: length = %d, max size = %d", length, maxsize)
+    }
+
+    if err := binary.Read(r, binary.BigEndian, &sum); err != nil {
+        return nil, truncated(err)
+    }
+
+    value := make([]byte, length)
+
+    if _, err := io.ReadFull(r, value); err != nil {
+        return nil, truncated(err)
+    }
+
+    if crc32.ChecksumIEEE(value) != sum {
+        return nil, fmt.Errorf("corrupt snapshot, checksum mismatch")
+    }
+
+    return value, nil
+}
+
+func readSnapshotKey(r io.Reader) (string, uint32, error) {
+    var length uint16
+    var index uint32
+
+    if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+        return "", 0, truncated(err)
+    }
+
+    key := make([]byte, length)
+
+    if _, err := io.ReadFull(r, key); err != nil {
+        return "", 0, truncated(err)
+    }
+
+    if err := binary.Read(r, binary.BigEndian, &index); err != nil {
+        return "", 0, truncated(err)
+    }
+
+    return string(key), index, nil
+}
+
+// truncated reports a read of the snapshot failing part way through a record
+func truncated(err error) error {
+    return fmt.Errorf("truncated snapshot: error = %s", err)
+}
@@ -0,0 +1,152 @@
+package web
+
+import (
+    "context"
+    "encoding/binary"
+    "github.com/stretchr/testify/require"
+    "io/ioutil"
+    "os"
+    "osdata/osvtile/container/lru"
+    "osdata/osvtile/mbtiles/mbtilestest"
+    "osdata/osvtile/tile"
+    "osdata/osvtile/tileset"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+func TestSnapshot(t *testing.T) {
+    dir, err := ioutil.TempDir("", "snapshot-test")
+    require.NoError(t, err)
+    defer os.RemoveAll(dir)
+
+    path := filepath.Join(dir, "cache.snapshot")
+    modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+    tilesets := tileset.NewRegistry()
+
+    for _, name := range []string{"a", "b", "memory"} {
+        ts, err := tilesets.Add(tileset.Config{Name: name}, mbtilestest.NewSource("pbf"))
+        require.NoError(t, err)
+
+        // only tilesets backed by a file are saved
+        if name != "memory" {
+            ts.ModTime, ts.Size = modTime, 1024
+        }
+    }
+
+    tiles := NewTileFetcher(lru.New(1024*1024), nil, nil)
+
+    for _, k := range []tile.Key{
+        {Tileset: "a", Format: "mvt", Z: 1, X: 0, Y: 0},
+        {Tileset: "a", Format: "mvt", Z: 1, X: 1, Y: 0},
+        {Tileset: "b", Format: "mvt", Z: 1, X: 0, Y: 0},
+        {Tileset: "memory", Format: "mvt", Z: 1, X: 0, Y: 0},
+    } {
+        _, _, err := tiles.Fetch(context.Background(), k, func(ctx context.Context) ([]byte, error) {
+            return []byte("shared"), nil
+        })
+        require.NoError(t, err)
+    }
+
+    entries, err := tiles.WriteSnapshot(context.Background(), path, tilesets)
+    require.NoError(t, err)
+    require.Equal(t, 3, entries)
+
+    // nothing to load
+    empty := NewTileFetcher(lru.New(1024*1024), nil, nil)
+    loaded, err := empty.LoadSnapshot(context.Background(), filepath.Join(dir, "missing"), tilesets)
+    require.NoError(t, err)
+    require.Equal(t, 0, loaded)
+
+    // tileset b changes after the snapshot is written, so only a is loaded
+    tilesets.Get("b").ModTime = modTime.Add(time.Hour)
+
+    restored := NewTileFetcher(lru.New(1024*1024), nil, nil)
+    loaded, err = restored.LoadSnapshot(context.Background(), path, tilesets)
+    require.NoError(t, err)
+    require.Equal(t, 2, loaded)
+
+    status := restored.Status()
+    require.Equal(t, 2, status.Elements)
+    require.Equal(t, 1, status.Payloads)
+
+    value, _, err := restored.Fetch(context.Background(), tile.Key{Tileset: "a", Format: "mvt", Z: 1, X: 1, Y: 0}, func(ctx context.Context) ([]byte, error) {
+        t.Fatal("tile should be loaded from the snapshot")
+        return nil, nil
+    })
+    require.NoError(t, err)
+    require.Equal(t, []byte("shared"), value)
+
+    // a snapshot from another version is ignored
+    data, err := ioutil.ReadFile(path)
+    require.NoError(t, err)
+    data[len(snapshotMagic)+1]++
+    require.NoError(t, ioutil.WriteFile(path, data, 0644))
+
+    loaded, err = NewTileFetcher(lru.New(1024*1024), nil, nil).LoadSnapshot(context.Background(), path, tilesets)
+    require.NoError(t, err)
+    require.Equal(t, 0, loaded)
+}
+
+func TestSnapshot_Corrupt(t *testing.T) {
+    dir, err := ioutil.TempDir("", "snapshot-test")
+    require.NoError(t, err)
+    defer os.RemoveAll(dir)
+
+    path := filepath.Join(dir, "cache.snapshot")
+
+    tilesets := tileset.NewRegistry()
+    ts, err := tilesets.Add(tileset.Config{Name: "a"}, mbtilestest.NewSource("pbf"))
+    require.NoError(t, err)
+    ts.ModTime, ts.Size = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), 1024
+
+    tiles := NewTileFetcher(lru.New(1024*1024), nil, nil)
+    _, _, err = tiles.Fetch(context.Background(), tile.Key{Tileset: "a", Format: "mvt", Z: 0}, func(ctx context.Context) ([]byte, error) {
+        return []byte("tile"), nil
+    })
+    require.NoError(t, err)
+
+    _, err = tiles.WriteSnapshot(context.Background(), path, tilesets)
+    require.NoError(t, err)
+
+    good, err := ioutil.ReadFile(path)
+    require.NoError(t, err)
+
+    // the header follows the magic, version and its length, then the value record: type, length, crc and bytes
+    header := len(snapshotMagic) + 2
+    value := header + 4 + int(binary.BigEndian.Uint32(good[header:])) + 1
+
+    load := func(data []byte) error {
+        require.NoError(t, ioutil.WriteFile(path, data, 0644))
+        _, err := NewTileFetcher(lru.New(1024*1024), nil, nil).LoadSnapshot(context.Background(), path, tilesets)
+        return err
+    }
+
+    require.NoError(t, load(good))
+
+    for _, cut := range []int{header + 2, value - 3, value + 2, value + 8 + 2, len(good) - 1} {
+        err := load(good[:cut])
+        require.Error(t, err, "cut = %d", cut)
+        require.Contains(t, err.Error(), "truncated snapshot", "cut = %d", cut)
+    }
+
+    corrupt := func(fn func(data []byte)) []byte {
+        data := append([]byte(nil), good...)
+        fn(data)
+        return data
+    }
+
+    err = load(corrupt(func(data []byte) { data[value+8]++ }))
+    require.Error(t, err)
+    require.Contains(t, err.Error(), "corrupt snapshot, checksum mismatch")
+
+    // lengths over the limits are refused before anything is allocated
+    err = load(corrupt(func(data []byte) { binary.BigEndian.PutUint32(data[header:], 0xffffffff) }))
+    require.Error(t, err)
+    require.Contains(t, err.Error(), "corrupt snapshot, header too large")
+
+    err = load(corrupt(func(data []byte) { binary.BigEndian.PutUint32(data[value:], 1024*1024+1) }))
+    require.Error(t, err)
+    require.Contains(t, err.Error(), "corrupt snapshot, value too large")
+}
@@ -0,0 +1,124 @@
+package web
+
+import (
+    "encoding/json"
+    "fmt"
+    "github.com/gorilla/mux"
+    "net/http"
+    "osdata/osvtile/mbtiles"
+    "osdata/osvtile/tileset"
+    "osdata/osvtile/trace"
+    "strconv"
+    "strings"
+)
+
+// TileJSONVersion is the version of the TileJSON spec that the documents conform to
+const TileJSONVersion = "3.0.0"
+
+// TileJSON is a TileJSON 3.0 document describing a tileset, see https://github.com/mapbox/tilejson-spec
+type TileJSON struct {
+    TileJSON     string                `json:"tilejson"`
+    Name         string                `json:"name,omitempty"`
+    Description  string                `json:"description,omitempty"`
+    Attribution  string                `json:"attribution,omitempty"`
+    Scheme       string                `json:"scheme"`
+    Tiles        []string              `json:"tiles"`
+    Minzoom      int                   `json:"minzoom"`
+    Maxzoom      int                   `json:"maxzoom"`
+    Bounds       []float64             `json:"bounds,omitempty"`
+    Center       []float64             `json:"center,omitempty"`
+    VectorLayers []mbtiles.VectorLayer `json:"vector_layers,omitempty"`
+}
+
+// NewTileJSON builds the TileJSON document for the tileset, with the (XYZ) tile URL templates rooted at the given
+// base URL, e.g. `https://tiles.example.com`. There is no document for tilesets of an unsupported format.
+func NewTileJSON(ts *tileset.Tileset, base string) (*TileJSON, bool) {
+    v := ts.Version
+    format, ok := tilesetFormat(ts)
+
+    if !ok {
+        return nil, false
+    }
+
+    tj := &TileJSON{
+        TileJSON:     TileJSONVersion,
+        Name:         v.Name,
+        Description:  v.Description,
+        Attribution:  v.Attribution,
+        Scheme:       string(mbtiles.XYZ),
+        Tiles:        []string{fmt.Sprintf("%s/%s/{z}/{x}/{y}/%s", base, ts.Name, format.File)},
+        Minzoom:      v.Minzoom,
+        Maxzoom:      v.Maxzoom,
+        VectorLayers: v.VectorLayers,
+    }
+
+    if v.Bounds != (mbtiles.BBox{}) {
+        tj.Bounds = v.Bounds[:]
+    }
+
+    if v.Center != (mbtiles.Position{}) {
+        tj.Center = v.Center[:]
+    }
+
+    return tj, true
+}
+
+// TilesetMatcher will only match routes of the form `/{name}.json` where the name is a loaded tileset. This
+// prevents the TileJSON route from hiding static JSON content such as the map styles.
+func TilesetMatcher(tilesets *tileset.Registry) mux.MatcherFunc {
+    return func(r *http.Request, rm *mux.RouteMatch) bool {
+        name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), ".json")
+        return tilesets.Get(name) != nil
+    }
+}
+
+// NewTileJSONHandler serves the TileJSON document for the tileset named in the request, or the `fallback` tileset
+// when the route does not include a name
+func NewTileJSONHandler(tilesets *tileset.Registry, fallback string) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        name, ok := mux.Vars(r)["name"]
+
+        if !ok {
+            name = fallback
+        }
+
+        ts := tilesets.Get(name)
+
+        if ts == nil {
+            w.WriteHeader(http.StatusNotFound)
+            return
+        }
+
+        tj, ok := NewTileJSON(ts, baseURL(r))
+
+        if !ok {
+            w.WriteHeader(http.StatusNotFound)
+            return
+        }
+
+        packet, _ := json.Marshal(tj)
+        w.Header().Set("content-type", "application/json")
+        w.Header().Set("content-length", strconv.Itoa(len(packet)))
+        w.WriteHeader(http.StatusOK)
+
+        if _, err := w.Write(packet); err != nil {
+            trace.Printf(r.Context(), "failed to write tilejson to client: error = %s", err)
+        }
+    }
+}
+
+// baseURL reports the scheme and host the client used to make the request. When proxy header support is enabled
+// the scheme will already have been set from the forwarded headers.
+func baseURL(r *http.Request) string {
+    scheme := r.URL.Scheme
+
+    if scheme == "" {
+        scheme = "http"
+
+        if r.TLS != nil {
+            scheme = "https"
+        }
+    }
+
+    return fmt.Sprintf("%s://%s", scheme, r.Host)
+}
@@ -0,0 +1,116 @@
+package web
+
+import (
+    "crypto/tls"
+    "encoding/json"
+    "github.com/gorilla/handlers"
+    "github.com/gorilla/mux"
+    "github.com/stretchr/testify/require"
+    "net/http"
+    "net/http/httptest"
+    "osdata/osvtile/mbtiles"
+    "osdata/osvtile/mbtiles/mbtilestest"
+    "osdata/osvtile/tileset"
+    "testing"
+)
+
+func newTileJSONRouter(t *testing.T) *mux.Router {
+    minzoom := 2
+
+    tilesets := tileset.NewRegistry()
+    _, err := tilesets.Add(tileset.Config{Name: "zoomstack"}, &mbtilestest.Source{Meta: &mbtiles.Version{
+        Name:         "OS Open Zoomstack",
+        Format:       "pbf",
+        Scheme:       mbtiles.TMS,
+        Minzoom:      0,
+        Maxzoom:      14,
+        Attribution:  "Contains OS data",
+        Bounds:       mbtiles.BBox{-9, 49.8, 2, 61},
+        Center:       mbtiles.Position{-1.4, 50.9, 7},
+        VectorLayers: []mbtiles.VectorLayer{{ID: "roads", Fields: map[string]string{"type": "String"}, Minzoom: &minzoom}},
+    }})
+    require.NoError(t, err)
+    _, err = tilesets.Add(tileset.Config{Name: "hillshade"}, &mbtilestest.Source{Meta: &mbtiles.Version{
+        Name:    "Hillshade",
+        Format:  "png",
+        Maxzoom: 12,
+    }})
+    require.NoError(t, err)
+    _, err = tilesets.Add(tileset.Config{Name: "photo"}, &mbtilestest.Source{Meta: &mbtiles.Version{Format: "jpg"}})
+    require.NoError(t, err)
+    _, err = tilesets.Add(tileset.Config{Name: "unknown"}, &mbtilestest.Source{Meta: &mbtiles.Version{Format: "tiff"}})
+    require.NoError(t, err)
+
+    r := mux.NewRouter()
+    r.HandleFunc("/tiles.json", NewTileJSONHandler(tilesets, "zoomstack"))
+    r.HandleFunc("/{name:[A-Za-z0-9_]+}.json", NewTileJSONHandler(tilesets, "")).MatcherFunc(TilesetMatcher(tilesets))
+    r.NotFoundHandler = http.HandlerFunc(NotFounderHandler)
+
+    return r
+}
+
+func readTileJSON(t *testing.T, w *httptest.ResponseRecorder) map[string]interface{} {
+    require.Equal(t, http.StatusOK, w.Code)
+    require.Equal(t, "application/json", w.Header().Get("content-type"))
+
+    var doc map[string]interface{}
+    require.NoError(t, json.Unmarshal(w.Body.Bytes(), &doc))
+
+    return doc
+}
+
+func TestTileJSONHandler(t *testing.T) {
+    r := newTileJSONRouter(t)
+
+    doc := readTileJSON(t, get(r, "http://tiles.example.com/zoomstack.json"))
+    require.Equal(t, "3.0.0", doc["tilejson"])
+    require.Equal(t, "OS Open Zoomstack", doc["name"])
+    require.Equal(t, "Contains OS data", doc["attribution"])
+    require.Equal(t, []interface{}{"http://tiles.example.com/zoomstack/{z}/{x}/{y}/tile.mvt"}, doc["tiles"])
+    require.Equal(t, 0.0, doc["minzoom"])
+    require.Equal(t, 14.0, doc["maxzoom"])
+    require.Equal(t, []interface{}{-9.0, 49.8, 2.0, 61.0}, doc["bounds"])
+    require.Equal(t, []interface{}{-1.4, 50.9, 7.0}, doc["center"])
+    require.Equal(t, []interface{}{map[string]interface{}{
+        "id":      "roads",
+        "fields":  map[string]interface{}{"type": "String"},
+        "minzoom": 2.0,
+    }}, doc["vector_layers"])
+
+    // the tile URLs are always XYZ, whatever the scheme of the package
+    require.Equal(t, "xyz", doc["scheme"])
+
+    // raster tilesets use the PNG route, empty bounds, center and layers are left out
+    doc = readTileJSON(t, get(r, "http://tiles.example.com/hillshade.json"))
+    require.Equal(t, []interface{}{"http://tiles.example.com/hillshade/{z}/{x}/{y}/hs.png"}, doc["tiles"])
+    require.NotContains(t, doc, "bounds")
+    require.NotContains(t, doc, "center")
+    require.NotContains(t, doc, "vector_layers")
+
+    // the unnamed route serves the fallback tileset
+    doc = readTileJSON(t, get(r, "http://tiles.example.com/tiles.json"))
+    require.Equal(t, "OS Open Zoomstack", doc["name"])
+
+    // other raster formats have their own route, unsupported formats have no document
+    doc = readTileJSON(t, get(r, "http://tiles.example.com/photo.json"))
+    require.Equal(t, []interface{}{"http://tiles.example.com/photo/{z}/{x}/{y}/tile.jpg"}, doc["tiles"])
+    require.Equal(t, http.StatusNotFound, get(r, "http://tiles.example.com/unknown.json").Code)
+
+    require.Equal(t, http.StatusNotFound, get(r, "http://tiles.example.com/other.json").Code)
+}
+
+func TestTileJSONHandler_BaseURL(t *testing.T) {
+    r := newTileJSONRouter(t)
+
+    // the forwarded headers are ignored unless proxy support is enabled
+    w := get(r, "http://internal:8080/zoomstack.json", "X-Forwarded-Proto", "https", "X-Forwarded-Host", "tiles.example.com")
+    require.Equal(t, []interface{}{"http://internal:8080/zoomstack/{z}/{x}/{y}/tile.mvt"}, readTileJSON(t, w)["tiles"])
+
+    w = get(handlers.ProxyHeaders(r), "http://internal:8080/zoomstack.json", "X-Forwarded-Proto", "https", "X-Forwarded-Host", "tiles.example.com")
+    require.Equal(t, []interface{}{"https://tiles.example.com/zoomstack/{z}/{x}/{y}/tile.mvt"}, readTileJSON(t, w)["tiles"])
+
+    // a direct TLS connection
+    req := httptest.NewRequest("GET", "https://tiles.example.com/zoomstack.json", nil)
+    req.TLS = &tls.ConnectionState{}
+    require.Equal(t, "https://tiles.example.com", baseURL(req))
+}
@@ -1,24 +1,31 @@
 package web
 
 import (
+    "context"
     "encoding/json"
     "github.com/gorilla/mux"
     "io"
-    "log"
     "net/http"
     "os"
-    "osdata/osvtile/container/lru"
     "osdata/osvtile/mbtiles"
+    "osdata/osvtile/tile"
+    "osdata/osvtile/tileset"
+    "osdata/osvtile/trace"
     "path/filepath"
     "strconv"
     "strings"
     "time"
 )
 
+// statusClientClosedRequest is recorded for requests given up by the client before a response could be written, as
+// used by nginx
+const statusClientClosedRequest = 499
+
 // StatusResponseWriter holds the status code that the server wrote to the client.
 // This allows upstream logging of the response
 type StatusResponseWriter struct {
     status int
+    size   int
     writer http.ResponseWriter
 }
 
@@ -27,7 +34,9 @@ func (s *StatusResponseWriter) Header() http.Header {
 }
 
 func (s *StatusResponseWriter) Write(b []byte) (int, error) {
-    return s.writer.Write(b)
+    n, err := s.writer.Write(b)
+    s.size += n
+    return n, err
 }
 
 func (s *StatusResponseWriter) WriteHeader(status int) {
@@ -46,7 +55,21 @@ func (e *Error) Error() string {
     return e.Message
 }
 
-func NewStatusHandler(metrics *Metrics, cache *lru.LRU) http.HandlerFunc {
+// preloadStats reports the footprint and load time of each tileset held in memory
+func preloadStats(tilesets *tileset.Registry) map[string]mbtiles.MemoryStats {
+    stats := map[string]mbtiles.MemoryStats{}
+
+    for _, name := range tilesets.Names() {
+        if m, ok := tilesets.Get(name).Source.(*mbtiles.Memory); ok {
+            stats[name] = m.Stats()
+        }
+    }
+
+    return stats
+}
+
+// NewStatusHandler reports the cache and request statistics, along with the memory held by each preloaded tileset
+func NewStatusHandler(metrics *Metrics, tiles *TileFetcher, tilesets *tileset.Registry) http.HandlerFunc {
     return func(w http.ResponseWriter, r *http.Request) {
 
         if r.Method == "OPTIONS" {
@@ -61,16 +84,20 @@ func NewStatusHandler(metrics *Metrics, cache *lru.LRU) http.HandlerFunc {
         defer metrics.rw.RUnlock()
 
         status := map[string]interface{}{
-            "cache": cache.Status(),
+            "cache":    tiles.Status(),
             "requests": metrics,
         }
 
+        if preloaded := preloadStats(tilesets); len(preloaded) > 0 {
+            status["preloaded"] = preloaded
+        }
+
         packet, _ := json.Marshal(status)
         w.Header().Add("content-size", strconv.Itoa(len(packet)))
         _, err := w.Write(packet)
 
         if err != nil {
-            log.Printf("failed to write status to client: error = %s", err)
+            trace.Printf(r.Context(), "failed to write status to client: error = %s", err)
         }
 
         return
@@ -85,20 +112,72 @@ func NewClacksHandler(h http.Handler) http.Handler {
     })
 }
 
-// NewRequestHandler wraps a handler func to provide standard request logging and setup
-func NewRequestHandler(m *Metrics, h http.Handler) http.Handler {
+// NewTraceHandler takes the request ID from the `X-Request-ID` header, generating one if the header is missing or
+// invalid, along with any W3C `traceparent` header. Both are stored in the request context, for the logs, and echoed
+// back in the response.
+func NewTraceHandler(h http.Handler) http.Handler {
     return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-        start := time.Now().UTC().UnixNano()
+        t := &trace.Trace{RequestID: r.Header.Get("X-Request-ID")}
+
+        if !trace.ValidRequestID(t.RequestID) {
+            t.RequestID = trace.NewRequestID()
+        }
+
+        w.Header().Set("X-Request-ID", t.RequestID)
+
+        if value := r.Header.Get("traceparent"); value != "" {
+            if parent, err := trace.ParseTraceparent(value); err == nil {
+                t.Parent = parent
+                w.Header().Set("traceparent", parent.String())
+            }
+        }
+
+        h.ServeHTTP(w, r.WithContext(trace.NewContext(r.Context(), t)))
+    })
+}
+
+// NewRequestHandler wraps a handler func to provide standard request logging, to the access logger, and setup
+func NewRequestHandler(m *Metrics, logger AccessLogger, h http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        start := time.Now().UTC()
+        r, info := withRequestInfo(r)
+
+        // deferred so a panicking handler, recovered by the server, is not left counted as in flight
+        m.inFlight.add(1)
+        defer m.inFlight.add(-1)
 
         sw := &StatusResponseWriter{status: http.StatusOK, writer: w}
         h.ServeHTTP(sw, r)
-        delta := time.Now().UTC().UnixNano() - start
-        log.Printf(
-            "Request handled: addr: %s, method: %s, uri:%s, userAgent: %s, startTime: %d, deltaTime: %d, status:%d",
-            r.RemoteAddr, r.Method, r.RequestURI, r.UserAgent(), start/1000, delta/1000, sw.status,
-        )
+        delta := time.Now().UTC().Sub(start)
+        t := trace.FromContext(r.Context())
+
+        if t == nil {
+            t = &trace.Trace{}
+        }
+
+        logger.Log(&AccessEntry{
+            Start:      start,
+            Duration:   delta,
+            RemoteAddr: r.RemoteAddr,
+            Method:     r.Method,
+            URI:        r.RequestURI,
+            Proto:      r.Proto,
+            Referer:    r.Referer(),
+            UserAgent:  r.UserAgent(),
+            Status:     sw.status,
+            Bytes:      sw.size,
+            RequestID:  t.RequestID,
+            TraceID:    t.TraceID(),
+            Tileset:    info.tileset,
+            Z:          info.z,
+            X:          info.x,
+            Y:          info.y,
+            Cache:      info.cache,
+            FetchTime:  info.fetchTime,
+        })
 
         m.Log(r, sw.status)
+        m.observe(r, info, sw.status, delta)
     })
 }
 
@@ -119,15 +198,15 @@ func NewFontHandler(path string) http.HandlerFunc {
         fontFile, err := os.Open(filepath.Join(path, stacks[0], file))
 
         if err != nil {
-            log.Printf("failed to open font path: requested font = %s, file = %s, error = %s", stacks[0], file, err)
+            trace.Printf(r.Context(), "failed to open font path: requested font = %s, file = %s, error = %s", stacks[0], file, err)
             w.WriteHeader(http.StatusInternalServerError)
             return
         }
 
         defer func() {
             if err := fontFile.Close(); err != nil {
-                log.Printf(
-                    "failed to close font file: error = %s, path = %s",
+                trace.Printf(
+                    r.Context(), "failed to close font file: error = %s, path = %s",
                     err, filepath.Join(path, stacks[0], file),
                 )
             }
@@ -137,99 +216,155 @@ func NewFontHandler(path string) http.HandlerFunc {
         _, err = io.Copy(w, fontFile)
 
         if err != nil {
-            log.Printf("failed to write font to client: requested font = %s, file = %s, error = %s", stacks[0], file, err)
+            trace.Printf(r.Context(), "failed to write font to client: requested font = %s, file = %s, error = %s", stacks[0], file, err)
             w.WriteHeader(http.StatusInternalServerError)
             return
         }
     }
 }
 
-func NewRasterDEMRequestHandler(d *mbtiles.MBTiles, cache *lru.LRU) http.HandlerFunc {
+// NewRasterDEMRequestHandler serves raster (PNG) tiles from the tileset named in the request, or the `fallback`
+// tileset when the route does not include a name
+func NewRasterDEMRequestHandler(tilesets *tileset.Registry, fallback string, tiles *TileFetcher) http.HandlerFunc {
+    return NewTileRequestHandler(tilesets, fallback, tiles, FormatPNG)
+}
+
+// NewMVTRequestHandler serves vector tiles from the tileset named in the request, or the `fallback` tileset when
+// the route does not include a name
+func NewMVTRequestHandler(tilesets *tileset.Registry, fallback string, tiles *TileFetcher) http.HandlerFunc {
+    return NewTileRequestHandler(tilesets, fallback, tiles, FormatMVT)
+}
+
+// NewTileRequestHandler serves tiles of the given format from the tileset named in the request, or the `fallback`
+// tileset when the route does not include a name
+func NewTileRequestHandler(tilesets *tileset.Registry, fallback string, tiles *TileFetcher, format TileFormat) http.HandlerFunc {
     return func(w http.ResponseWriter, r *http.Request) {
-        vars := mux.Vars(r)
-        x, _ := strconv.Atoi(vars["x"])
-        y, _ := strconv.Atoi(vars["y"])
-        z, _ := strconv.Atoi(vars["z"])
+        serveTile(w, r, tilesets, fallback, tiles, format)
+    }
+}
 
-        var err error
-        tile, md5 := cache.Get(r.RequestURI)
+// serveTile resolves the tileset for the request and writes the tile (from cache or the tileset) to the client. The
+// format keeps the cached tiles of each route apart and sets the content headers. Rows are in the XYZ scheme unless
+// the route has a `tms` scheme variable.
+func serveTile(
+    w http.ResponseWriter, r *http.Request, tilesets *tileset.Registry, fallback string, tiles *TileFetcher,
+    format TileFormat,
+) {
+    vars := mux.Vars(r)
+    x, _ := strconv.Atoi(vars["x"])
+    y, _ := strconv.Atoi(vars["y"])
+    z, _ := strconv.Atoi(vars["z"])
+
+    name, ok := vars["name"]
+
+    if !ok {
+        name = fallback
+    }
 
-        if tile == nil {
-            tile, err = d.FetchTile(x, y, z)
+    ts := tilesets.Get(name)
 
-            if tile == nil {
-                w.WriteHeader(http.StatusNotFound)
-                return
-            }
+    // a route only serves the tilesets of its own format, so e.g. PNG tiles are never sent as gzipped vector tiles
+    if ts == nil || !formatMatches(ts, format) {
+        w.WriteHeader(http.StatusNotFound)
+        return
+    }
 
-            if err != nil {
-                log.Printf("failed to fetch tile from datasource: error = %s", err)
-                w.WriteHeader(http.StatusInternalServerError)
-                return
-            }
+    info := getRequestInfo(r)
+    info.tileset = ts.Name
+    info.format = format.Name
+    info.z, info.x, info.y = z, x, y
 
-            md5 = cache.Set(r.RequestURI, tile)
-        }
+    scheme := mbtiles.XYZ
 
-        // tiles are in gzip format already
-        w.Header().Set("content-length", strconv.Itoa(len(tile)))
-        w.Header().Set("content-type", "image/png")
-        w.Header().Set("etag", md5)
-        w.WriteHeader(http.StatusOK)
-        c, err := w.Write(tile)
+    if vars["scheme"] == string(mbtiles.TMS) {
+        scheme = mbtiles.TMS
+    }
 
-        if err != nil {
-            log.Printf("failed to write tile data to client: error = %s", err)
-        }
+    // cache keys always use the XYZ row so both schemes share the cached tiles
+    key := tile.Key{Tileset: ts.Name, Format: format.Name, Z: z, X: x, Y: y}
+
+    if scheme != mbtiles.XYZ {
+        key.Y = mbtiles.FlipY(y, z)
+    }
+
+    fetch := sourceFetch(ts, key)
+    data, md5, result, err := tiles.fetch(r.Context(), key, func(ctx context.Context) ([]byte, error) {
+        start := time.Now()
+        defer func() {
+            info.fetchTime = time.Since(start)
+        }()
 
-        if c != len(tile) {
-            log.Printf("failed to write whole tile to client: tile size = %d, written = %d", len(tile), c)
+        return fetch(ctx)
+    })
+
+    info.cache = result
+
+    if err != nil {
+        switch {
+        case r.Context().Err() != nil:
+            trace.Printf(r.Context(), "client went away before tile was fetched: tileset = %s, error = %s", ts.Name, err)
+            w.WriteHeader(statusClientClosedRequest)
+        case err == context.DeadlineExceeded:
+            trace.Printf(r.Context(), "timed out fetching tile from datasource: tileset = %s, timeout = %s", ts.Name, ts.FetchTimeout)
+            w.WriteHeader(http.StatusGatewayTimeout)
+        default:
+            trace.Printf(r.Context(), "failed to fetch tile from datasource: tileset = %s, error = %s", ts.Name, err)
+            w.WriteHeader(http.StatusInternalServerError)
         }
+
+        return
     }
-}
 
-func NewMVTRequestHandler(d *mbtiles.MBTiles, cache *lru.LRU) http.HandlerFunc {
-    return func(w http.ResponseWriter, r *http.Request) {
-        vars := mux.Vars(r)
-        x, _ := strconv.Atoi(vars["x"])
-        y, _ := strconv.Atoi(vars["y"])
-        z, _ := strconv.Atoi(vars["z"])
+    if data == nil {
+        w.WriteHeader(http.StatusNotFound)
+        return
+    }
 
-        var err error
-        tile, md5 := cache.Get(r.RequestURI)
+    etag := quoteETag(md5)
+    setCacheHeaders(w.Header(), ts, etag)
 
-        if tile == nil {
-            tile, err = d.FetchTile(x, y, z)
+    if notModified(r, etag, ts.ModTime) {
+        w.WriteHeader(http.StatusNotModified)
+        return
+    }
 
-            if tile == nil {
-                w.WriteHeader(http.StatusNotFound)
-                return
-            }
+    format.setHeaders(w.Header())
+    w.Header().Set("content-length", strconv.Itoa(len(data)))
+    w.WriteHeader(http.StatusOK)
+    c, err := w.Write(data)
+    info.size = c
 
-            if err != nil {
-                log.Printf("failed to fetch tile from datasource: error = %s", err)
-                w.WriteHeader(http.StatusInternalServerError)
-                return
-            }
+    if err != nil {
+        trace.Printf(r.Context(), "failed to write tile data to client: error = %s", err)
+    }
 
-            md5 = cache.Set(r.RequestURI, tile)
-        }
+    if c != len(data) {
+        trace.Printf(r.Context(), "failed to write whole tile to client: tile size = %d, written = %d", len(data), c)
+    }
+}
 
-        // tiles are in gzip format already
-        w.Header().Set("content-length", strconv.Itoa(len(tile)))
-        w.Header().Set("content-encoding", "gzip")
-        w.Header().Set("content-type", "application/x-protobuf")
-        w.Header().Set("etag", md5)
-        w.WriteHeader(http.StatusOK)
-        c, err := w.Write(tile)
+// formatMatches reports if the tileset can be served by the route for the format. Packages without a format in their
+// metadata are served by any route, packages of an unsupported format by none.
+func formatMatches(ts *tileset.Tileset, format TileFormat) bool {
+    if ts.Version == nil || ts.Version.Format == "" {
+        return true
+    }
 
-        if err != nil {
-            log.Printf("failed to write tile data to client: error = %s", err)
-        }
+    f, ok := tilesetFormat(ts)
+    return ok && f == format
+}
 
-        if c != len(tile) {
-            log.Printf("failed to write whole tile to client: tile size = %d, written = %d", len(tile), c)
+// sourceFetch creates the func to load the tile for the key from the tileset source, within the tileset's fetch
+// timeout (if it has one)
+func sourceFetch(ts *tileset.Tileset, key tile.Key) FetchFunc {
+    return func(ctx context.Context) ([]byte, error) {
+        if ts.FetchTimeout > 0 {
+            var cancel context.CancelFunc
+            ctx, cancel = context.WithTimeout(ctx, ts.FetchTimeout)
+            defer cancel()
         }
+
+        return ts.Source.FetchTileContext(ctx, key.X, ts.Row(key.Y, key.Z, mbtiles.XYZ), key.Z)
     }
 }
 
@@ -0,0 +1,191 @@
+package web
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "fmt"
+    "github.com/gorilla/mux"
+    "github.com/stretchr/testify/require"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "osdata/osvtile/container/lru"
+    "osdata/osvtile/mbtiles"
+    "osdata/osvtile/mbtiles/mbtilestest"
+    "osdata/osvtile/tile"
+    "osdata/osvtile/tileset"
+    "osdata/osvtile/trace"
+    "path/filepath"
+    "testing"
+)
+
+// newTileRouter routes the named tile requests of both schemes as the server does, with a fresh tile cache
+func newTileRouter(tilesets *tileset.Registry) *mux.Router {
+    tiles := NewTileFetcher(lru.New(1024*1024, lru.WithNamespaces(tile.Namespace)), nil, nil)
+
+    r := mux.NewRouter()
+    r.HandleFunc("/{scheme:tms}/{name:[A-Za-z0-9_]+}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}/tile.mvt", NewMVTRequestHandler(tilesets, "", tiles))
+    r.HandleFunc("/{scheme:tms}/{name:[A-Za-z0-9_]+}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}/hs.png", NewRasterDEMRequestHandler(tilesets, "", tiles))
+    r.HandleFunc("/{name:[A-Za-z0-9_]+}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}/tile.mvt", NewMVTRequestHandler(tilesets, "", tiles))
+    r.HandleFunc("/{name:[A-Za-z0-9_]+}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}/hs.png", NewRasterDEMRequestHandler(tilesets, "", tiles))
+    r.HandleFunc("/{name:[A-Za-z0-9_]+}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}/tile.jpg", NewTileRequestHandler(tilesets, "", tiles, FormatJPG))
+
+    return r
+}
+
+// get makes a GET request to the handler
+func get(h http.Handler, path string, headers ...string) *httptest.ResponseRecorder {
+    r := httptest.NewRequest("GET", path, nil)
+
+    for i := 0; i+1 < len(headers); i += 2 {
+        r.Header.Set(headers[i], headers[i+1])
+    }
+
+    w := httptest.NewRecorder()
+    h.ServeHTTP(w, r)
+
+    return w
+}
+
+func TestServeTile_Format(t *testing.T) {
+    tilesets := tileset.NewRegistry()
+    _, err := tilesets.Add(tileset.Config{Name: "vector", Scheme: "tms"}, mbtilestest.NewSource("pbf"))
+    require.NoError(t, err)
+    _, err = tilesets.Add(tileset.Config{Name: "raster", Scheme: "tms"}, mbtilestest.NewSource("png"))
+    require.NoError(t, err)
+    _, err = tilesets.Add(tileset.Config{Name: "photo", Scheme: "tms"}, mbtilestest.NewSource("jpg"))
+    require.NoError(t, err)
+    _, err = tilesets.Add(tileset.Config{Name: "unknown", Scheme: "tms"}, mbtilestest.NewSource("tiff"))
+    require.NoError(t, err)
+
+    r := newTileRouter(tilesets)
+
+    w := get(r, "/vector/0/0/0/tile.mvt")
+    require.Equal(t, http.StatusOK, w.Code)
+    require.Equal(t, "gzip", w.Header().Get("content-encoding"))
+
+    w = get(r, "/raster/0/0/0/hs.png")
+    require.Equal(t, http.StatusOK, w.Code)
+    require.Equal(t, "image/png", w.Header().Get("content-type"))
+    require.Empty(t, w.Header().Get("content-encoding"))
+
+    w = get(r, "/photo/0/0/0/tile.jpg")
+    require.Equal(t, http.StatusOK, w.Code)
+    require.Equal(t, "image/jpeg", w.Header().Get("content-type"))
+
+    // each route only serves tilesets of its own format
+    require.Equal(t, http.StatusNotFound, get(r, "/raster/0/0/0/tile.mvt").Code)
+    require.Equal(t, http.StatusNotFound, get(r, "/vector/0/0/0/hs.png").Code)
+    require.Equal(t, http.StatusNotFound, get(r, "/other/0/0/0/tile.mvt").Code)
+    require.Equal(t, http.StatusNotFound, get(r, "/photo/0/0/0/hs.png").Code)
+
+    // unsupported formats are not served by any route
+    require.Equal(t, http.StatusNotFound, get(r, "/unknown/0/0/0/hs.png").Code)
+    require.Equal(t, http.StatusNotFound, get(r, "/unknown/0/0/0/tile.jpg").Code)
+}
+
+func TestTraceHandler(t *testing.T) {
+    var traced *trace.Trace
+    h := NewTraceHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        traced = trace.FromContext(r.Context())
+    }))
+
+    // the client's request ID and traceparent are kept and echoed
+    r := httptest.NewRequest("GET", "/", nil)
+    r.Header.Set("X-Request-ID", "client-id-1")
+    r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+    w := httptest.NewRecorder()
+    h.ServeHTTP(w, r)
+
+    require.Equal(t, "client-id-1", traced.RequestID)
+    require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", traced.TraceID())
+    require.Equal(t, "client-id-1", w.Header().Get("X-Request-ID"))
+    require.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", w.Header().Get("traceparent"))
+
+    // an invalid request ID is replaced and an invalid traceparent ignored
+    r = httptest.NewRequest("GET", "/", nil)
+    r.Header.Set("X-Request-ID", "bad id\n")
+    r.Header.Set("traceparent", "00-bad")
+    w = httptest.NewRecorder()
+    h.ServeHTTP(w, r)
+
+    require.Len(t, traced.RequestID, 32)
+    require.Nil(t, traced.Parent)
+    require.Equal(t, traced.RequestID, w.Header().Get("X-Request-ID"))
+    require.Empty(t, w.Header().Get("traceparent"))
+}
+
+// gridSource holds every tile, each tile being its stored location, in the given scheme
+func gridSource(scheme mbtiles.Scheme) *mbtilestest.Source {
+    return &mbtilestest.Source{
+        Meta: &mbtiles.Version{Name: "grid", Format: "pbf", Scheme: scheme, Maxzoom: 14},
+        Tile: func(ctx context.Context, x, y, z int) ([]byte, error) {
+            return []byte(fmt.Sprintf("%d/%d/%d", z, x, y)), nil
+        },
+    }
+}
+
+func TestServeTile_Scheme(t *testing.T) {
+    tilesets := tileset.NewRegistry()
+    _, err := tilesets.Add(tileset.Config{Name: "stored_tms"}, gridSource(""))
+    require.NoError(t, err)
+    _, err = tilesets.Add(tileset.Config{Name: "stored_xyz"}, gridSource(mbtiles.XYZ))
+    require.NoError(t, err)
+
+    r := newTileRouter(tilesets)
+
+    // the XYZ and TMS routes address the same tile with flipped rows, whatever the stored scheme
+    for name, stored := range map[string]string{"stored_tms": "2/1/3", "stored_xyz": "2/1/0"} {
+        xyz := get(r, fmt.Sprintf("/%s/2/1/0/tile.mvt", name))
+        tms := get(r, fmt.Sprintf("/tms/%s/2/1/3/tile.mvt", name))
+
+        require.Equal(t, http.StatusOK, xyz.Code)
+        require.Equal(t, http.StatusOK, tms.Code)
+        require.Equal(t, stored, xyz.Body.String(), name)
+        require.Equal(t, stored, tms.Body.String(), name)
+        require.Equal(t, xyz.Header().Get("etag"), tms.Header().Get("etag"))
+    }
+}
+
+func TestStatusHandler(t *testing.T) {
+    dir, err := ioutil.TempDir("", "status-test")
+    require.NoError(t, err)
+    defer os.RemoveAll(dir)
+
+    path := filepath.Join(dir, "preloaded.mbtiles")
+    db, err := sql.Open("sqlite3", path)
+    require.NoError(t, err)
+    _, err = db.Exec(`
+        create table metadata (name text, value text);
+        create table tiles (zoom_level integer, tile_column integer, tile_row integer, tile_data blob);
+        insert into metadata values ('format', 'pbf');
+        insert into tiles values (0, 0, 0, 'tile');
+    `)
+    require.NoError(t, err)
+    require.NoError(t, db.Close())
+
+    tilesets := tileset.NewRegistry()
+    defer tilesets.Close()
+
+    _, err = tilesets.Load(tileset.Config{Name: "preloaded", Path: path, Preload: true})
+    require.NoError(t, err)
+    _, err = tilesets.Add(tileset.Config{Name: "fake"}, mbtilestest.NewSource("pbf"))
+    require.NoError(t, err)
+
+    h := NewStatusHandler(NewMetrics(), NewTileFetcher(lru.New(1024*1024), nil, nil), tilesets)
+    w := get(h, "/status")
+    require.Equal(t, http.StatusOK, w.Code)
+
+    var status struct {
+        Preloaded map[string]mbtiles.MemoryStats `json:"preloaded"`
+    }
+    require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+
+    // only the preloaded tileset is reported
+    require.Len(t, status.Preloaded, 1)
+    require.Equal(t, 1, status.Preloaded["preloaded"].Tiles)
+    require.True(t, status.Preloaded["preloaded"].Bytes > 0)
+    require.True(t, status.Preloaded["preloaded"].LoadTime > 0)
+}